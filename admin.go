@@ -0,0 +1,336 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-playground/log"
+	"github.com/gorilla/mux"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// startAdminListener serves the admin routes, along with /metrics, on their
+// own listeners so they don't have to be reachable from the internet. The
+// tcp listener needs a token like the admin host does, the unix socket is
+// only reachable by whoever can open it, so it doesn't
+func startAdminListener() {
+	if *adminListen != "" {
+		l, err := net.Listen("tcp", *adminListen)
+		if err != nil {
+			log.Fatal(err)
+			panic(err)
+		}
+		serveAdmin(l, newAdminRouter(true))
+	}
+
+	if *adminSocket != "" {
+		if c, err := net.Dial("unix", *adminSocket); err == nil {
+			c.Close()
+			log.Errorf("%s is in use by another process, not listening on it", *adminSocket)
+			return
+		}
+		// Left over from the last run
+		os.Remove(*adminSocket)
+
+		l, err := net.Listen("unix", *adminSocket)
+		if err != nil {
+			log.Fatal(err)
+			panic(err)
+		}
+		if err := os.Chmod(*adminSocket, 0600); err != nil {
+			log.Fatal(err)
+			panic(err)
+		}
+		serveAdmin(l, newAdminRouter(false))
+	}
+}
+
+func serveAdmin(l net.Listener, h http.Handler) {
+	srv := &http.Server{
+		Handler: h,
+
+		ReadTimeout: 5 * time.Second,
+		IdleTimeout: 120 * time.Second,
+	}
+
+	log.Infof("Admin listening on %s", l.Addr())
+	go func() {
+		log.Error(srv.Serve(l))
+	}()
+}
+
+func newAdminRouter(auth bool) *mux.Router {
+	r := mux.NewRouter()
+	r.Path("/metrics").Methods("GET").HandlerFunc(metricsHandler)
+	setupAdminRoutes(r, auth)
+	return r
+}
+
+// setupAdminRoutes registers everything we only want the people running the
+// server to see, behind a token or login cookie when auth is set
+func setupAdminRoutes(r *mux.Router, auth bool) {
+	if auth {
+		r.Path("/login").Methods("GET").HandlerFunc(adminLoginPageHandler)
+		r.Path("/login").Methods("POST").HandlerFunc(adminLoginHandler)
+		r.Path("/logout").Methods("POST").HandlerFunc(adminLogoutHandler)
+		r = r.PathPrefix("/").Subrouter()
+		r.Use(requireAdmin)
+	}
+
+	r.Path("/api/status").Methods("GET").HandlerFunc(statusHandler)
+	r.Path("/api/domains").Methods("GET").HandlerFunc(domainsHandler)
+	r.Path("/api/domains").Methods("POST").HandlerFunc(addDomainHandler)
+	r.Path("/api/domains/{domain}").Methods("DELETE").HandlerFunc(removeDomainHandler)
+	r.Path("/api/domains/{domain}/approve").Methods("POST").HandlerFunc(approveDomainHandler)
+	r.Path("/api/certs").Methods("GET").HandlerFunc(certsHandler)
+	r.Path("/api/certs/{domain}/renew").Methods("POST").HandlerFunc(renewCertHandler)
+	r.Path("/api/cache/purge").Methods("POST").HandlerFunc(purgeCacheHandler)
+	r.Path("/api/proxy-cache/purge").Methods("POST").HandlerFunc(purgeProxyCacheHandler)
+	r.Path("/api/reload").Methods("POST").HandlerFunc(reloadHandler)
+	r.Path("/api/analytics").Methods("GET").HandlerFunc(analyticsSitesHandler)
+	r.Path("/api/analytics/{host}").Methods("GET").HandlerFunc(analyticsSiteHandler)
+	// Following the log holds the response open for as long as it's wanted
+	r.Path("/api/logs").Methods("GET").Handler(withWriteTimeout(0, http.HandlerFunc(logsAPIHandler)))
+	r.Path("/api/links").Methods("GET").HandlerFunc(shortLinksHandler)
+	r.Path("/api/links").Methods("POST").HandlerFunc(createShortLinkHandler)
+	r.Path("/api/links/{host}/{slug:.+}").Methods("GET").HandlerFunc(shortLinkHandler)
+	r.Path("/api/links/{host}/{slug:.+}").Methods("PUT", "PATCH").HandlerFunc(updateShortLinkHandler)
+	r.Path("/api/links/{host}/{slug:.+}").Methods("DELETE").HandlerFunc(removeShortLinkHandler)
+	r.Path("/api/dyndns").Methods("GET").HandlerFunc(dyndnsListHandler)
+	r.Path("/api/dyndns/zone").Methods("GET").HandlerFunc(dyndnsZoneHandler)
+	r.Path("/api/dyndns/{hostname}").Methods("DELETE").HandlerFunc(dyndnsRemoveHandler)
+	r.Path("/analytics/{host}").Methods("GET").HandlerFunc(analyticsDashboardHandler)
+	r.Path("/").Methods("GET").HandlerFunc(analyticsDashboardHandler)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// queryInt reads a positive integer from the query string, falling back to def
+func queryInt(r *http.Request, name string, def int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+type analyticsDay struct {
+	Day string `json:"day"`
+	*siteDay
+}
+
+type analyticsSummary struct {
+	Host       string         `json:"host"`
+	Days       int            `json:"days"`
+	Requests   int64          `json:"requests"`
+	Pageviews  int64          `json:"pageviews"`
+	Visitors   int64          `json:"visitors"`
+	Bytes      int64          `json:"bytes"`
+	Paths      []countEntry   `json:"paths,omitempty"`
+	Referrers  []countEntry   `json:"referrers,omitempty"`
+	UserAgents []countEntry   `json:"user_agents,omitempty"`
+	Status     []countEntry   `json:"status,omitempty"`
+	Daily      []analyticsDay `json:"daily,omitempty"`
+	// Some of the visitors may have been counted twice, see siteDay
+	VisitorsApproximate bool `json:"visitors_approximate,omitempty"`
+}
+
+// summarize builds the summary for host over the last days days, with at
+// most limit entries in each breakdown
+func summarize(host string, days, limit int, daily bool) (*analyticsSummary, error) {
+	total, perDay, err := analyticsRange(host, days)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &analyticsSummary{
+		Host:                host,
+		Days:                days,
+		Requests:            total.Requests,
+		Pageviews:           total.Pageviews,
+		Visitors:            total.Visitors,
+		Bytes:               total.Bytes,
+		Paths:               topCounts(total.Paths, limit),
+		Referrers:           topCounts(total.Referrers, limit),
+		UserAgents:          topCounts(total.UserAgents, limit),
+		Status:              topCounts(total.Status, limit),
+		VisitorsApproximate: total.VisitorsApproximate,
+	}
+
+	if daily {
+		for day, d := range perDay {
+			s.Daily = append(s.Daily, analyticsDay{day, d})
+		}
+		sort.Slice(s.Daily, func(i, j int) bool { return s.Daily[i].Day < s.Daily[j].Day })
+	}
+
+	return s, nil
+}
+
+func analyticsSitesHandler(w http.ResponseWriter, r *http.Request) {
+	days := queryInt(r, "days", 30)
+
+	hosts, err := analyticsSites()
+	if err != nil {
+		log.Error(err)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sites := []*analyticsSummary{}
+	for _, host := range hosts {
+		s, err := summarize(host, days, 0, false)
+		if err != nil {
+			log.Error(err)
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// The list view only needs the totals
+		s.Paths, s.Referrers, s.UserAgents, s.Status = nil, nil, nil, nil
+		sites = append(sites, s)
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Pageviews > sites[j].Pageviews })
+
+	writeJSON(w, http.StatusOK, sites)
+}
+
+func analyticsSiteHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := summarize(mux.Vars(r)["host"], queryInt(r, "days", 30), queryInt(r, "limit", 25), true)
+	if err != nil {
+		log.Error(err)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+var analyticsDashboard = template.Must(template.New("analytics").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Site}}{{.Site.Host}} - {{end}}Analytics</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: .25em .5em; border-bottom: 1px solid #ddd; }
+td.n, th.n { text-align: right; }
+nav a { margin-right: 1em; }
+</style>
+</head>
+<body>
+<nav>{{$days := .Days}}<a href="/">All sites</a> Last {{range .Ranges}}<a href="?days={{.}}">{{.}}d</a> {{end}}</nav>
+{{if .Site}}{{with .Site}}
+<h1>{{.Host}} <small>last {{.Days}} days</small></h1>
+<table>
+<tr><th>Pageviews</th><th>Visitors</th><th>Requests</th><th>Bytes</th></tr>
+<tr><td>{{.Pageviews}}</td><td>{{template "visitors" .}}</td><td>{{.Requests}}</td><td>{{.Bytes}}</td></tr>
+</table>
+<h2>Daily</h2>
+<table>
+<tr><th>Day</th><th class="n">Pageviews</th><th class="n">Visitors</th><th class="n">Requests</th><th class="n">Bytes</th></tr>
+{{range .Daily}}<tr><td>{{.Day}}</td><td class="n">{{.Pageviews}}</td><td class="n">{{template "visitors" .}}</td><td class="n">{{.Requests}}</td><td class="n">{{.Bytes}}</td></tr>
+{{end}}</table>
+<h2>Paths</h2>
+<table>{{range .Paths}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>
+<h2>Referrers</h2>
+<table>{{range .Referrers}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>
+<h2>Browsers</h2>
+<table>{{range .UserAgents}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>
+<h2>Status codes</h2>
+<table>{{range .Status}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>
+{{end}}{{else}}
+<h1>Sites <small>last {{.Days}} days</small></h1>
+<table>
+<tr><th>Host</th><th class="n">Pageviews</th><th class="n">Visitors</th><th class="n">Requests</th><th class="n">Bytes</th></tr>
+{{range .Sites}}<tr><td><a href="/analytics/{{.Host}}?days={{$days}}">{{.Host}}</a></td><td class="n">{{.Pageviews}}</td><td class="n">{{template "visitors" .}}</td><td class="n">{{.Requests}}</td><td class="n">{{.Bytes}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Approximate}}<p><small>~ some visitors may have been counted twice, the server was restarted part way through the day</small></p>{{end}}
+</body>
+</html>
+{{define "visitors"}}{{if .VisitorsApproximate}}~{{end}}{{.Visitors}}{{end}}
+`))
+
+func analyticsDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Days   int
+		Ranges []int
+		Site   *analyticsSummary
+		Sites  []*analyticsSummary
+		// Whether any of the visitor counts shown are approximate
+		Approximate bool
+	}{
+		Days:   queryInt(r, "days", 30),
+		Ranges: []int{1, 7, 30, 90, 365},
+	}
+
+	if host := mux.Vars(r)["host"]; host != "" {
+		s, err := summarize(host, data.Days, 25, true)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Site = s
+		data.Approximate = s.VisitorsApproximate
+	} else {
+		hosts, err := analyticsSites()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, host := range hosts {
+			s, err := summarize(host, data.Days, 0, false)
+			if err != nil {
+				log.Error(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data.Sites = append(data.Sites, s)
+			data.Approximate = data.Approximate || s.VisitorsApproximate
+		}
+		sort.Slice(data.Sites, func(i, j int) bool { return data.Sites[i].Pageviews > data.Sites[j].Pageviews })
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := analyticsDashboard.Execute(w, data); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAdminHostNeedsAuth checks nothing on the admin host, the analytics
+// dashboard included, is served to someone who hasn't logged in
+func TestAdminHostNeedsAuth(t *testing.T) {
+	openTestDB(t)
+	token := "0123456789abcdef0123"
+	setTestConfig(t, &Config{AdminTokens: []string{token}})
+	r := mux.NewRouter()
+	setupAdminRoutes(r.Host("admin.test").Subrouter(), true)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusFound},
+		{"/analytics/example.com", http.StatusFound},
+		{"/api/analytics", http.StatusUnauthorized},
+		{"/api/analytics/example.com", http.StatusUnauthorized},
+		{"/api/logs", http.StatusUnauthorized},
+		{"/api/links", http.StatusUnauthorized},
+		{"/api/dyndns", http.StatusUnauthorized},
+		{"/api/status", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		for _, auth := range []string{"", "Bearer wrong-token-wrong-token", "Bearer " + token} {
+			req := httptest.NewRequest("GET", "http://admin.test"+tt.path, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			switch {
+			case strings.HasSuffix(auth, token):
+				if w.Code == http.StatusFound || w.Code == http.StatusUnauthorized {
+					t.Errorf("%s with the token got %d", tt.path, w.Code)
+				}
+			case auth != "":
+				if w.Code != http.StatusUnauthorized {
+					t.Errorf("%s with a bad token got %d, want 401", tt.path, w.Code)
+				}
+			default:
+				if w.Code != tt.want {
+					t.Errorf("%s got %d, want %d", tt.path, w.Code, tt.want)
+				}
+				if tt.want == http.StatusFound && !strings.HasPrefix(w.Header().Get("Location"), "/login?") {
+					t.Errorf("%s sent to %q, not the login page", tt.path, w.Header().Get("Location"))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-playground/log"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type serverStatus struct {
+	Commit         string           `json:"commit,omitempty"`
+	BuildTime      string           `json:"build_time,omitempty"`
+	Go             string           `json:"go"`
+	Started        time.Time        `json:"started"`
+	Uptime         string           `json:"uptime"`
+	DevMode        bool             `json:"dev_mode"`
+	Listen         string           `json:"listen"`
+	Domains        int              `json:"domains"`
+	PendingDomains int              `json:"pending_domains"`
+	CachedSums     int              `json:"cached_sums"`
+	Goroutines     int              `json:"goroutines"`
+	MemoryAlloc    uint64           `json:"memory_alloc"`
+	Upstreams      []upstreamStatus `json:"upstreams"`
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	domains, pending := listDomains()
+
+	listenAddr := *listen
+	if *devMode {
+		listenAddr = ":34265"
+	}
+
+	writeJSON(w, http.StatusOK, serverStatus{
+		Commit:         commit,
+		BuildTime:      buildTime,
+		Go:             runtime.Version(),
+		Started:        startTime,
+		Uptime:         time.Since(startTime).Round(time.Second).String(),
+		DevMode:        *devMode,
+		Listen:         listenAddr,
+		Domains:        len(domains),
+		PendingDomains: len(pending),
+		CachedSums:     fileSumCount(),
+		Goroutines:     runtime.NumGoroutine(),
+		MemoryAlloc:    ms.Alloc,
+		Upstreams:      upstreamStatuses(),
+	})
+}
+
+func domainsHandler(w http.ResponseWriter, r *http.Request) {
+	domains, pending := listDomains()
+	writeJSON(w, http.StatusOK, map[string][]string{
+		"domains": domains,
+		"pending": pending,
+	})
+}
+
+// requestDomain gets the domain from a JSON body, a form or the query string
+func requestDomain(r *http.Request) string {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Domain string `json:"domain"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+			return body.Domain
+		}
+		return ""
+	}
+	return r.FormValue("domain")
+}
+
+func validDomain(domain string) bool {
+	return domain != "" && strings.Contains(strings.Trim(domain, "."), ".") && !strings.ContainsAny(domain, " /\\:")
+}
+
+func addDomainHandler(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(strings.TrimSpace(requestDomain(r)))
+	if !validDomain(domain) {
+		writeJSONError(w, http.StatusBadRequest, errors.New("a valid domain is required"))
+		return
+	}
+	if domainIsRegistered(domain) {
+		writeJSONError(w, http.StatusConflict, errors.New("domain is already registered"))
+		return
+	}
+
+	addToDomainList(domain, true)
+	writeJSON(w, http.StatusCreated, map[string]string{"domain": domain})
+}
+
+func removeDomainHandler(w http.ResponseWriter, r *http.Request) {
+	domain := mux.Vars(r)["domain"]
+	if err := removeDomain(domain); err != nil {
+		code := http.StatusInternalServerError
+		if err == errDomainNotFound {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func approveDomainHandler(w http.ResponseWriter, r *http.Request) {
+	domain := mux.Vars(r)["domain"]
+	if err := approveDomain(domain); err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"domain": domain})
+}
+
+func certsHandler(w http.ResponseWriter, r *http.Request) {
+	certs, err := listCerts(certDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if certs == nil {
+		certs = []certInfo{}
+	}
+	writeJSON(w, http.StatusOK, certs)
+}
+
+func renewCertHandler(w http.ResponseWriter, r *http.Request) {
+	if err := renewCert(mux.Vars(r)["domain"]); err != nil {
+		log.Error(err)
+		code := http.StatusInternalServerError
+		if err == errDomainNotFound {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	n := purgeFileSums(r.FormValue("prefix"))
+	log.Noticef("Purged %d cached file sums", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := reload(); err != nil {
+		log.Error(err)
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
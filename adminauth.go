@@ -0,0 +1,169 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/go-playground/log"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	adminCookieName = "henry.sites-admin"
+	adminCookieTTL  = 12 * time.Hour
+)
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+func validAdminToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	valid := false
+	for _, t := range config().AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// adminAuthorized checks for either an admin token or a login cookie
+func adminAuthorized(r *http.Request) bool {
+	if validAdminToken(bearerToken(r)) {
+		return true
+	}
+	if c, err := r.Cookie(adminCookieName); err == nil {
+		if _, err := verifyCookie(adminCookieName, c.Value); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminAuthorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") || r.Header.Get("Authorization") != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="henry.sites admin"`)
+			writeJSONError(w, http.StatusUnauthorized, errors.New("a valid admin token is required"))
+			return
+		}
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+	})
+}
+
+var adminLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Log in</title>
+<style>
+body { font-family: sans-serif; margin: 4em auto; max-width: 24em; color: #222; }
+input { display: block; width: 100%; margin: .5em 0; padding: .25em; box-sizing: border-box; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Log in</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/login">
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="password" name="token" placeholder="Admin token" autofocus>
+<input type="submit" value="Log in">
+</form>
+</body>
+</html>
+`))
+
+func renderAdminLogin(w http.ResponseWriter, code int, next, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := adminLoginPage.Execute(w, struct{ Next, Error string }{next, msg}); err != nil {
+		log.Error(err)
+	}
+}
+
+// safeNext only lets us redirect back to paths on this host after login
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func adminLoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderAdminLogin(w, http.StatusOK, safeNext(r.URL.Query().Get("next")), "")
+}
+
+func adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.FormValue("next"))
+
+	if !validAdminToken(r.FormValue("token")) {
+		log.Warnf("Failed admin login from %s", GetIP(r))
+		renderAdminLogin(w, http.StatusUnauthorized, next, "That token isn't valid")
+		return
+	}
+
+	expires := time.Now().Add(adminCookieTTL)
+	value, err := signCookie(adminCookieName, "admin", expires)
+	if err != nil {
+		renderAdminLogin(w, http.StatusInternalServerError, next, "Logging in needs a cookie secret, set cookie_secret in the config")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+func adminLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
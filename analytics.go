@@ -0,0 +1,427 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/go-playground/log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We never store an IP address. Unique visitors are counted by hashing the
+// ip and user agent with a salt that only lives in memory for a single day,
+// once the day is over the salt and the hashes are thrown away and only the
+// count is kept. Neither is written to disk, so a restart part way through
+// the day starts counting visitors again from there, and that day's count
+// is marked as approximate.
+
+const (
+	analyticsDayFormat = "2006-01-02"
+	// Cap on distinct keys per breakdown, anything past this lands in "(other)"
+	analyticsMaxKeys = 500
+	analyticsOther   = "(other)"
+)
+
+var (
+	analyticsBucket = []byte("analytics")
+	// Where the salt and visitor hashes used to be kept, deleted if found
+	analyticsVisitorBucket = []byte("analytics-visitors")
+	analyticsSaltBucket    = []byte("analytics-salt")
+)
+
+// siteDay is every counter we keep for one site for one day
+type siteDay struct {
+	Requests   int64            `json:"requests"`
+	Pageviews  int64            `json:"pageviews"`
+	Visitors   int64            `json:"visitors"`
+	Bytes      int64            `json:"bytes"`
+	Paths      map[string]int64 `json:"paths"`
+	Referrers  map[string]int64 `json:"referrers"`
+	UserAgents map[string]int64 `json:"user_agents"`
+	Status     map[string]int64 `json:"status"`
+	// Visitors from before a restart can have been counted again after it
+	VisitorsApproximate bool `json:"visitors_approximate,omitempty"`
+}
+
+func newSiteDay() *siteDay {
+	return &siteDay{
+		Paths:      map[string]int64{},
+		Referrers:  map[string]int64{},
+		UserAgents: map[string]int64{},
+		Status:     map[string]int64{},
+	}
+}
+
+func (d *siteDay) add(o *siteDay) {
+	d.Requests += o.Requests
+	d.Pageviews += o.Pageviews
+	d.Visitors += o.Visitors
+	d.VisitorsApproximate = d.VisitorsApproximate || o.VisitorsApproximate
+	d.Bytes += o.Bytes
+	addCounts(d.Paths, o.Paths)
+	addCounts(d.Referrers, o.Referrers)
+	addCounts(d.UserAgents, o.UserAgents)
+	addCounts(d.Status, o.Status)
+}
+
+func addCounts(dst, src map[string]int64) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+func incrCount(m map[string]int64, key string) {
+	if _, ok := m[key]; !ok && len(m) >= analyticsMaxKeys {
+		key = analyticsOther
+	}
+	m[key]++
+}
+
+type analyticsAggregator struct {
+	sync.Mutex
+	day      string
+	salt     []byte
+	sites    map[string]*siteDay
+	visitors map[string]map[string]bool
+	dirty    map[string]bool
+}
+
+var siteAnalytics = &analyticsAggregator{}
+
+// startAnalytics loads the current day from the database and starts
+// periodically flushing the counters back to it
+func startAnalytics() {
+	siteAnalytics.Lock()
+	siteAnalytics.rotate(analyticsToday())
+	siteAnalytics.Unlock()
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			siteAnalytics.Lock()
+			if day := analyticsToday(); day != siteAnalytics.day {
+				siteAnalytics.rotate(day)
+			} else {
+				siteAnalytics.flush()
+			}
+			siteAnalytics.Unlock()
+		}
+	}()
+}
+
+func analyticsToday() string {
+	return time.Now().In(loc).Format(analyticsDayFormat)
+}
+
+// record adds a single request to the counters for host
+func (a *analyticsAggregator) record(r *http.Request, host, ip string, bytes int64, code int) {
+	if code == 0 {
+		// serveFile reports a successful response as 0
+		code = http.StatusOK
+	}
+	host = strings.ToLower(host)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.sites == nil {
+		// startAnalytics hasn't been called, we have nowhere to put this
+		return
+	}
+
+	if day := analyticsToday(); day != a.day {
+		a.rotate(day)
+	}
+
+	s := a.sites[host]
+	if s == nil {
+		s = newSiteDay()
+		a.sites[host] = s
+	}
+
+	s.Requests++
+	s.Bytes += bytes
+	incrCount(s.Status, strconv.Itoa(code))
+
+	if isPageview(r, code) {
+		s.Pageviews++
+		incrCount(s.Paths, r.URL.Path)
+		incrCount(s.UserAgents, userAgentFamily(r.UserAgent()))
+		if ref := referrerHost(r.Referer()); ref != "" && ref != host {
+			incrCount(s.Referrers, ref)
+		}
+
+		v := a.visitors[host]
+		if v == nil {
+			v = map[string]bool{}
+			a.visitors[host] = v
+		}
+		hash := a.visitorHash(host, ip, r.UserAgent())
+		if !v[hash] {
+			v[hash] = true
+			s.Visitors++
+		}
+	}
+
+	a.dirty[host] = true
+}
+
+func (a *analyticsAggregator) visitorHash(host, ip, ua string) string {
+	h := sha256.New()
+	h.Write(a.salt)
+	h.Write([]byte(host + "\x00" + ip + "\x00" + ua))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// rotate flushes whatever we have and switches over to day, with a new salt
+// and none of the visitor hashes from the day before. Must be called with
+// a held
+func (a *analyticsAggregator) rotate(day string) {
+	if a.sites != nil {
+		a.flush()
+	}
+
+	a.day = day
+	a.sites = map[string]*siteDay{}
+	a.visitors = map[string]map[string]bool{}
+	a.dirty = map[string]bool{}
+	a.salt = make([]byte, 32)
+	if _, err := rand.Read(a.salt); err != nil {
+		log.Error(err)
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{analyticsSaltBucket, analyticsVisitorBucket} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		sitesBucket, err := tx.CreateBucketIfNotExists(analyticsBucket)
+		if err != nil {
+			return err
+		}
+
+		// Pick up where we left off if we were restarted part way through the day
+		return sitesBucket.ForEach(func(host, v []byte) error {
+			b := sitesBucket.Bucket(host)
+			if v != nil || b == nil {
+				return nil
+			}
+			raw := b.Get([]byte(day))
+			if raw == nil {
+				return nil
+			}
+			s := newSiteDay()
+			if err := json.Unmarshal(raw, s); err != nil {
+				return err
+			}
+			// The hashes are gone, anyone already counted today will be
+			// counted again
+			if s.Visitors > 0 && !s.VisitorsApproximate {
+				s.VisitorsApproximate = true
+				a.dirty[string(host)] = true
+			}
+			a.sites[string(host)] = s
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// flush writes every site that has changed since the last flush to the
+// database. Must be called with a held
+func (a *analyticsAggregator) flush() {
+	if len(a.dirty) == 0 {
+		return
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		sitesBucket, err := tx.CreateBucketIfNotExists(analyticsBucket)
+		if err != nil {
+			return err
+		}
+		for host := range a.dirty {
+			b, err := sitesBucket.CreateBucketIfNotExists([]byte(host))
+			if err != nil {
+				return err
+			}
+			raw, err := json.Marshal(a.sites[host])
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(a.day), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	a.dirty = map[string]bool{}
+}
+
+// isPageview decides whether a request was somebody looking at a page, as
+// opposed to a stylesheet, image, error, etc
+func isPageview(r *http.Request, code int) bool {
+	if r.Method != http.MethodGet || code != http.StatusOK {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(r.URL.Path)) {
+	case "", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// referrerHost reduces a referrer to just its host, we don't want to keep
+// full urls from other sites around
+func referrerHost(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// userAgentFamily buckets a user agent into something coarse enough that it
+// can't be used to tell visitors apart
+func userAgentFamily(ua string) string {
+	l := strings.ToLower(ua)
+	switch {
+	case l == "":
+		return "Unknown"
+	case strings.Contains(l, "bot") || strings.Contains(l, "spider") || strings.Contains(l, "crawl"):
+		return "Bot"
+	case strings.HasPrefix(l, "curl/"):
+		return "curl"
+	case strings.HasPrefix(l, "wget/"):
+		return "Wget"
+	case strings.Contains(l, "edg/") || strings.Contains(l, "edge/"):
+		return "Edge"
+	case strings.Contains(l, "opr/") || strings.Contains(l, "opera"):
+		return "Opera"
+	case strings.Contains(l, "firefox/"):
+		return "Firefox"
+	case strings.Contains(l, "chrome/") || strings.Contains(l, "crios/"):
+		return "Chrome"
+	case strings.Contains(l, "safari/"):
+		return "Safari"
+	case strings.Contains(l, "msie") || strings.Contains(l, "trident/"):
+		return "Internet Explorer"
+	}
+	return "Other"
+}
+
+// analyticsRange returns the combined counters and the per day counters for
+// host over the last n days, including today
+func analyticsRange(host string, days int) (*siteDay, map[string]*siteDay, error) {
+	siteAnalytics.Lock()
+	siteAnalytics.flush()
+	siteAnalytics.Unlock()
+
+	total := newSiteDay()
+	perDay := map[string]*siteDay{}
+	oldest := time.Now().In(loc).AddDate(0, 0, -(days - 1)).Format(analyticsDayFormat)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		sitesBucket := tx.Bucket(analyticsBucket)
+		if sitesBucket == nil {
+			return nil
+		}
+		b := sitesBucket.Bucket([]byte(strings.ToLower(host)))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(oldest)); k != nil; k, v = c.Next() {
+			d := newSiteDay()
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			perDay[string(k)] = d
+			total.add(d)
+		}
+		return nil
+	})
+	return total, perDay, err
+}
+
+// analyticsSites lists every host we have counters for
+func analyticsSites() ([]string, error) {
+	siteAnalytics.Lock()
+	siteAnalytics.flush()
+	siteAnalytics.Unlock()
+
+	hosts := []string{}
+	err := db.View(func(tx *bolt.Tx) error {
+		sitesBucket := tx.Bucket(analyticsBucket)
+		if sitesBucket == nil {
+			return nil
+		}
+		return sitesBucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				hosts = append(hosts, string(k))
+			}
+			return nil
+		})
+	})
+	return hosts, err
+}
+
+type countEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// topCounts sorts m by count, largest first, and returns at most n entries
+func topCounts(m map[string]int64, n int) []countEntry {
+	entries := make([]countEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, countEntry{k, v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count == entries[j].Count {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Count > entries[j].Count
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
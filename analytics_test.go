@@ -0,0 +1,98 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAnalyticsRestart checks the visitors for a day picked up after a
+// restart are marked as approximate, in the API and on the dashboard
+func TestAnalyticsRestart(t *testing.T) {
+	openTestDB(t)
+	host := "restart.example.com"
+	day := analyticsToday()
+	// Start over from any earlier run
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(analyticsBucket)
+		if err != nil {
+			return err
+		}
+		for _, h := range []string{host, "assets.example.com"} {
+			if err := b.DeleteBucket([]byte(h)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := &analyticsAggregator{}
+	before.rotate(day)
+	for _, ua := range []string{"a", "b"} {
+		r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		r.Header.Set("User-Agent", ua)
+		before.record(r, host, "192.0.2.1", 100, 200)
+	}
+	// Nobody to count twice here
+	before.record(httptest.NewRequest("GET", "http://assets.example.com/app.css", nil), "assets.example.com", "192.0.2.1", 100, 200)
+	before.flush()
+	if s := before.sites[host]; s.Visitors != 2 || s.VisitorsApproximate {
+		t.Fatalf("before the restart %d visitors, approximate %v", s.Visitors, s.VisitorsApproximate)
+	}
+
+	after := &analyticsAggregator{}
+	after.rotate(day)
+	s := after.sites[host]
+	if s == nil || s.Visitors != 2 || !s.VisitorsApproximate {
+		t.Fatalf("after the restart got %+v, want 2 approximate visitors", s)
+	}
+	// Marked in the database too, so it's in the API
+	after.flush()
+	total, perDay, err := analyticsRange(host, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !total.VisitorsApproximate || !perDay[day].VisitorsApproximate {
+		t.Errorf("the stored day isn't approximate, total %+v", total)
+	}
+
+	summary, err := summarize(host, 1, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := analyticsDashboard.Execute(&b, map[string]interface{}{"Days": 1, "Site": summary, "Approximate": true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "<td>~2</td>") || !strings.Contains(b.String(), "counted twice") {
+		t.Errorf("the dashboard doesn't say the visitors are approximate:\n%s", b.String())
+	}
+
+	if s := after.sites["assets.example.com"]; s == nil || s.VisitorsApproximate {
+		t.Errorf("a day without visitors got %+v, want it exact", s)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const certDir = "certs"
+
+var (
+	certMu sync.RWMutex
+	// nil in dev mode, where we don't do TLS
+	m *autocert.Manager
+)
+
+func newCertManager() *autocert.Manager {
+	mgr := &autocert.Manager{
+		Cache:      metricsCache{autocert.DirCache(certDir)},
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy,
+	}
+	// Calling HTTPHandler is what turns on http-01 challenges, the handler
+	// itself gets built per request on port 80
+	mgr.HTTPHandler(nil)
+	return mgr
+}
+
+func certManager() *autocert.Manager {
+	certMu.RLock()
+	defer certMu.RUnlock()
+	return m
+}
+
+// renewingCache hides domain's cached certificate from the manager until a
+// new one is put in its place, so the manager asks the CA for a new one
+type renewingCache struct {
+	autocert.Cache
+	domain string
+
+	mu      sync.Mutex
+	renewed bool
+}
+
+func (c *renewingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	hide := key == c.domain && !c.renewed
+	c.mu.Unlock()
+	if hide {
+		return nil, autocert.ErrCacheMiss
+	}
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *renewingCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	if key == c.domain {
+		c.mu.Lock()
+		c.renewed = true
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// renewCert gets a new certificate for domain right now. It's done with a
+// new manager that takes over once the certificate has been issued, the
+// current one keeps serving the old certificate until then, or if it fails
+//
+// The old manager's renewal timers check the cache before doing anything,
+// so they won't renew anything the new one already has
+func renewCert(domain string) error {
+	old := certManager()
+	if old == nil {
+		return errors.New("certificates aren't managed in dev mode")
+	}
+	if !domainIsRegistered(domain) {
+		return errDomainNotFound
+	}
+
+	mgr := newCertManager()
+	mgr.Cache = &renewingCache{Cache: old.Cache, domain: domain}
+
+	log.Noticef("Renewing the certificate for %s", domain)
+	if _, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: domain}); err != nil {
+		autocertErrors.inc()
+		return fmt.Errorf("renewing %s: %v", domain, err)
+	}
+
+	certMu.Lock()
+	m = mgr
+	certMu.Unlock()
+
+	log.Noticef("Renewed the certificate for %s", domain)
+	return nil
+}
+
+type certInfo struct {
+	Domain    string    `json:"domain"`
+	Names     []string  `json:"names"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DaysLeft  int       `json:"days_left"`
+}
+
+// listCerts reads the certificates autocert has stored in dir
+func listCerts(dir string) ([]certInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []certInfo{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, "acme_account") || strings.HasPrefix(name, "http-01-") || strings.HasSuffix(name, ".acme.invalid") {
+			continue
+		}
+
+		info, err := readCert(filepath.Join(dir, name))
+		if err != nil || info == nil {
+			continue
+		}
+		info.Domain = name
+		certs = append(certs, *info)
+	}
+
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Domain < certs[j].Domain })
+	return certs, nil
+}
+
+// readCert returns the leaf certificate from an autocert cache file, which
+// has the private key first and then the chain
+func readCert(path string) (*certInfo, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &certInfo{
+			Names:     leaf.DNSNames,
+			Issuer:    leaf.Issuer.CommonName,
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+			DaysLeft:  int(time.Until(leaf.NotAfter).Hours() / 24),
+		}, nil
+	}
+}
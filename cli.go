@@ -0,0 +1,713 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "Run the server, the default when no command is given", serveCommand},
+		{"domains", "list|add|rm|approve [domain]", "Manage the domains we get certificates for", domainsCommand},
+		{"certs", "list|renew [domain]", "Show or renew certificates", certsCommand},
+		{"cache", "purge [-prefix path] [-proxy] [-url url]", "Forget cached file sums or proxy responses", cacheCommand},
+		{"config", "check [-config path]", "Check the config and redirects files for mistakes", configCommand},
+		{"logs", "[flags]", "Search and follow the access logs", logsCommand},
+		{"links", "list|show|add|set|rm [host] [slug]", "Manage short links and see their clicks", linksCommand},
+		{"dyndns", "list|zone|rm [hostname]", "Show, export or remove dynamic DNS records", dyndnsCommand},
+		{"passwd", "[-argon2] [-file path] user", "Hash a password read from stdin for a site's htpasswd file", passwdCommand},
+		{"version", "", "Print version information", versionCommand},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s %-32s %s\n", c.name, c.args, c.summary)
+	}
+	fmt.Fprintf(out, "\nCommands other than serve talk to a running server over its admin socket,\nor work on the files in the current directory when it isn't running.\n\nServe flags:\n")
+	flag.PrintDefaults()
+}
+
+func runCommand(name string, args []string) int {
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(args)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	return 2
+}
+
+func serveCommand(args []string) int {
+	flag.CommandLine.Parse(args)
+	serve()
+	return 0
+}
+
+// adminConn is how commands talk to a running server
+type adminConn struct {
+	socket string
+	client *http.Client
+}
+
+// clientFlags adds the flags every command talking to the server takes
+func clientFlags(fs *flag.FlagSet) (*string, *bool) {
+	return fs.String("admin-socket", "admin.sock", "The admin socket of the running server"),
+		fs.Bool("offline", false, "Work on the files directly, even if the server is running")
+}
+
+// connectAdmin returns a connection to the running server, or nil when it
+// isn't running or we've been told not to use it
+func connectAdmin(socket string, offline bool) *adminConn {
+	if offline || socket == "" {
+		return nil
+	}
+	c, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil
+	}
+	c.Close()
+
+	return &adminConn{
+		socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// call makes a request to the admin api, decoding the response into out
+func (a *adminConn) call(method, path string, form url.Values, out interface{}) error {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+
+	req, err := http.NewRequest(method, "http://admin"+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// parseArgs parses fs from args, allowing flags after the positional
+// arguments as well as before them, returning the positional ones
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// arg returns the i'th positional argument, or an empty string
+func arg(pos []string, i int) string {
+	if i < len(pos) {
+		return pos[i]
+	}
+	return ""
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// offlineNote reminds whoever is running a command that changed files that a
+// server without an admin socket won't see the change by itself
+func offlineNote() {
+	fmt.Fprintln(os.Stderr, "Changed the files directly, reload or restart the server if it's running")
+}
+
+func domainsCommand(args []string) int {
+	fs := flag.NewFlagSet("domains", flag.ContinueOnError)
+	socket, offline := clientFlags(fs)
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	sub, domain := arg(pos, 0), strings.ToLower(arg(pos, 1))
+
+	if sub != "list" && !validDomain(domain) {
+		fmt.Fprintln(os.Stderr, "Usage: domains list|add|rm|approve [domain]")
+		return 2
+	}
+
+	admin := connectAdmin(*socket, *offline)
+	if admin == nil {
+		loadDomainList()
+	}
+
+	switch sub {
+	case "list":
+		var list struct {
+			Domains []string `json:"domains"`
+			Pending []string `json:"pending"`
+		}
+		if admin != nil {
+			err = admin.call("GET", "/api/domains", nil, &list)
+		} else {
+			list.Domains, list.Pending = listDomains()
+		}
+		if err != nil {
+			return fail(err)
+		}
+		for _, d := range list.Domains {
+			fmt.Println(d)
+		}
+		for _, d := range list.Pending {
+			fmt.Println(d + " (pending)")
+		}
+		return 0
+	case "add":
+		if admin != nil {
+			err = admin.call("POST", "/api/domains", url.Values{"domain": {domain}}, nil)
+		} else if domainIsRegistered(domain) {
+			err = errors.New("domain is already registered")
+		} else {
+			addToDomainList(domain, true)
+			offlineNote()
+		}
+	case "rm":
+		if admin != nil {
+			err = admin.call("DELETE", "/api/domains/"+url.PathEscape(domain), nil, nil)
+		} else if err = removeDomain(domain); err == nil {
+			offlineNote()
+		}
+	case "approve":
+		if admin != nil {
+			err = admin.call("POST", "/api/domains/"+url.PathEscape(domain)+"/approve", nil, nil)
+		} else if err = approveDomain(domain); err == nil {
+			offlineNote()
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: domains list|add|rm|approve [domain]")
+		return 2
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func certsCommand(args []string) int {
+	fs := flag.NewFlagSet("certs", flag.ContinueOnError)
+	socket, offline := clientFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the certificates as JSON")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	admin := connectAdmin(*socket, *offline)
+
+	switch arg(pos, 0) {
+	case "list":
+		var certs []certInfo
+		if admin != nil {
+			err = admin.call("GET", "/api/certs", nil, &certs)
+		} else {
+			certs, err = listCerts(certDir)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if *asJSON {
+			printJSON(certs)
+			return 0
+		}
+		for _, c := range certs {
+			fmt.Printf("%-40s expires %s (%d days) issued by %s\n", c.Domain, c.NotAfter.Format("2006-01-02"), c.DaysLeft, c.Issuer)
+		}
+		return 0
+	case "renew":
+		domain := strings.ToLower(arg(pos, 1))
+		if !validDomain(domain) {
+			fmt.Fprintln(os.Stderr, "Usage: certs renew domain")
+			return 2
+		}
+		if admin == nil {
+			// The CA has to be able to reach the running server to check we
+			// own the domain, so there's nothing we can do without one
+			return fail(errors.New("renewing a certificate needs the server to be running"))
+		}
+		if err := admin.call("POST", "/api/certs/"+url.PathEscape(domain)+"/renew", nil, nil); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Renewed the certificate for %s\n", domain)
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: certs list|renew [domain]")
+	return 2
+}
+
+func cacheCommand(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ContinueOnError)
+	socket, _ := clientFlags(fs)
+	fs.StringVar(proxyCacheDir, "proxy-cache-dir", *proxyCacheDir, "Where proxied responses are cached, when the server isn't running")
+	prefix := fs.String("prefix", "", "Only purge sums for paths starting with this, or with -proxy, responses for urls like example.com/path")
+	proxy := fs.Bool("proxy", false, "Purge cached proxy responses instead of file sums")
+	purgeURL := fs.String("url", "", "Purge the cached proxy responses for this url")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if arg(pos, 0) != "purge" {
+		fmt.Fprintln(os.Stderr, "Usage: cache purge [-prefix path] [-proxy] [-url url]")
+		return 2
+	}
+
+	var out struct {
+		Purged int `json:"purged"`
+	}
+	if *proxy && *prefix == "" && *purgeURL == "" {
+		fmt.Fprintln(os.Stderr, "cache purge -proxy needs -prefix or -url")
+		return 2
+	}
+
+	admin := connectAdmin(*socket, false)
+	if *proxy || *purgeURL != "" {
+		form := url.Values{"prefix": {*prefix}}
+		if *purgeURL != "" {
+			form = url.Values{"url": {*purgeURL}}
+		}
+		if admin != nil {
+			err = admin.call("POST", "/api/proxy-cache/purge", form, &out)
+		} else if *proxyCacheDir != "" {
+			// Responses cached on disk outlive the server
+			var match func(string) bool
+			if match, err = purgeMatcher(*purgeURL, form.Get("prefix")); err == nil {
+				c := newResponseCache(*proxyCacheDir, 0, math.MaxInt64)
+				if err = c.load(); err == nil {
+					out.Purged = c.purge(match)
+				}
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Purged %d cached responses\n", out.Purged)
+		return 0
+	}
+
+	if admin == nil {
+		// The sums only live in memory
+		fmt.Println("The server isn't running, there's nothing cached")
+		return 0
+	}
+	if err := admin.call("POST", "/api/cache/purge", url.Values{"prefix": {*prefix}}, &out); err != nil {
+		return fail(err)
+	}
+	fmt.Printf("Purged %d cached file sums\n", out.Purged)
+	return 0
+}
+
+func configCommand(args []string) int {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	path := fs.String("config", "config.json", "The path to the config file")
+	fs.StringVar(redirectsPath, "redirects", *redirectsPath, "The path to the redirect rules")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if arg(pos, 0) != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: config check [-config path]")
+		return 2
+	}
+
+	if _, err := readRedirects(*redirectsPath); err != nil {
+		return fail(fmt.Errorf("%s: %v", *redirectsPath, err))
+	}
+	if _, err := readDomainFile(domainsFile); err != nil {
+		return fail(err)
+	}
+	if _, err := os.Stat(*path); os.IsNotExist(err) {
+		fmt.Printf("%s doesn't exist, the defaults will be used\n", *path)
+		return 0
+	}
+	if _, err := readConfig(*path); err != nil {
+		return fail(fmt.Errorf("%s: %v", *path, err))
+	}
+	fmt.Printf("%s is OK\n", *path)
+	return 0
+}
+
+func dyndnsCommand(args []string) int {
+	fs := flag.NewFlagSet("dyndns", flag.ContinueOnError)
+	socket, offline := clientFlags(fs)
+	fs.StringVar(dbPath, "db", *dbPath, "The path to the database file, when the server isn't running")
+	fs.StringVar(dyndnsZoneName, "dyndns-zone", *dyndnsZoneName, "The zone the hostnames are in")
+	asJSON := fs.Bool("json", false, "Print the records as JSON")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	sub, hostname := arg(pos, 0), strings.ToLower(arg(pos, 1))
+
+	admin := connectAdmin(*socket, *offline)
+	if admin == nil {
+		openDB()
+		defer db.Close()
+	}
+
+	switch sub {
+	case "list", "zone":
+		var records []dyndnsRecord
+		if admin != nil {
+			err = admin.call("GET", "/api/dyndns", nil, &records)
+		} else {
+			records, err = listDynDNS()
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if sub == "zone" {
+			writeZoneFile(os.Stdout, records)
+			return 0
+		}
+		if *asJSON {
+			printJSON(records)
+			return 0
+		}
+		for _, rec := range records {
+			fmt.Printf("%-40s %-15s %-39s updated %s by %s\n", rec.Hostname, orNone(rec.IPv4), orNone(rec.IPv6),
+				rec.Updated.In(loc).Format("2006-01-02 15:04"), rec.UpdatedBy)
+		}
+		return 0
+	case "rm":
+		if !validDomain(hostname) {
+			break
+		}
+		if admin != nil {
+			err = admin.call("DELETE", "/api/dyndns/"+url.PathEscape(hostname), nil, nil)
+		} else {
+			err = removeDynDNS(hostname)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: dyndns list|zone|rm [hostname]")
+	return 2
+}
+
+func linksCommand(args []string) int {
+	fs := flag.NewFlagSet("links", flag.ContinueOnError)
+	socket, offline := clientFlags(fs)
+	fs.StringVar(dbPath, "db", *dbPath, "The path to the database file, when the server isn't running")
+	req := &shortLinkRequest{}
+	fs.StringVar(&req.Target, "to", "", "Where the link goes, for add and set")
+	fs.StringVar(&req.Status, "status", "", "The redirect status, 302 by default")
+	fs.StringVar(&req.Expires, "expires", "", "When the link stops working, a time, a duration like 30d, or never")
+	asJSON := fs.Bool("json", false, "Print the links as JSON")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	sub := arg(pos, 0)
+	req.Host, req.Slug = strings.ToLower(arg(pos, 1)), strings.Trim(arg(pos, 2), "/")
+	linkPath := "/api/links/" + url.PathEscape(req.Host) + "/" + req.Slug
+
+	admin := connectAdmin(*socket, *offline)
+	if admin == nil {
+		openDB()
+		defer db.Close()
+	}
+
+	form := url.Values{}
+	for k, v := range map[string]string{"host": req.Host, "slug": req.Slug, "target": req.Target, "status": req.Status, "expires": req.Expires} {
+		if v != "" {
+			form.Set(k, v)
+		}
+	}
+
+	switch sub {
+	case "list":
+		var links []shortLink
+		if admin != nil {
+			err = admin.call("GET", "/api/links?host="+url.QueryEscape(req.Host), nil, &links)
+		} else {
+			links, err = listShortLinks(req.Host)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if *asJSON {
+			printJSON(links)
+			return 0
+		}
+		for _, l := range links {
+			expires := "never"
+			if !l.Expires.IsZero() {
+				expires = l.Expires.In(loc).Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%-50s %6d clicks  expires %-16s  %d %s\n", l.Host+"/"+l.Slug, l.Clicks, expires, l.Status, l.Target)
+		}
+		return 0
+	case "show":
+		if req.Host == "" || req.Slug == "" {
+			break
+		}
+		var summary shortLinkSummary
+		if admin != nil {
+			err = admin.call("GET", linkPath, nil, &summary)
+		} else {
+			var l *shortLink
+			if l, err = getShortLink(req.Host, req.Slug); err == nil {
+				summary = summarizeShortLink(l)
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if *asJSON {
+			printJSON(summary)
+			return 0
+		}
+		fmt.Printf("%s/%s -> %s (%d)\n", summary.Host, summary.Slug, summary.Target, summary.Status)
+		fmt.Printf("Created %s, %d clicks\n", summary.Created.In(loc).Format("2006-01-02 15:04"), summary.Clicks)
+		if !summary.Expires.IsZero() {
+			fmt.Printf("Expires %s\n", summary.Expires.In(loc).Format("2006-01-02 15:04"))
+		}
+		for _, section := range []struct {
+			name   string
+			counts []countEntry
+		}{{"Referrers", summary.Referrers}, {"Countries", summary.Countries}} {
+			if len(section.counts) == 0 {
+				continue
+			}
+			fmt.Printf("\n%s:\n", section.name)
+			for _, c := range section.counts {
+				fmt.Printf("  %-40s %d\n", c.Key, c.Count)
+			}
+		}
+		return 0
+	case "add":
+		if req.Host == "" || req.Target == "" {
+			break
+		}
+		l := &shortLink{}
+		if admin != nil {
+			err = admin.call("POST", "/api/links", form, l)
+		} else if l, err = req.newShortLink(); err == nil {
+			err = createShortLink(l)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("%s/%s -> %s\n", l.Host, l.Slug, l.Target)
+		return 0
+	case "set":
+		if req.Host == "" || req.Slug == "" {
+			break
+		}
+		if admin != nil {
+			err = admin.call("PUT", linkPath, form, nil)
+		} else if err = req.apply(&shortLink{}); err == nil {
+			_, err = updateShortLink(req.Host, req.Slug, func(l *shortLink) {
+				req.apply(l)
+			})
+		}
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	case "rm":
+		if req.Host == "" || req.Slug == "" {
+			break
+		}
+		if admin != nil {
+			err = admin.call("DELETE", linkPath, nil, nil)
+		} else {
+			err = removeShortLink(req.Host, req.Slug)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: links list [host] | show|set|rm <host> <slug> | add <host> [slug] -to <url>")
+	return 2
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func passwdCommand(args []string) int {
+	fs := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	useArgon2 := fs.Bool("argon2", false, "Hash with argon2id instead of bcrypt")
+	file := fs.String("file", "", "Add the user to this htpasswd file, or change their password, instead of printing the line")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	user := arg(pos, 0)
+	if user == "" || strings.Contains(user, ":") {
+		fmt.Fprintln(os.Stderr, "Usage: passwd [-argon2] [-file path] user")
+		return 2
+	}
+
+	fmt.Fprintln(os.Stderr, "Password:")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fail(err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fail(errors.New("the password can't be empty"))
+	}
+	hash, err := hashPassword(password, *useArgon2)
+	if err != nil {
+		return fail(err)
+	}
+	line := user + ":" + hash
+
+	if *file == "" {
+		fmt.Println(line)
+		return 0
+	}
+	var lines []string
+	replaced := false
+	if b, err := os.ReadFile(*file); err == nil && len(b) > 0 {
+		for _, l := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			if strings.HasPrefix(l, user+":") {
+				l, replaced = line, true
+			}
+			lines = append(lines, l)
+		}
+	} else if !os.IsNotExist(err) {
+		return fail(err)
+	}
+	if !replaced {
+		lines = append(lines, line)
+	}
+	if err := os.WriteFile(*file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return fail(err)
+	}
+	if replaced {
+		fmt.Printf("Changed %s's password in %s\n", user, *file)
+	} else {
+		fmt.Printf("Added %s to %s\n", user, *file)
+	}
+	return 0
+}
+
+func versionCommand(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	socket, _ := clientFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	fmt.Printf("henry.sites %s built %s with %s\n", orUnknown(commit), orUnknown(buildTime), runtime.Version())
+
+	if admin := connectAdmin(*socket, false); admin != nil {
+		var status serverStatus
+		if err := admin.call("GET", "/api/status", nil, &status); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Running server %s built %s with %s, up %s\n", orUnknown(status.Commit), orUnknown(status.BuildTime), status.Go, status.Uptime)
+	}
+	return 0
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
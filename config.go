@@ -0,0 +1,190 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config holds everything that can be changed without a restart, it's read
+// from the file given by -config and reloaded through the admin api
+type Config struct {
+	// Bearer tokens accepted by the admin api
+	AdminTokens []string `json:"admin_tokens"`
+	// Secret for signing cookies, overrides the one built in with -ldflags
+	CookieSecret string `json:"cookie_secret"`
+	// Users who can update dynamic DNS records
+	DynDNS []DynDNSUser `json:"dyndns"`
+	// Hosts served by more than their static files
+	Sites map[string][]*SiteRoute `json:"sites"`
+	// Addresses let in or kept out for every host
+	Access *AccessRules `json:"access,omitempty"`
+	// And for particular hosts
+	HostAccess map[string]*AccessRules `json:"host_access,omitempty"`
+	// How many requests a client can make to a host
+	HostRateLimit map[string]*RateLimit `json:"host_rate_limit,omitempty"`
+}
+
+// duration is a time.Duration written like "10s" in the config
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(`durations are strings like "10s" or "1m30s"`)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var (
+	configMu      sync.RWMutex
+	currentConfig = &Config{}
+	// Called with the new config every time it's loaded, in the order they
+	// were added. An error stops the load, leaving the old config in place
+	// for any hooks that haven't run yet
+	configHooks []func(*Config) error
+)
+
+// onConfigLoad registers f to be called with every config that gets loaded
+func onConfigLoad(f func(*Config) error) {
+	configHooks = append(configHooks, f)
+}
+
+func config() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return currentConfig
+}
+
+// readConfig reads and checks the config at path, a missing file is the
+// same as an empty one
+func readConfig(path string) (*Config, error) {
+	c := &Config{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
+
+func (c *Config) validate() error {
+	for _, t := range c.AdminTokens {
+		if len(t) < 16 {
+			return errors.New("admin tokens must be at least 16 characters")
+		}
+	}
+	if err := validateDynDNS(c.DynDNS); err != nil {
+		return err
+	}
+	sites, err := compileSites(c.Sites)
+	if err != nil {
+		return err
+	}
+	c.Sites = sites
+	if c.Access != nil {
+		if err := c.Access.compile(); err != nil {
+			return fmt.Errorf("access: %v", err)
+		}
+	}
+	if c.HostAccess, err = compileHostAccess(c.HostAccess); err != nil {
+		return err
+	}
+	if c.HostRateLimit, err = compileHostRateLimits(c.HostRateLimit); err != nil {
+		return err
+	}
+	if c.CookieSecret == "" && cookieSecret == "" {
+		for host, routes := range c.Sites {
+			for _, route := range routes {
+				if route.OIDC != nil {
+					return fmt.Errorf("site %s uses oidc, which needs a cookie_secret", host)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadConfig reads the config file and, if it's good, switches over to it
+func loadConfig() error {
+	c, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	for _, hook := range configHooks {
+		if err := hook(c); err != nil {
+			return err
+		}
+	}
+
+	configMu.Lock()
+	old := currentConfig
+	currentConfig = c
+	configMu.Unlock()
+	closeSites(old.Sites)
+	openSites(c.Sites)
+
+	log.Infof("Loaded config from %s", *configPath)
+	return nil
+}
+
+// getCookieSecret returns the secret used for signing cookies, empty if
+// there isn't one
+func getCookieSecret() string {
+	if s := config().CookieSecret; s != "" {
+		return s
+	}
+	return cookieSecret
+}
+
+// reload rereads everything we read from disk at startup that can be
+// changed while we're running
+func reload() error {
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	if err := loadRedirects(); err != nil {
+		return err
+	}
+	loadDomainList()
+	return nil
+}
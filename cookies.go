@@ -0,0 +1,138 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadCookie = errors.New("invalid or expired cookie")
+
+// signCookie returns value, with an expiry and signature added, signed with
+// the cookie secret so we can trust it when it comes back to us. name is
+// part of the signature so one cookie can't stand in for another
+func signCookie(name, value string, expires time.Time) (string, error) {
+	secret := getCookieSecret()
+	if secret == "" {
+		return "", errors.New("no cookie secret configured")
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + cookieMAC(secret, name, payload), nil
+}
+
+// verifyCookie checks a cookie made by signCookie and returns its value
+func verifyCookie(name, cookie string) (string, error) {
+	secret := getCookieSecret()
+	if secret == "" {
+		return "", errBadCookie
+	}
+
+	i := strings.LastIndex(cookie, ".")
+	if i < 0 {
+		return "", errBadCookie
+	}
+	payload, mac := cookie[:i], cookie[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(cookieMAC(secret, name, payload))) {
+		return "", errBadCookie
+	}
+
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return "", errBadCookie
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", errBadCookie
+	}
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errBadCookie
+	}
+	return string(value), nil
+}
+
+func cookieMAC(secret, name, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sealCookie is signCookie for values the browser shouldn't be able to
+// read either, they're encrypted with a key made from the cookie secret
+func sealCookie(name, value string, expires time.Time) (string, error) {
+	aead, err := cookieAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	plain := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	plain = append(plain, value...)
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+// openCookie checks and decrypts a cookie made by sealCookie
+func openCookie(name, cookie string) (string, error) {
+	aead, err := cookieAEAD()
+	if err != nil {
+		return "", errBadCookie
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", errBadCookie
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(name))
+	if err != nil || len(plain) < 8 {
+		return "", errBadCookie
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(plain)) {
+		return "", errBadCookie
+	}
+	return string(plain[8:]), nil
+}
+
+// cookieAEAD is AES-GCM keyed from the cookie secret, so the key changes
+// with it
+func cookieAEAD() (cipher.AEAD, error) {
+	secret := getCookieSecret()
+	if secret == "" {
+		return nil, errors.New("no cookie secret configured")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("henry.sites cookie encryption"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestSealCookie(t *testing.T) {
+	setTestConfig(t, &Config{CookieSecret: "a secret just for the tests"})
+	hour := time.Now().Add(time.Hour)
+
+	sealed, err := sealCookie("session", "alice@example.com", hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := openCookie("session", sealed); err != nil || v != "alice@example.com" {
+		t.Fatalf("opened %q, %v", v, err)
+	}
+	if again, _ := sealCookie("session", "alice@example.com", hour); again == sealed {
+		t.Error("sealing the same value twice gave the same cookie")
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(sealed)
+	flipped := append([]byte{}, raw...)
+	flipped[len(flipped)-1] ^= 1
+	expired, _ := sealCookie("session", "alice@example.com", time.Now().Add(-time.Second))
+
+	tests := []struct {
+		name   string
+		cookie string
+		open   string
+	}{
+		{"other name", sealed, "login"},
+		{"tampered", base64.RawURLEncoding.EncodeToString(flipped), "session"},
+		{"truncated", base64.RawURLEncoding.EncodeToString(raw[:8]), "session"},
+		{"not base64", "!!!", "session"},
+		{"empty", "", "session"},
+		{"expired", expired, "session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v, err := openCookie(tt.open, tt.cookie); err != errBadCookie {
+				t.Errorf("opened %q, %v, want errBadCookie", v, err)
+			}
+		})
+	}
+
+	// A new secret is a new key
+	setTestConfig(t, &Config{CookieSecret: "a different secret"})
+	if _, err := openCookie("session", sealed); err != errBadCookie {
+		t.Errorf("opened with another secret, %v", err)
+	}
+}
+
+func TestSealCookieNeedsSecret(t *testing.T) {
+	setTestConfig(t, &Config{})
+	old := cookieSecret
+	cookieSecret = ""
+	t.Cleanup(func() { cookieSecret = old })
+
+	if _, err := sealCookie("session", "x", time.Now().Add(time.Hour)); err == nil {
+		t.Error("sealed a cookie without a secret")
+	}
+}
+
+func TestSignCookie(t *testing.T) {
+	setTestConfig(t, &Config{CookieSecret: "a secret just for the tests"})
+
+	signed, err := signCookie("admin", "ok", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := verifyCookie("admin", signed); err != nil || v != "ok" {
+		t.Fatalf("verified %q, %v", v, err)
+	}
+	expired, _ := signCookie("admin", "ok", time.Now().Add(-time.Second))
+
+	for name, tt := range map[string]struct{ name, cookie string }{
+		"other name": {"login", signed},
+		"tampered":   {"admin", "bm90b2s" + signed[2:]},
+		"no mac":     {"admin", "b2s"},
+		"expired":    {"admin", expired},
+	} {
+		if _, err := verifyCookie(tt.name, tt.cookie); err != errBadCookie {
+			t.Errorf("%s: got %v, want errBadCookie", name, err)
+		}
+	}
+}
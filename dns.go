@@ -0,0 +1,585 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An authoritative DNS server for -dns-zone, which answers every name in it
+// with the address of whoever's asking, which is the recursive resolver
+// rather than the client, plus the client's subnet when the resolver sends
+// it with EDNS Client Subnet. Like o-o.myaddr.l.google.com, for when only
+// DNS gets out:
+//
+//	dig +short TXT whoami.dns.ifcfg.org
+//
+// It also serves the dynamic DNS records in -dyndns-zone, see dyndns.go.
+// It only speaks enough DNS for that, a single question per query and EDNS
+// with nothing but ECS.
+
+const (
+	dnsTypeA    = 1
+	dnsTypeNS   = 2
+	dnsTypeSOA  = 6
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+	dnsTypeANY  = 255
+
+	dnsClassIN = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+
+	dnsOptionECS = 8
+
+	// What we'll take over UDP with EDNS, the DNS flag day 2020 value
+	dnsEDNSSize = 1232
+	dnsTCPIdle  = 10 * time.Second
+)
+
+var dnsTypeNames = map[uint16]string{
+	dnsTypeA:    "A",
+	dnsTypeNS:   "NS",
+	dnsTypeSOA:  "SOA",
+	dnsTypeTXT:  "TXT",
+	dnsTypeAAAA: "AAAA",
+	dnsTypeANY:  "ANY",
+}
+
+var dnsRcodeNames = map[int]string{
+	dnsRcodeSuccess:  "NOERROR",
+	dnsRcodeFormErr:  "FORMERR",
+	dnsRcodeServFail: "SERVFAIL",
+	dnsRcodeNXDomain: "NXDOMAIN",
+	dnsRcodeNotImp:   "NOTIMP",
+	dnsRcodeRefused:  "REFUSED",
+}
+
+func dnsTypeName(t uint16) string {
+	if name, ok := dnsTypeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+var errDNSShort = errors.New("dns: message too short")
+
+// dnsQuery is the parts of a query we look at
+type dnsQuery struct {
+	id     uint16
+	rd     bool
+	opcode int
+	// The question as it was asked, for echoing back
+	question []byte
+	name     string
+	qtype    uint16
+	qclass   uint16
+
+	edns    bool
+	udpSize int
+	// ECS from the query, nil when there wasn't one
+	ecs *dnsECS
+}
+
+// dnsECS is an EDNS Client Subnet option, RFC 7871
+type dnsECS struct {
+	family       uint16
+	sourcePrefix uint8
+	scopePrefix  uint8
+	addr         []byte
+}
+
+func (e *dnsECS) String() string {
+	ip := make(net.IP, 16)
+	if e.family == 1 {
+		ip = make(net.IP, 4)
+	}
+	copy(ip, e.addr)
+	return fmt.Sprintf("%s/%d", ip, e.sourcePrefix)
+}
+
+// readDNSName reads the name at off in msg, following compression
+// pointers, and returns it in presentation format with the offset after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			if jumps++; jumps > 10 {
+				return "", 0, errors.New("dns: too many compression pointers")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		case n&0xC0 != 0:
+			return "", 0, errors.New("dns: bad label")
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, escapeDNSLabel(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func escapeDNSLabel(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '.' || c == '\\' || c == '"':
+			s.WriteByte('\\')
+			s.WriteByte(c)
+		case c <= ' ' || c >= 0x7F:
+			fmt.Fprintf(&s, "\\%03d", c)
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String()
+}
+
+// appendDNSName appends name, which has no escapes in it, uncompressed
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func parseDNSQuery(msg []byte) (*dnsQuery, error) {
+	if len(msg) < 12 {
+		return nil, errDNSShort
+	}
+	q := &dnsQuery{
+		id:      binary.BigEndian.Uint16(msg[0:]),
+		rd:      msg[2]&0x01 != 0,
+		opcode:  int(msg[2]>>3) & 0xF,
+		udpSize: 512,
+	}
+	if msg[2]&0x80 != 0 {
+		return nil, errors.New("dns: not a query")
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	skip := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:]))
+	if qdcount != 1 {
+		return q, errors.New("dns: want exactly one question")
+	}
+
+	name, off, err := readDNSName(msg, 12)
+	if err != nil {
+		return q, err
+	}
+	if off+4 > len(msg) {
+		return q, errDNSShort
+	}
+	q.name = name
+	q.qtype = binary.BigEndian.Uint16(msg[off:])
+	q.qclass = binary.BigEndian.Uint16(msg[off+2:])
+	q.question = msg[12 : off+4]
+	off += 4
+
+	for i := 0; i < skip+arcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return q, err
+		}
+		if next+10 > len(msg) {
+			return q, errDNSShort
+		}
+		rrtype := binary.BigEndian.Uint16(msg[next:])
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return q, errDNSShort
+		}
+		off = rdata + rdlen
+
+		if i < skip || rrtype != dnsTypeOPT {
+			continue
+		}
+		q.edns = true
+		if int(class) > q.udpSize {
+			q.udpSize = int(class)
+		}
+		if q.udpSize > dnsEDNSSize {
+			q.udpSize = dnsEDNSSize
+		}
+		if q.ecs, err = parseECS(msg[rdata : rdata+rdlen]); err != nil {
+			return q, err
+		}
+	}
+
+	return q, nil
+}
+
+// parseECS finds the client subnet option in OPT rdata
+func parseECS(opts []byte) (*dnsECS, error) {
+	for len(opts) >= 4 {
+		code := binary.BigEndian.Uint16(opts)
+		n := int(binary.BigEndian.Uint16(opts[2:]))
+		if 4+n > len(opts) {
+			return nil, errDNSShort
+		}
+		data := opts[4 : 4+n]
+		opts = opts[4+n:]
+		if code != dnsOptionECS {
+			continue
+		}
+
+		if len(data) < 4 {
+			return nil, errors.New("dns: bad client subnet option")
+		}
+		ecs := &dnsECS{
+			family:       binary.BigEndian.Uint16(data),
+			sourcePrefix: data[2],
+			addr:         data[4:],
+		}
+		max := 32
+		if ecs.family == 2 {
+			max = 128
+		} else if ecs.family != 1 {
+			return nil, errors.New("dns: bad client subnet family")
+		}
+		if int(ecs.sourcePrefix) > max || len(ecs.addr) != (int(ecs.sourcePrefix)+7)/8 {
+			return nil, errors.New("dns: bad client subnet option")
+		}
+		return ecs, nil
+	}
+	return nil, nil
+}
+
+// dnsRR is an answer, the name is always the one asked about
+type dnsRR struct {
+	rrtype uint16
+	rdata  []byte
+	ttl    uint32
+}
+
+// dnsAnswer works out the rcode and answers for q, asked by ip, and which
+// of our zones it's in
+func dnsAnswer(q *dnsQuery, ip net.IP) (int, []dnsRR, bool, string) {
+	name := strings.ToLower(q.name)
+	zone := dnsZone()
+	inZone := func(zone string) bool {
+		return name == zone || strings.HasSuffix(name, "."+zone)
+	}
+	if q.qclass != dnsClassIN {
+		return dnsRcodeRefused, nil, false, zone
+	}
+	if inZone(dyndnsZone()) {
+		rcode, answers := dyndnsAnswer(q, name)
+		return rcode, answers, rcode != dnsRcodeServFail, dyndnsZone()
+	}
+	if !inZone(zone) {
+		return dnsRcodeRefused, nil, false, zone
+	}
+
+	var answers []dnsRR
+	ip4 := ip.To4()
+	switch q.qtype {
+	case dnsTypeA:
+		if ip4 != nil {
+			answers = append(answers, dnsRR{dnsTypeA, ip4, 0})
+		}
+	case dnsTypeAAAA:
+		if ip4 == nil {
+			answers = append(answers, dnsRR{dnsTypeAAAA, ip.To16(), 0})
+		}
+	case dnsTypeTXT, dnsTypeANY:
+		answers = append(answers, dnsRR{dnsTypeTXT, txtRdata(ip.String()), 0})
+		if q.ecs != nil {
+			answers = append(answers, dnsRR{dnsTypeTXT, txtRdata("edns0-client-subnet " + q.ecs.String()), 0})
+		}
+	case dnsTypeSOA:
+		if name == zone {
+			answers = append(answers, dnsRR{dnsTypeSOA, soaRdata(zone), 0})
+		}
+	}
+	return dnsRcodeSuccess, answers, true, zone
+}
+
+func txtRdata(s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func soaRdata(zone string) []byte {
+	b := appendDNSName(nil, zone)
+	b = appendDNSName(b, "hostmaster."+zone)
+	// serial, refresh, retry, expire and minimum, nothing here is worth
+	// caching
+	for _, v := range []uint32{1, 3600, 600, 86400, 0} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// buildDNSResponse writes the response to q, limit is how big it can be
+func buildDNSResponse(q *dnsQuery, rcode int, answers []dnsRR, authoritative bool, zone string, limit int) []byte {
+	build := func(answers []dnsRR, truncated bool) []byte {
+		b := make([]byte, 12, 512)
+		binary.BigEndian.PutUint16(b[0:], q.id)
+		b[2] = 0x80 | byte(q.opcode<<3)
+		if authoritative {
+			b[2] |= 0x04
+		}
+		if truncated {
+			b[2] |= 0x02
+		}
+		if q.rd {
+			b[2] |= 0x01
+		}
+		b[3] = byte(rcode & 0xF)
+
+		var qdcount, ancount, nscount, arcount uint16
+		if q.question != nil {
+			qdcount = 1
+			b = append(b, q.question...)
+		}
+		for _, rr := range answers {
+			// A pointer back to the name in the question
+			b = append(b, 0xC0, 12)
+			b = binary.BigEndian.AppendUint16(b, rr.rrtype)
+			b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+			b = binary.BigEndian.AppendUint32(b, rr.ttl)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(rr.rdata)))
+			b = append(b, rr.rdata...)
+			ancount++
+		}
+		if authoritative && len(answers) == 0 {
+			// No data or no such name, the SOA says how long to cache that
+			// for
+			soa := soaRdata(zone)
+			b = appendDNSName(b, zone)
+			b = binary.BigEndian.AppendUint16(b, dnsTypeSOA)
+			b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+			b = binary.BigEndian.AppendUint32(b, 0)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(soa)))
+			b = append(b, soa...)
+			nscount++
+		}
+		if q.edns {
+			var opt []byte
+			if q.ecs != nil {
+				// The scope is how much of the subnet the answer depends
+				// on, which is all of it for the TXT record and none of it
+				// otherwise
+				scope := uint8(0)
+				if q.qtype == dnsTypeTXT || q.qtype == dnsTypeANY {
+					scope = q.ecs.sourcePrefix
+				}
+				opt = binary.BigEndian.AppendUint16(opt, dnsOptionECS)
+				opt = binary.BigEndian.AppendUint16(opt, uint16(4+len(q.ecs.addr)))
+				opt = binary.BigEndian.AppendUint16(opt, q.ecs.family)
+				opt = append(opt, q.ecs.sourcePrefix, scope)
+				opt = append(opt, q.ecs.addr...)
+			}
+			b = append(b, 0)
+			b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+			b = binary.BigEndian.AppendUint16(b, dnsEDNSSize)
+			b = binary.BigEndian.AppendUint32(b, 0)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(opt)))
+			b = append(b, opt...)
+			arcount++
+		}
+
+		binary.BigEndian.PutUint16(b[4:], qdcount)
+		binary.BigEndian.PutUint16(b[6:], ancount)
+		binary.BigEndian.PutUint16(b[8:], nscount)
+		binary.BigEndian.PutUint16(b[10:], arcount)
+		return b
+	}
+
+	b := build(answers, false)
+	if len(b) > limit {
+		b = build(nil, true)
+	}
+	return b
+}
+
+// handleDNS answers msg from addr, the response is nil when there's
+// nothing worth saying
+func handleDNS(msg []byte, addr net.Addr, proto string, limit int) []byte {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	zone := dnsZone()
+	q, err := parseDNSQuery(msg)
+	if q == nil {
+		// Not even a header, or a response, there's nobody to answer
+		return nil
+	}
+
+	rcode, authoritative := dnsRcodeFormErr, false
+	var answers []dnsRR
+	switch {
+	case err != nil:
+		q.question = nil
+	case q.opcode != 0:
+		rcode = dnsRcodeNotImp
+	default:
+		rcode, answers, authoritative, zone = dnsAnswer(q, ip)
+	}
+	if limit == 0 {
+		limit = q.udpSize
+	}
+	resp := buildDNSResponse(q, rcode, answers, authoritative, zone, limit)
+
+	qtype := dnsTypeName(q.qtype)
+	// Anyone can ask for any type, don't let them make up metrics
+	metricType := "other"
+	if _, ok := dnsTypeNames[q.qtype]; ok {
+		metricType = qtype
+	}
+	dnsQueries.inc(proto, metricType, dnsRcodeNames[rcode])
+	ecs := ""
+	if q.ecs != nil {
+		ecs = "ecs=" + q.ecs.String()
+	}
+	name := q.name
+	if name == "" {
+		name = "-"
+	}
+	queueAccessLog(ip.String(), "-", qtype, strings.TrimSuffix(zone, "."), name, ecs, "DNS/"+proto, rcode, int64(len(resp)), "", "")
+
+	return resp
+}
+
+// dnsZone is -dns-zone as a lower case fully qualified name
+func dnsZone() string {
+	return strings.ToLower(strings.TrimSuffix(*dnsZoneName, ".")) + "."
+}
+
+// startDNS starts the DNS server on -dns-listen, over both UDP and TCP
+func startDNS() {
+	if *dnsListen == "" {
+		return
+	}
+
+	pc, err := net.ListenPacket("udp", *dnsListen)
+	if err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+	l, err := net.Listen("tcp", *dnsListen)
+	if err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+	log.Info("Serving DNS for " + dnsZone() + " and " + dyndnsZone() + " on " + *dnsListen)
+
+	go serveDNSUDP(pc)
+	go serveDNSTCP(l)
+}
+
+func serveDNSUDP(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if resp := handleDNS(buf[:n], addr, "UDP", 0); resp != nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+func serveDNSTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Error(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go serveDNSConn(conn)
+	}
+}
+
+// serveDNSConn answers length prefixed queries on conn until it goes quiet
+func serveDNSConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdle))
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+
+		resp := handleDNS(msg, conn.RemoteAddr(), "TCP", 65535)
+		if resp == nil {
+			return
+		}
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
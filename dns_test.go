@@ -0,0 +1,269 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testDNSQuery builds a query for name, with an OPT record holding opts
+// when opts isn't nil
+func testDNSQuery(name string, qtype uint16, opts []byte) []byte {
+	b := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	b = appendDNSName(b, name)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	if opts != nil {
+		b[11] = 1
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+		b = binary.BigEndian.AppendUint16(b, 4096)
+		b = binary.BigEndian.AppendUint32(b, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(opts)))
+		b = append(b, opts...)
+	}
+	return b
+}
+
+func testECSOption(family uint16, prefix uint8, addr []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, dnsOptionECS)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(addr)))
+	b = binary.BigEndian.AppendUint16(b, family)
+	b = append(b, prefix, 0)
+	return append(b, addr...)
+}
+
+func TestReadDNSName(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		off  int
+		want string
+		end  int
+		bad  bool
+	}{
+		{"simple", []byte{3, 'f', 'o', 'o', 3, 'c', 'o', 'm', 0}, 0, "foo.com.", 9, false},
+		{"root", []byte{0}, 0, ".", 1, false},
+		{"compressed", []byte{3, 'c', 'o', 'm', 0, 3, 'f', 'o', 'o', 0xC0, 0}, 5, "foo.com.", 11, false},
+		{"escaped", []byte{3, 'a', '.', ' ', 0}, 0, `a\.\032.`, 5, false},
+		{"pointer loop", []byte{0xC0, 0}, 0, "", 0, true},
+		{"truncated label", []byte{5, 'a', 'b'}, 0, "", 0, true},
+		{"no end", []byte{1, 'a'}, 0, "", 0, true},
+		{"truncated pointer", []byte{0xC0}, 0, "", 0, true},
+		{"reserved label type", []byte{0x40, 0}, 0, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, end, err := readDNSName(tt.msg, tt.off)
+			if tt.bad {
+				if err == nil {
+					t.Errorf("read %q", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want || end != tt.end {
+				t.Errorf("got %q %d %v, want %q %d", got, end, err, tt.want, tt.end)
+			}
+		})
+	}
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	response := testDNSQuery("a.test", dnsTypeA, nil)
+	response[2] |= 0x80
+	two := testDNSQuery("a.test", dnsTypeA, nil)
+	two[5] = 2
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		qname string
+		qtype uint16
+		edns  bool
+		size  int
+		ecs   string
+		bad   bool
+	}{
+		{name: "plain", msg: testDNSQuery("Dns.Ifcfg.org", dnsTypeA, nil), qname: "Dns.Ifcfg.org.", qtype: dnsTypeA, size: 512},
+		{name: "edns", msg: testDNSQuery("dns.ifcfg.org", dnsTypeTXT, []byte{}), qname: "dns.ifcfg.org.", qtype: dnsTypeTXT, edns: true, size: dnsEDNSSize},
+		{name: "ecs v4", msg: testDNSQuery("dns.ifcfg.org", dnsTypeTXT, testECSOption(1, 24, []byte{192, 0, 2})), qname: "dns.ifcfg.org.", qtype: dnsTypeTXT, edns: true, size: dnsEDNSSize, ecs: "192.0.2.0/24"},
+		{name: "ecs v6", msg: testDNSQuery("dns.ifcfg.org", dnsTypeTXT, testECSOption(2, 48, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 1})), qname: "dns.ifcfg.org.", qtype: dnsTypeTXT, edns: true, size: dnsEDNSSize, ecs: "2001:db8:1::/48"},
+		{name: "other options", msg: testDNSQuery("dns.ifcfg.org", dnsTypeA, []byte{0, 10, 0, 2, 1, 2}), qname: "dns.ifcfg.org.", qtype: dnsTypeA, edns: true, size: dnsEDNSSize},
+		{name: "short", msg: []byte{0, 1, 2}, bad: true},
+		{name: "response", msg: response, bad: true},
+		{name: "two questions", msg: two, bad: true},
+		{name: "truncated question", msg: testDNSQuery("a.test", dnsTypeA, nil)[:14], bad: true},
+		{name: "ecs prefix too long", msg: testDNSQuery("a.test", dnsTypeTXT, testECSOption(1, 33, []byte{1, 2, 3, 4, 5})), bad: true},
+		{name: "ecs address too long", msg: testDNSQuery("a.test", dnsTypeTXT, testECSOption(1, 8, []byte{1, 2})), bad: true},
+		{name: "ecs bad family", msg: testDNSQuery("a.test", dnsTypeTXT, testECSOption(3, 0, nil)), bad: true},
+		{name: "truncated option", msg: testDNSQuery("a.test", dnsTypeTXT, []byte{0, 8, 0, 9, 0}), bad: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseDNSQuery(tt.msg)
+			if tt.bad {
+				if err == nil {
+					t.Errorf("parsed %+v", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.id != 0x1234 || !q.rd || q.name != tt.qname || q.qtype != tt.qtype || q.qclass != dnsClassIN || q.edns != tt.edns || q.udpSize != tt.size {
+				t.Errorf("got %+v", q)
+			}
+			ecs := ""
+			if q.ecs != nil {
+				ecs = q.ecs.String()
+			}
+			if ecs != tt.ecs {
+				t.Errorf("ecs is %q, want %q", ecs, tt.ecs)
+			}
+		})
+	}
+}
+
+// testDNSResponse is the parts of a response the tests look at
+type testDNSResponse struct {
+	id             uint16
+	rcode          int
+	aa, tc         bool
+	qd, an, ns, ar int
+	answers        [][]byte
+	answerTypes    []uint16
+}
+
+func parseTestDNSResponse(t *testing.T, b []byte) testDNSResponse {
+	t.Helper()
+	if len(b) < 12 || b[2]&0x80 == 0 {
+		t.Fatalf("not a response: %x", b)
+	}
+	r := testDNSResponse{
+		id:    binary.BigEndian.Uint16(b),
+		rcode: int(b[3] & 0xF),
+		aa:    b[2]&0x04 != 0,
+		tc:    b[2]&0x02 != 0,
+		qd:    int(binary.BigEndian.Uint16(b[4:])),
+		an:    int(binary.BigEndian.Uint16(b[6:])),
+		ns:    int(binary.BigEndian.Uint16(b[8:])),
+		ar:    int(binary.BigEndian.Uint16(b[10:])),
+	}
+	off := 12
+	if r.qd == 1 {
+		_, next, err := readDNSName(b, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off = next + 4
+	}
+	for i := 0; i < r.an; i++ {
+		_, next, err := readDNSName(b, off)
+		if err != nil || next+10 > len(b) {
+			t.Fatalf("bad answer %d: %v", i, err)
+		}
+		n := int(binary.BigEndian.Uint16(b[next+8:]))
+		r.answerTypes = append(r.answerTypes, binary.BigEndian.Uint16(b[next:]))
+		r.answers = append(r.answers, b[next+10:next+10+n])
+		off = next + 10 + n
+	}
+	return r
+}
+
+func TestHandleDNS(t *testing.T) {
+	old := *dnsZoneName
+	*dnsZoneName = "dns.ifcfg.test"
+	t.Cleanup(func() { *dnsZoneName = old })
+
+	v4 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}
+	notImp := testDNSQuery("dns.ifcfg.test", dnsTypeA, nil)
+	notImp[2] |= 2 << 3
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		from    net.Addr
+		rcode   int
+		aa      bool
+		answers []string
+		ns      int
+	}{
+		{"A", testDNSQuery("dns.ifcfg.test", dnsTypeA, nil), v4, dnsRcodeSuccess, true, []string{"\xc0\x00\x02\x01"}, 0},
+		{"A in a subdomain", testDNSQuery("Whoami.DNS.ifcfg.test", dnsTypeA, nil), v4, dnsRcodeSuccess, true, []string{"\xc0\x00\x02\x01"}, 0},
+		{"A from IPv6", testDNSQuery("dns.ifcfg.test", dnsTypeA, nil), v6, dnsRcodeSuccess, true, nil, 1},
+		{"AAAA", testDNSQuery("dns.ifcfg.test", dnsTypeAAAA, nil), v6, dnsRcodeSuccess, true, []string{string(net.ParseIP("2001:db8::1"))}, 0},
+		{"TXT", testDNSQuery("dns.ifcfg.test", dnsTypeTXT, nil), v4, dnsRcodeSuccess, true, []string{"\x09192.0.2.1"}, 0},
+		{"TXT with ecs", testDNSQuery("dns.ifcfg.test", dnsTypeTXT, testECSOption(1, 24, []byte{198, 51, 100})), &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, dnsRcodeSuccess, true, []string{"\x09192.0.2.1", "\x23edns0-client-subnet 198.51.100.0/24"}, 0},
+		{"SOA", testDNSQuery("dns.ifcfg.test", dnsTypeSOA, nil), v4, dnsRcodeSuccess, true, []string{string(soaRdata("dns.ifcfg.test."))}, 0},
+		{"other zone", testDNSQuery("example.com", dnsTypeA, nil), v4, dnsRcodeRefused, false, nil, 0},
+		{"lookalike zone", testDNSQuery("notdns.ifcfg.test", dnsTypeA, nil), v4, dnsRcodeRefused, false, nil, 0},
+		{"not a query", notImp, v4, dnsRcodeNotImp, false, nil, 0},
+		{"garbage question", []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 0x40}, v4, dnsRcodeFormErr, false, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := handleDNS(tt.msg, tt.from, "UDP", 0)
+			r := parseTestDNSResponse(t, b)
+			if r.id != 0x1234 || r.rcode != tt.rcode || r.aa != tt.aa || r.ns != tt.ns {
+				t.Errorf("got %+v", r)
+			}
+			if len(r.answers) != len(tt.answers) {
+				t.Fatalf("got %d answers, want %d", len(r.answers), len(tt.answers))
+			}
+			for i, a := range r.answers {
+				if string(a) != tt.answers[i] {
+					t.Errorf("answer %d is %q, want %q", i, a, tt.answers[i])
+				}
+			}
+		})
+	}
+
+	// Nothing to say to something that isn't even a query
+	if b := handleDNS([]byte{1, 2}, v4, "UDP", 0); b != nil {
+		t.Errorf("answered a runt with %x", b)
+	}
+}
+
+func TestBuildDNSResponseTruncates(t *testing.T) {
+	q, err := parseDNSQuery(testDNSQuery("dns.ifcfg.test", dnsTypeTXT, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := dnsRR{dnsTypeTXT, txtRdata(strings.Repeat("x", 255)), 0}
+	b := buildDNSResponse(q, dnsRcodeSuccess, []dnsRR{long, long}, true, "dns.ifcfg.test.", 512)
+	if len(b) > 512 {
+		t.Fatalf("response is %d bytes", len(b))
+	}
+	r := parseTestDNSResponse(t, b)
+	if !r.tc || r.an != 0 {
+		t.Errorf("got %+v, want it truncated without answers", r)
+	}
+
+	b = buildDNSResponse(q, dnsRcodeSuccess, []dnsRR{long, long}, true, "dns.ifcfg.test.", 65535)
+	if r := parseTestDNSResponse(t, b); r.tc || r.an != 2 || !bytes.Equal(r.answers[1], long.rdata) {
+		t.Errorf("got %+v, want both answers", r)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	domainsFile        = "domains.txt"
+	pendingDomainsFile = "domains.pending.txt"
+)
+
+var (
+	domainMu sync.RWMutex
+	// Domains we'll get certificates for
+	domainList = []string{}
+	// Domains we've seen requests for but that haven't been approved yet,
+	// only used with -approve-domains
+	pendingDomains = []string{}
+)
+
+var errDomainNotFound = errors.New("domain not found")
+
+func domainIsRegistered(domain string) bool {
+	domainMu.RLock()
+	defer domainMu.RUnlock()
+	return containsString(domainList, domain)
+}
+
+func domainIsPending(domain string) bool {
+	domainMu.RLock()
+	defer domainMu.RUnlock()
+	return containsString(pendingDomains, domain)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) ([]string, bool) {
+	for i, v := range list {
+		if v == s {
+			return append(list[:i:i], list[i+1:]...), true
+		}
+	}
+	return list, false
+}
+
+// listDomains returns copies of the registered and pending domains
+func listDomains() ([]string, []string) {
+	domainMu.RLock()
+	defer domainMu.RUnlock()
+	return append([]string{}, domainList...), append([]string{}, pendingDomains...)
+}
+
+// hostPolicy is the autocert.HostPolicy, only letting through registered
+// domains
+func hostPolicy(ctx context.Context, host string) error {
+	if !domainIsRegistered(host) {
+		return fmt.Errorf("acme/autocert: host %q not configured in %s", host, domainsFile)
+	}
+	return nil
+}
+
+// seenDomain is called when we get a request for domain, registering it
+// straight away, or with -approve-domains, waiting for someone to approve it
+func seenDomain(domain string) {
+	if domainIsRegistered(domain) {
+		return
+	}
+	if *approveDomains {
+		addPendingDomain(domain)
+		return
+	}
+	addToDomainList(domain, true)
+}
+
+func addToDomainList(domain string, isNew bool) {
+	if domain == "" {
+		log.Warn("Cannot use an empty string as a domain")
+		return
+	}
+
+	domainMu.Lock()
+	defer domainMu.Unlock()
+
+	if containsString(domainList, domain) {
+		log.Noticef("%s already in domain list, returning\n", domain)
+		return
+	}
+	domainList = append(domainList, domain)
+
+	err := writeDomainFile(domainsFile, domainList)
+	if err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+
+	if list, ok := removeString(pendingDomains, domain); ok {
+		pendingDomains = list
+		if err := writeDomainFile(pendingDomainsFile, pendingDomains); err != nil {
+			log.Error(err)
+		}
+	}
+
+	if isNew {
+		log.Noticef("Added %s to registered domains", domain)
+	}
+
+	acme.RateLimit(err)
+}
+
+func addPendingDomain(domain string) {
+	if domain == "" {
+		return
+	}
+
+	domainMu.Lock()
+	defer domainMu.Unlock()
+
+	if containsString(pendingDomains, domain) || containsString(domainList, domain) {
+		return
+	}
+	pendingDomains = append(pendingDomains, domain)
+
+	if err := writeDomainFile(pendingDomainsFile, pendingDomains); err != nil {
+		log.Error(err)
+	}
+	log.Noticef("%s is waiting for approval", domain)
+}
+
+// approveDomain moves domain from pending to registered
+func approveDomain(domain string) error {
+	if !domainIsPending(domain) {
+		return errDomainNotFound
+	}
+	addToDomainList(domain, true)
+	return nil
+}
+
+// removeDomain forgets about domain, whether it's registered or pending
+func removeDomain(domain string) error {
+	domainMu.Lock()
+	defer domainMu.Unlock()
+
+	var removed, removedPending bool
+	domainList, removed = removeString(domainList, domain)
+	pendingDomains, removedPending = removeString(pendingDomains, domain)
+
+	if removed {
+		if err := writeDomainFile(domainsFile, domainList); err != nil {
+			return err
+		}
+		log.Noticef("Removed %s from registered domains", domain)
+	}
+	if removedPending {
+		if err := writeDomainFile(pendingDomainsFile, pendingDomains); err != nil {
+			return err
+		}
+	}
+	if !removed && !removedPending {
+		return errDomainNotFound
+	}
+	return nil
+}
+
+func writeDomainFile(path string, domains []string) error {
+	return ioutil.WriteFile(path, []byte(strings.Join(domains, "\n")), 0644)
+}
+
+func readDomainFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if d := strings.TrimSpace(scanner.Text()); d != "" && !containsString(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// loadDomainList (re)reads the registered and pending domains from disk
+func loadDomainList() {
+	if _, err := os.Stat(domainsFile); os.IsNotExist(err) {
+		f, err := os.Create(domainsFile)
+		if err != nil {
+			log.Fatal(err)
+			panic(err)
+		}
+		f.Close()
+	}
+
+	domains, err := readDomainFile(domainsFile)
+	if err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+	pending, err := readDomainFile(pendingDomainsFile)
+	if err != nil {
+		log.Error(err)
+	}
+
+	domainMu.Lock()
+	domainList = append([]string{}, domains...)
+	pendingDomains = pending
+	domainMu.Unlock()
+
+	log.Noticef("There are now %d domains registered\n", len(domains))
+}
@@ -0,0 +1,389 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/go-playground/log"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dynamic DNS, speaking the DynDNS2 protocol most routers know:
+//
+//	GET /nic/update?hostname=home.dyn.ifcfg.org&myip=203.0.113.7
+//
+// with Basic auth for one of the users in the config. myip defaults to the
+// address the request came from, so the v4 and v6 hosts set the A and AAAA
+// records. The records are served by the DNS server for -dyndns-zone
+
+const (
+	dyndnsBucket = "dyndns"
+	dyndnsTTL    = 60
+)
+
+// DynDNSUser can update the records for Hostnames
+type DynDNSUser struct {
+	Username string `json:"username"`
+	// A bcrypt or argon2 hash, like henry.sites passwd makes
+	PasswordHash string `json:"password_hash"`
+	// Plain text passwords aren't taken, it's only here to say so
+	Password  string   `json:"password,omitempty"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// dyndnsRecord is the addresses for a hostname
+type dyndnsRecord struct {
+	Hostname  string    `json:"hostname"`
+	IPv4      string    `json:"ipv4,omitempty"`
+	IPv6      string    `json:"ipv6,omitempty"`
+	Updated   time.Time `json:"updated"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+var errDynDNSNotFound = errors.New("no record for that hostname")
+
+// 3 wrong passwords, then one a minute, for an IP or IPv6 /64
+var dyndnsAuthLimiter = newRateLimiter(1.0/60, 3)
+
+// dyndnsZone is -dyndns-zone as a lower case fully qualified name
+func dyndnsZone() string {
+	return strings.ToLower(strings.TrimSuffix(*dyndnsZoneName, ".")) + "."
+}
+
+// inDynDNSZone says whether hostname, fully qualified or not, is a name
+// in the dyndns zone, not counting the zone itself
+func inDynDNSZone(hostname string) bool {
+	name := strings.ToLower(strings.TrimSuffix(hostname, ".")) + "."
+	return strings.HasSuffix(name, "."+dyndnsZone())
+}
+
+// validateDynDNS checks the dyndns users, lowercasing their hostnames
+func validateDynDNS(users []DynDNSUser) error {
+	seen := map[string]bool{}
+	for i, u := range users {
+		if u.Username == "" || strings.Contains(u.Username, ":") {
+			return errors.New("dyndns usernames can't be empty or have a : in them")
+		}
+		if seen[u.Username] {
+			return fmt.Errorf("dyndns user %s is there more than once", u.Username)
+		}
+		seen[u.Username] = true
+		if u.Password != "" {
+			return fmt.Errorf("dyndns user %s has a plain text password, hash it with henry.sites passwd for password_hash", u.Username)
+		}
+		if !supportedPasswordHash(u.PasswordHash) {
+			return fmt.Errorf("dyndns user %s needs a bcrypt or argon2 password_hash", u.Username)
+		}
+		for j, h := range u.Hostnames {
+			// Hostnames in updates are lowercased before they're looked for
+			h = strings.ToLower(strings.TrimSuffix(h, "."))
+			if !validDomain(h) || !inDynDNSZone(h) {
+				return fmt.Errorf("dyndns hostname %s isn't a name in %s", h, dyndnsZone())
+			}
+			users[i].Hostnames[j] = h
+		}
+	}
+	return nil
+}
+
+// dyndnsUser returns the user with username and password, or nil
+func dyndnsUser(username, password string) *DynDNSUser {
+	var found *DynDNSUser
+	// Unknown users are checked against a hash too, so they take as long
+	// and can't be told apart
+	hash := dummyPasswordHash()
+	users := config().DynDNS
+	for i, u := range users {
+		if subtle.ConstantTimeCompare([]byte(u.Username), []byte(username)) == 1 {
+			found, hash = &users[i], u.PasswordHash
+		}
+	}
+	if !checkPasswordHash(hash, password) {
+		return nil
+	}
+	return found
+}
+
+func getDynDNS(hostname string) (*dyndnsRecord, error) {
+	var rec *dyndnsRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dyndnsBucket))
+		if b == nil {
+			return errDynDNSNotFound
+		}
+		v := b.Get([]byte(hostname))
+		if v == nil {
+			return errDynDNSNotFound
+		}
+		rec = &dyndnsRecord{}
+		return json.Unmarshal(v, rec)
+	})
+	return rec, err
+}
+
+func listDynDNS() ([]dyndnsRecord, error) {
+	records := []dyndnsRecord{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dyndnsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var rec dyndnsRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// updateDynDNS sets the addresses of hostname to ips, returning whether
+// anything changed
+func updateDynDNS(hostname string, ips []net.IP, username string) (bool, error) {
+	changed := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(dyndnsBucket))
+		if err != nil {
+			return err
+		}
+		rec := dyndnsRecord{Hostname: hostname}
+		if v := b.Get([]byte(hostname)); v != nil {
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+		}
+
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				changed = changed || rec.IPv4 != ip.String()
+				rec.IPv4 = ip.String()
+			} else {
+				changed = changed || rec.IPv6 != ip.String()
+				rec.IPv6 = ip.String()
+			}
+		}
+		if !changed {
+			return nil
+		}
+		rec.Updated = time.Now().UTC()
+		rec.UpdatedBy = username
+
+		v, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(hostname), v)
+	})
+	return changed, err
+}
+
+func removeDynDNS(hostname string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dyndnsBucket))
+		if b == nil || b.Get([]byte(hostname)) == nil {
+			return errDynDNSNotFound
+		}
+		return b.Delete([]byte(hostname))
+	})
+}
+
+// writeZoneFile writes records as a BIND zone file for the dyndns zone
+func writeZoneFile(w io.Writer, records []dyndnsRecord) {
+	sort.Slice(records, func(i, j int) bool { return records[i].Hostname < records[j].Hostname })
+
+	// The serial is the last time anything changed
+	var serial int64 = 1
+	for _, rec := range records {
+		if s := rec.Updated.Unix(); s > serial {
+			serial = s
+		}
+	}
+
+	zone := dyndnsZone()
+	fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", zone, dyndnsTTL)
+	fmt.Fprintf(w, "@\tIN\tSOA\t%s hostmaster.%s %d 3600 600 86400 %d\n", zone, zone, serial, dyndnsTTL)
+	for _, rec := range records {
+		name := strings.TrimSuffix(rec.Hostname+".", "."+zone)
+		if rec.IPv4 != "" {
+			fmt.Fprintf(w, "%s\tIN\tA\t%s\n", name, rec.IPv4)
+		}
+		if rec.IPv6 != "" {
+			fmt.Fprintf(w, "%s\tIN\tAAAA\t%s\n", name, rec.IPv6)
+		}
+	}
+}
+
+// dyndnsAnswer answers a DNS query for name in the dyndns zone
+func dyndnsAnswer(q *dnsQuery, name string) (int, []dnsRR) {
+	if name == dyndnsZone() {
+		if q.qtype == dnsTypeSOA {
+			return dnsRcodeSuccess, []dnsRR{{dnsTypeSOA, soaRdata(name), 0}}
+		}
+		return dnsRcodeSuccess, nil
+	}
+
+	rec, err := getDynDNS(strings.TrimSuffix(name, "."))
+	if err == errDynDNSNotFound {
+		return dnsRcodeNXDomain, nil
+	}
+	if err != nil {
+		log.Error(err)
+		return dnsRcodeServFail, nil
+	}
+
+	var answers []dnsRR
+	if rec.IPv4 != "" && (q.qtype == dnsTypeA || q.qtype == dnsTypeANY) {
+		answers = append(answers, dnsRR{dnsTypeA, net.ParseIP(rec.IPv4).To4(), dyndnsTTL})
+	}
+	if rec.IPv6 != "" && (q.qtype == dnsTypeAAAA || q.qtype == dnsTypeANY) {
+		answers = append(answers, dnsRR{dnsTypeAAAA, net.ParseIP(rec.IPv6).To16(), dyndnsTTL})
+	}
+	return dnsRcodeSuccess, answers
+}
+
+// dyndnsUpdateHandler is the DynDNS2 update endpoint. The protocol wants a
+// 200 and a text code for most failures, badauth, nohost and the like
+func dyndnsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var lines []string
+	code := http.StatusOK
+	defer func() {
+		body := strings.Join(lines, "\n") + "\n"
+		w.Header().Set("Server", "ifcfg.org")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		n, _ := io.WriteString(w, body)
+		go logRequest(w, r, int64(n), code)
+	}()
+
+	ip := GetIP(r)
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ifcfg.org dyndns"`)
+		code, lines = http.StatusUnauthorized, []string{"badauth"}
+		return
+	}
+	// Locked out IPs are turned away before their password is looked at,
+	// or they could keep guessing and only be told when they got it
+	if locked, _ := dyndnsAuthLimiter.blocked(clientKey64(ip)); locked {
+		code, lines = http.StatusTooManyRequests, []string{"abuse"}
+		return
+	}
+	user := dyndnsUser(username, password)
+	if user == nil {
+		dyndnsAuthLimiter.take(clientKey64(ip))
+		log.Warnf("Failed dyndns login for %q from %s", username, ip)
+		w.Header().Set("WWW-Authenticate", `Basic realm="ifcfg.org dyndns"`)
+		code, lines = http.StatusUnauthorized, []string{"badauth"}
+		return
+	}
+
+	var ips []net.IP
+	if myip := r.URL.Query().Get("myip"); myip != "" {
+		for _, s := range strings.Split(myip, ",") {
+			parsed := net.ParseIP(strings.TrimSpace(s))
+			if parsed == nil {
+				code, lines = http.StatusBadRequest, []string{"badip"}
+				return
+			}
+			ips = append(ips, parsed)
+		}
+	} else {
+		ips = []net.IP{net.ParseIP(ip)}
+	}
+	var shown []string
+	for _, parsed := range ips {
+		shown = append(shown, parsed.String())
+	}
+
+	hostnames := r.URL.Query().Get("hostname")
+	if hostnames == "" {
+		lines = []string{"notfqdn"}
+		return
+	}
+	for _, hostname := range strings.Split(hostnames, ",") {
+		hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+		if !validDomain(hostname) {
+			lines = append(lines, "notfqdn")
+			continue
+		}
+		if !containsString(user.Hostnames, hostname) {
+			lines = append(lines, "nohost")
+			continue
+		}
+
+		changed, err := updateDynDNS(hostname, ips, user.Username)
+		switch {
+		case err != nil:
+			log.Error(err)
+			lines = append(lines, "911")
+		case changed:
+			log.Infof("dyndns: %s is now %s", hostname, strings.Join(shown, ","))
+			lines = append(lines, "good "+strings.Join(shown, ","))
+		default:
+			lines = append(lines, "nochg "+strings.Join(shown, ","))
+		}
+	}
+}
+
+func dyndnsListHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := listDynDNS()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func dyndnsZoneHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := listDynDNS()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeZoneFile(w, records)
+}
+
+func dyndnsRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	hostname := strings.ToLower(mux.Vars(r)["hostname"])
+	if err := removeDynDNS(hostname); err != nil {
+		code := http.StatusInternalServerError
+		if err == errDynDNSNotFound {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateDynDNS(t *testing.T) {
+	hash, err := hashPassword("a long random string", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user DynDNSUser
+		ok   bool
+	}{
+		{"hashed", DynDNSUser{Username: "router", PasswordHash: hash, Hostnames: []string{"Home.dyn.ifcfg.org."}}, true},
+		{"plain text", DynDNSUser{Username: "router", Password: "a long random string", Hostnames: []string{"home.dyn.ifcfg.org"}}, false},
+		{"not a hash", DynDNSUser{Username: "router", PasswordHash: "a long random string", Hostnames: []string{"home.dyn.ifcfg.org"}}, false},
+		{"outside the zone", DynDNSUser{Username: "router", PasswordHash: hash, Hostnames: []string{"home.example.com"}}, false},
+		{"colon", DynDNSUser{Username: "rou:ter", PasswordHash: hash}, false},
+	}
+	for _, tt := range tests {
+		users := []DynDNSUser{tt.user}
+		err := validateDynDNS(users)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if tt.ok && users[0].Hostnames[0] != "home.dyn.ifcfg.org" {
+			t.Errorf("%s: hostname is %s", tt.name, users[0].Hostnames[0])
+		}
+	}
+}
+
+func TestDynDNSUser(t *testing.T) {
+	hash, err := hashPassword("a long random string", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, &Config{DynDNS: []DynDNSUser{
+		{Username: "router", PasswordHash: hash},
+		{Username: "nas", PasswordHash: hash},
+	}})
+
+	tests := []struct {
+		username, password, want string
+	}{
+		{"router", "a long random string", "router"},
+		{"nas", "a long random string", "nas"},
+		{"router", "wrong", ""},
+		{"nobody", "a long random string", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if u := dyndnsUser(tt.username, tt.password); u != nil {
+			got = u.Username
+		}
+		if got != tt.want {
+			t.Errorf("%s/%s got %q, want %q", tt.username, tt.password, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ifcfg's /echo, which sends back everything about the request as it
+// arrived, down to the TLS ClientHello
+
+// echoBodyLimit is as much of the body as gets echoed back
+const echoBodyLimit = 64 << 10
+
+// echoHosts serve /echo, only their connections have the order of their
+// headers recorded
+var echoHosts = map[string]bool{
+	"ifcfg.org":    true,
+	"v4.ifcfg.org": true,
+	"v6.ifcfg.org": true,
+}
+
+func isEchoHost(serverName string) bool {
+	return echoHosts[strings.ToLower(serverName)]
+}
+
+// clientHellos are the ClientHellos of open TLS connections, by remote
+// address, they're gone by the time a handler could ask the tls.Conn
+var clientHellos sync.Map
+
+// captureClientHello is the tls.Config's GetConfigForClient, it doesn't
+// change the config, it just keeps the hello for /echo
+func captureClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if hello.Conn != nil {
+		clientHellos.Store(hello.Conn.RemoteAddr().String(), newEchoHello(hello))
+	}
+	return nil, nil
+}
+
+// forgetConn is the http.Server's ConnState, dropping what we kept about a
+// connection once it's done with
+func forgetConn(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		clientHellos.Delete(c.RemoteAddr().String())
+	}
+}
+
+// echoHello is what the client offered in its ClientHello
+type echoHello struct {
+	ServerName        string   `json:"server_name,omitempty" xml:"server_name,omitempty"`
+	ALPN              []string `json:"alpn,omitempty" xml:"alpn,omitempty"`
+	SupportedVersions []string `json:"supported_versions" xml:"supported_version"`
+	CipherSuites      []string `json:"cipher_suites" xml:"cipher_suite"`
+	Curves            []string `json:"curves" xml:"curve"`
+	PointFormats      []uint8  `json:"point_formats,omitempty" xml:"point_format,omitempty"`
+	SignatureSchemes  []string `json:"signature_schemes" xml:"signature_scheme"`
+	Extensions        []uint16 `json:"extensions" xml:"extension"`
+	JA3               string   `json:"ja3" xml:"ja3"`
+	JA3Hash           string   `json:"ja3_hash" xml:"ja3_hash"`
+}
+
+// isGREASE says whether v is one of the RFC 8701 values clients throw in
+// to keep servers honest, which JA3 leaves out
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func newEchoHello(hello *tls.ClientHelloInfo) *echoHello {
+	h := &echoHello{
+		ServerName:   hello.ServerName,
+		ALPN:         hello.SupportedProtos,
+		PointFormats: hello.SupportedPoints,
+	}
+
+	// JA3 wants the version from the start of the hello, which Go doesn't
+	// give us. It's TLS 1.2 for anything offering 1.3, and otherwise the
+	// highest version offered
+	legacyVersion := uint16(0)
+	for _, v := range hello.SupportedVersions {
+		if isGREASE(v) {
+			continue
+		}
+		h.SupportedVersions = append(h.SupportedVersions, tlsVersionName(v))
+		if v > legacyVersion {
+			legacyVersion = v
+		}
+	}
+	if legacyVersion > tls.VersionTLS12 {
+		legacyVersion = tls.VersionTLS12
+	}
+
+	var ciphers, extensions, curves, points []string
+	for _, c := range hello.CipherSuites {
+		if isGREASE(c) {
+			continue
+		}
+		h.CipherSuites = append(h.CipherSuites, tls.CipherSuiteName(c))
+		ciphers = append(ciphers, strconv.Itoa(int(c)))
+	}
+	for _, e := range hello.Extensions {
+		if isGREASE(e) {
+			continue
+		}
+		h.Extensions = append(h.Extensions, e)
+		extensions = append(extensions, strconv.Itoa(int(e)))
+	}
+	for _, c := range hello.SupportedCurves {
+		if isGREASE(uint16(c)) {
+			continue
+		}
+		h.Curves = append(h.Curves, c.String())
+		curves = append(curves, strconv.Itoa(int(c)))
+	}
+	for _, p := range hello.SupportedPoints {
+		points = append(points, strconv.Itoa(int(p)))
+	}
+	for _, s := range hello.SignatureSchemes {
+		h.SignatureSchemes = append(h.SignatureSchemes, s.String())
+	}
+
+	h.JA3 = strings.Join([]string{
+		strconv.Itoa(int(legacyVersion)),
+		strings.Join(ciphers, "-"),
+		strings.Join(extensions, "-"),
+		strings.Join(curves, "-"),
+		strings.Join(points, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(h.JA3))
+	h.JA3Hash = hex.EncodeToString(sum[:])
+	return h
+}
+
+func tlsVersionName(v uint16) string {
+	if name, ok := tlsVersionNames[v]; ok {
+		return "TLS " + name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// headerRecordingListener wraps the connections from a plain text
+// listener so /echo can see the headers in the order they were sent, which
+// net/http forgets. tlsRecordingListener does the same under TLS
+type headerRecordingListener struct {
+	net.Listener
+}
+
+func (l headerRecordingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &headerRecordingConn{Conn: c}, nil
+}
+
+// tlsRecordingListener does the TLS handshakes itself, so HTTP/1
+// connections for hosts serving /echo can be handed to the server wrapped
+// in a headerRecordingConn that sees what's been decrypted. Anything else,
+// HTTP/2 especially, goes to the server as the *tls.Conn it needs to speak
+// it. HTTP/2 headers arrive HPACK encoded and net/http doesn't tell us the
+// order they came in, so there's no getting it back for those
+type tlsRecordingListener struct {
+	net.Listener
+	conf    *tls.Config
+	timeout time.Duration
+	// record says whether connections for a server name are recorded
+	record func(serverName string) bool
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTLSRecordingListener(l net.Listener, conf *tls.Config, timeout time.Duration, record func(string) bool) *tlsRecordingListener {
+	tl := &tlsRecordingListener{
+		Listener: l,
+		conf:     conf,
+		timeout:  timeout,
+		record:   record,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go tl.accept()
+	return tl
+}
+
+// accept hands every connection off to be handshaken, so a slow client
+// doesn't hold up the rest
+func (l *tlsRecordingListener) accept() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(c)
+	}
+}
+
+func (l *tlsRecordingListener) handshake(c net.Conn) {
+	tc := tls.Server(c, l.conf)
+	if l.timeout > 0 {
+		c.SetDeadline(time.Now().Add(l.timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		// What net/http would have logged to the ErrorLog for us
+		tlsHandshakeErrors.inc()
+		log.Debugf("TLS handshake error from %s: %s", c.RemoteAddr(), err)
+		// The hello was kept before it failed, and the server's ConnState
+		// never hears about this one
+		clientHellos.Delete(c.RemoteAddr().String())
+		tc.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	var conn net.Conn = tc
+	cs := tc.ConnectionState()
+	switch cs.NegotiatedProtocol {
+	case "", "http/1.1", "http/1.0":
+		if l.record != nil && l.record(cs.ServerName) {
+			conn = &headerRecordingConn{Conn: tc}
+		}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		clientHellos.Delete(c.RemoteAddr().String())
+		tc.Close()
+	}
+}
+
+func (l *tlsRecordingListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsRecordingListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// withConnTLS fills in r.TLS for the HTTP/1 connections net/http doesn't
+// know are TLS, because tlsRecordingListener wrapped them
+func withConnTLS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hc, ok := r.Context().Value(echoConnKey{}).(*headerRecordingConn); ok && r.TLS == nil {
+			if tc, ok := hc.Conn.(*tls.Conn); ok {
+				cs := tc.ConnectionState()
+				r = r.WithContext(r.Context())
+				r.TLS = &cs
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type echoConnKey struct{}
+
+// echoConnContext is the http.Server's ConnContext, putting the connection
+// where the handler can find it
+func echoConnContext(ctx context.Context, c net.Conn) context.Context {
+	if hc, ok := c.(*headerRecordingConn); ok {
+		return context.WithValue(ctx, echoConnKey{}, hc)
+	}
+	return ctx
+}
+
+// headerRecordingConn keeps the header blocks of the HTTP/1 requests read
+// from it, until a handler asks for them. It follows Content-Length to find
+// where the next request starts, and gives up on chunked bodies or anything
+// it doesn't follow
+type headerRecordingConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	buf     []byte
+	skip    int64
+	stopped bool
+	// The server reads pipelined requests before handling the first, so
+	// there can be a few waiting
+	blocks [][]byte
+}
+
+// headerRecordingBlocks is how many header blocks are kept, the oldest go
+// first
+const headerRecordingBlocks = 8
+
+func (c *headerRecordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(b[:n])
+	}
+	return n, err
+}
+
+func (c *headerRecordingConn) record(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(b) > 0 && !c.stopped {
+		if c.skip > 0 {
+			if int64(len(b)) <= c.skip {
+				c.skip -= int64(len(b))
+				return
+			}
+			b = b[c.skip:]
+			c.skip = 0
+		}
+		if len(c.buf) == 0 {
+			// Stray line endings between requests are allowed
+			b = bytes.TrimLeft(b, "\r\n")
+		}
+
+		c.buf = append(c.buf, b...)
+		end := bytes.Index(c.buf, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(c.buf) > 1<<20 {
+				c.stopped = true
+			}
+			return
+		}
+		block := c.buf[:end+4]
+		b = append([]byte{}, c.buf[end+4:]...)
+		c.buf = nil
+		if len(c.blocks) == headerRecordingBlocks {
+			c.blocks = c.blocks[1:]
+		}
+		c.blocks = append(c.blocks, block)
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(block)))
+		if err != nil || len(req.TransferEncoding) > 0 || req.ContentLength < 0 {
+			c.stopped = true
+			return
+		}
+		c.skip = req.ContentLength
+	}
+}
+
+// header returns r's header block, the first kept one with its request
+// line. It and any before it, for requests nobody asked about, are dropped
+func (c *headerRecordingConn) header(r *http.Request) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line := r.Method + " " + r.RequestURI + " " + r.Proto + "\r\n"
+	for i, block := range c.blocks {
+		if bytes.HasPrefix(block, []byte(line)) {
+			c.blocks = c.blocks[i+1:]
+			return block
+		}
+	}
+	return nil
+}
+
+// echoHeader is a header, in a list so the order can be kept
+type echoHeader struct {
+	Name  string `json:"name" xml:"name,attr"`
+	Value string `json:"value" xml:",chardata"`
+}
+
+// receivedHeaders returns the headers of r as they arrived, or sorted by
+// name when we didn't get to see them, and whether they're in order
+func receivedHeaders(r *http.Request) ([]echoHeader, bool) {
+	if hc, ok := r.Context().Value(echoConnKey{}).(*headerRecordingConn); ok {
+		if block := hc.header(r); block != nil {
+			var headers []echoHeader
+			lines := strings.Split(strings.TrimSuffix(string(block), "\r\n\r\n"), "\r\n")
+			for _, line := range lines[1:] {
+				i := strings.IndexByte(line, ':')
+				if i < 0 {
+					continue
+				}
+				headers = append(headers, echoHeader{line[:i], strings.TrimSpace(line[i+1:])})
+			}
+			return headers, true
+		}
+	}
+
+	headers := []echoHeader{{"Host", r.Host}}
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			headers = append(headers, echoHeader{name, value})
+		}
+	}
+	return headers, false
+}
+
+// ifcfgEcho is the request, as /echo sends it back
+type ifcfgEcho struct {
+	XMLName       xml.Name     `json:"-" xml:"echo"`
+	Method        string       `json:"method" xml:"method"`
+	URL           string       `json:"url" xml:"url"`
+	Proto         string       `json:"proto" xml:"proto"`
+	RemoteAddr    string       `json:"remote_addr" xml:"remote_addr"`
+	Headers       []echoHeader `json:"headers" xml:"headers>header"`
+	HeaderOrder   string       `json:"header_order" xml:"header_order"`
+	TLS           *echoTLS     `json:"tls,omitempty" xml:"tls,omitempty"`
+	Body          string       `json:"body,omitempty" xml:"body,omitempty"`
+	BodyEncoding  string       `json:"body_encoding,omitempty" xml:"body_encoding,omitempty"`
+	BodyLength    int          `json:"body_length" xml:"body_length"`
+	BodyTruncated bool         `json:"body_truncated,omitempty" xml:"body_truncated,omitempty"`
+}
+
+// echoTLS is the connection's TLS, with what the client offered in
+// ClientHello
+type echoTLS struct {
+	Version     string     `json:"version" xml:"version"`
+	CipherSuite string     `json:"cipher_suite" xml:"cipher_suite"`
+	ALPN        string     `json:"alpn,omitempty" xml:"alpn,omitempty"`
+	Resumed     bool       `json:"resumed" xml:"resumed"`
+	ClientHello *echoHello `json:"client_hello,omitempty" xml:"client_hello,omitempty"`
+}
+
+func newIfcfgEcho(r *http.Request) *ifcfgEcho {
+	e := &ifcfgEcho{
+		Method:      r.Method,
+		URL:         r.RequestURI,
+		Proto:       r.Proto,
+		RemoteAddr:  r.RemoteAddr,
+		HeaderOrder: "sorted",
+	}
+	var ordered bool
+	if e.Headers, ordered = receivedHeaders(r); ordered {
+		e.HeaderOrder = "received"
+	}
+
+	if r.TLS != nil {
+		e.TLS = &echoTLS{
+			Version:     tlsVersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ALPN:        r.TLS.NegotiatedProtocol,
+			Resumed:     r.TLS.DidResume,
+		}
+		if hello, ok := clientHellos.Load(r.RemoteAddr); ok {
+			e.TLS.ClientHello = hello.(*echoHello)
+		}
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, echoBodyLimit+1))
+	if len(body) > echoBodyLimit {
+		body = body[:echoBodyLimit]
+		e.BodyTruncated = true
+	}
+	e.BodyLength = len(body)
+	if utf8.Valid(body) {
+		e.Body = string(body)
+	} else {
+		e.Body = base64.StdEncoding.EncodeToString(body)
+		e.BodyEncoding = "base64"
+	}
+	return e
+}
+
+// text writes the request out much like it came in, followed by the TLS
+// details
+func (e *ifcfgEcho) text() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\n", e.Method, e.URL, e.Proto)
+	for _, h := range e.Headers {
+		fmt.Fprintf(&buf, "%s: %s\n", h.Name, h.Value)
+	}
+	buf.WriteString("\n")
+	if e.BodyLength > 0 {
+		buf.WriteString(e.Body)
+		if e.BodyTruncated {
+			fmt.Fprintf(&buf, "\n[truncated to %d bytes]", echoBodyLimit)
+		}
+		buf.WriteString("\n\n")
+	}
+
+	fmt.Fprintf(&buf, "remote_addr:  %s\nheader_order: %s\n", e.RemoteAddr, e.HeaderOrder)
+	if e.TLS != nil {
+		buf.WriteString("\n")
+		writeText(&buf, struct {
+			TLS *echoTLS `json:"tls"`
+		}{e.TLS})
+	}
+	return buf.String()
+}
+
+func ifcfgEchoHandler(w http.ResponseWriter, r *http.Request) {
+	e := newIfcfgEcho(r)
+	ifcfgRespond(w, r, ifcfgFormat(r), e, e.text())
+}
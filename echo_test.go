@@ -0,0 +1,304 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderRecordingConnRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		reads   []string
+		blocks  []string
+		stopped bool
+	}{
+		{
+			"one request",
+			[]string{"GET / HTTP/1.1\r\nHost: a\r\nB: 1\r\n\r\n"},
+			[]string{"GET / HTTP/1.1\r\nHost: a\r\nB: 1\r\n\r\n"}, false,
+		},
+		{
+			"split across reads",
+			[]string{"GET / HT", "TP/1.1\r\nHost: a\r", "\n\r\n"},
+			[]string{"GET / HTTP/1.1\r\nHost: a\r\n\r\n"}, false,
+		},
+		{
+			"pipelined",
+			[]string{"GET /1 HTTP/1.1\r\nHost: a\r\n\r\nGET /2 HTTP/1.1\r\nHost: b\r\n\r\n"},
+			[]string{"GET /1 HTTP/1.1\r\nHost: a\r\n\r\n", "GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"}, false,
+		},
+		{
+			"body skipped",
+			[]string{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 16\r\n\r\nX: y\r\n\r\nZ: 1\r\n\r\n", "GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"},
+			[]string{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 16\r\n\r\n", "GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"}, false,
+		},
+		{
+			"body split across reads",
+			[]string{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\n0123", "456", "789GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"},
+			[]string{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\n", "GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"}, false,
+		},
+		{
+			"stray line endings",
+			[]string{"GET /1 HTTP/1.1\r\nHost: a\r\n\r\n\r\n", "\r\nGET /2 HTTP/1.1\r\nHost: b\r\n\r\n"},
+			[]string{"GET /1 HTTP/1.1\r\nHost: a\r\n\r\n", "GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"}, false,
+		},
+		{
+			"gives up on chunked",
+			[]string{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n4\r\n\r\n\r\n\r\n0\r\n\r\n", "GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"},
+			[]string{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n"}, true,
+		},
+		{
+			"gives up on garbage",
+			[]string{"\x16\x03\x01 not http\r\n\r\n", "GET /2 HTTP/1.1\r\nHost: b\r\n\r\n"},
+			[]string{"\x16\x03\x01 not http\r\n\r\n"}, true,
+		},
+		{
+			"gives up on huge headers",
+			[]string{"GET / HTTP/1.1\r\nHost: a\r\nX: " + strings.Repeat("x", 1<<20), "\r\n\r\n"},
+			nil, true,
+		},
+		{
+			"keeps the latest",
+			[]string{strings.Repeat("GET / HTTP/1.1\r\nHost: a\r\n\r\n", headerRecordingBlocks), "GET /last HTTP/1.1\r\nHost: a\r\n\r\n"},
+			append(strings.SplitAfter(strings.Repeat("GET / HTTP/1.1\r\nHost: a\r\n\r\n", headerRecordingBlocks-1), "\r\n\r\n")[:headerRecordingBlocks-1], "GET /last HTTP/1.1\r\nHost: a\r\n\r\n"), false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &headerRecordingConn{}
+			for _, b := range tt.reads {
+				c.record([]byte(b))
+			}
+			var blocks []string
+			for _, b := range c.blocks {
+				blocks = append(blocks, string(b))
+			}
+			if strings.Join(blocks, "|") != strings.Join(tt.blocks, "|") || c.stopped != tt.stopped {
+				t.Errorf("got %q, stopped %v", blocks, c.stopped)
+			}
+		})
+	}
+}
+
+func TestHeaderRecordingConnHeader(t *testing.T) {
+	c := &headerRecordingConn{}
+	c.record([]byte("GET /a?b=1 HTTP/1.1\r\nHost: a\r\n\r\nGET /skipped HTTP/1.1\r\nHost: a\r\n\r\nGET /c HTTP/1.1\r\nHost: a\r\n\r\n"))
+
+	for _, tt := range []struct {
+		target string
+		found  bool
+	}{
+		{"/a?b=1", true},
+		{"/other", false},
+		{"/c", true},
+		// Dropped with the ones before /c
+		{"/skipped", false},
+		{"/c", false},
+	} {
+		if got := c.header(httptest.NewRequest("GET", tt.target, nil)) != nil; got != tt.found {
+			t.Errorf("%s found %v", tt.target, got)
+		}
+	}
+}
+
+// testTLSConfig is a config with httptest's certificate, keeping the
+// ClientHello like the real one
+func testTLSConfig(t *testing.T) *tls.Config {
+	s := httptest.NewUnstartedServer(http.NotFoundHandler())
+	s.StartTLS()
+	cert := s.TLS.Certificates[0]
+	s.Close()
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		GetConfigForClient: captureClientHello,
+		NextProtos:         []string{"http/1.1"},
+	}
+}
+
+// serveTestTLSRecording serves the headers of each request as received,
+// whether they're in order and whether it was over TLS
+func serveTestTLSRecording(t *testing.T, conf *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: withConnTLS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			headers, ordered := receivedHeaders(r)
+			var names []string
+			for _, h := range headers {
+				names = append(names, h.Name)
+			}
+			fmt.Fprintf(w, "%s %v %v", strings.Join(names, ","), ordered, r.TLS != nil)
+		})),
+		ConnState:   forgetConn,
+		ConnContext: echoConnContext,
+	}
+	go srv.Serve(newTLSRecordingListener(l, conf, time.Second, isEchoHost))
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// sendTestRequests writes requests on a TLS connection to addr in one go,
+// returning the bodies of the responses
+func sendTestRequests(t *testing.T, addr, serverName string, requests ...string) []string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, strings.Join(requests, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	br := bufio.NewReader(conn)
+	for range requests {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		bodies = append(bodies, string(b))
+	}
+	return bodies
+}
+
+func TestTLSRecordingListener(t *testing.T) {
+	addr := serveTestTLSRecording(t, testTLSConfig(t))
+
+	tests := []struct {
+		name       string
+		serverName string
+		requests   []string
+		want       []string
+	}{
+		{
+			"in order",
+			"ifcfg.org",
+			[]string{"GET / HTTP/1.1\r\nHost: ifcfg.org\r\nZ: 1\r\nA: 2\r\nM: 3\r\n\r\n"},
+			[]string{"Host,Z,A,M true true"},
+		},
+		{
+			"pipelined past a body",
+			"v4.ifcfg.org",
+			[]string{
+				"POST / HTTP/1.1\r\nHost: ifcfg.org\r\nContent-Length: 12\r\n\r\nX: 1\r\n\r\nY: 2",
+				"GET /2 HTTP/1.1\r\nHost: ifcfg.org\r\nZ: 1\r\nA: 2\r\n\r\n",
+			},
+			[]string{"Host,Content-Length true true", "Host,Z,A true true"},
+		},
+		{
+			"chunked",
+			"ifcfg.org",
+			[]string{
+				"POST / HTTP/1.1\r\nHost: ifcfg.org\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+				"GET /2 HTTP/1.1\r\nHost: ifcfg.org\r\nZ: 1\r\nA: 2\r\n\r\n",
+			},
+			[]string{"Host,Transfer-Encoding true true", "Host,A,Z false true"},
+		},
+		{
+			"another site",
+			"example.com",
+			[]string{"GET / HTTP/1.1\r\nHost: example.com\r\nZ: 1\r\nA: 2\r\n\r\n"},
+			[]string{"Host,A,Z false true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sendTestRequests(t, addr, tt.serverName, tt.requests...)
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("request %d got %q, want %q", i+1, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTLSRecordingListenerALPN(t *testing.T) {
+	conf := testTLSConfig(t)
+	conf.NextProtos = []string{"h2", "http/1.1"}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := newTLSRecordingListener(l, conf, time.Second, isEchoHost)
+	defer tl.Close()
+
+	for _, proto := range []string{"h2", "http/1.1"} {
+		go func() {
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "ifcfg.org", InsecureSkipVerify: true, NextProtos: []string{proto}})
+			if err == nil {
+				defer conn.Close()
+				conn.Read(make([]byte, 1))
+			}
+		}()
+		c, err := tl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, recording := c.(*headerRecordingConn)
+		if recording != (proto == "http/1.1") {
+			t.Errorf("%s was handed over as a %T", proto, c)
+		}
+		c.Close()
+	}
+}
+
+func TestTLSRecordingListenerForgetsFailedHandshakes(t *testing.T) {
+	conf := testTLSConfig(t)
+	conf.Certificates = nil
+	conf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, fmt.Errorf("no certificate")
+	}
+	addr := serveTestTLSRecording(t, conf)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().String()
+	if err := tls.Client(conn, &tls.Config{ServerName: "unknown.test", InsecureSkipVerify: true}).Handshake(); err == nil {
+		t.Fatal("the handshake worked")
+	}
+	conn.Close()
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, ok := clientHellos.Load(local); !ok {
+			return
+		}
+	}
+	t.Error("the ClientHello was kept after the handshake failed")
+}
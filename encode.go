@@ -0,0 +1,249 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Just enough YAML and "key: value" text encoding for the flat-ish structs
+// ifcfg responds with, going by their json tags
+
+type field struct {
+	name  string
+	value reflect.Value
+}
+
+// jsonFields returns the exported fields of struct v, named and skipped
+// the way encoding/json would
+func jsonFields(v reflect.Value) []field {
+	var fields []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = sf.Name
+		}
+		fv := v.Field(i)
+		if len(parts) > 1 && parts[1] == "omitempty" && isEmptyValue(fv) {
+			continue
+		}
+		fields = append(fields, field{name, fv})
+	}
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func sortedMapKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	return keys
+}
+
+// scalarString formats a non-container value, ok is false for containers
+func scalarString(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func yamlScalar(v reflect.Value) string {
+	s, _ := scalarString(v)
+	if v.Kind() != reflect.String {
+		return s
+	}
+	if s == "" || strings.ContainsAny(s, ":#{}[],&*!|>'\"%@`\n\t\\") || strings.TrimSpace(s) != s ||
+		strings.HasPrefix(s, "-") || strings.HasPrefix(s, "?") {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// writeYAML writes struct, map or slice v as a YAML document
+func writeYAML(w io.Writer, v interface{}) {
+	writeYAMLValue(w, reflect.ValueOf(v), 0)
+}
+
+func writeYAMLValue(w io.Writer, v reflect.Value, indent int) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	pad := strings.Repeat("  ", indent)
+
+	writeEntry := func(key string, fv reflect.Value) {
+		for fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface {
+			if fv.IsNil() {
+				fmt.Fprintf(w, "%s%s: null\n", pad, key)
+				return
+			}
+			fv = fv.Elem()
+		}
+		if _, ok := scalarString(fv); ok {
+			fmt.Fprintf(w, "%s%s: %s\n", pad, key, yamlScalar(fv))
+			return
+		}
+		if fv.Len() == 0 && fv.Kind() != reflect.Struct {
+			if fv.Kind() == reflect.Map {
+				fmt.Fprintf(w, "%s%s: {}\n", pad, key)
+			} else {
+				fmt.Fprintf(w, "%s%s: []\n", pad, key)
+			}
+			return
+		}
+		fmt.Fprintf(w, "%s%s:\n", pad, key)
+		writeYAMLValue(w, fv, indent+1)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, f := range jsonFields(v) {
+			writeEntry(f.name, f.value)
+		}
+	case reflect.Map:
+		for _, k := range sortedMapKeys(v) {
+			writeEntry(yamlScalar(reflect.ValueOf(fmt.Sprint(k))), v.MapIndex(k))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			ev := v.Index(i)
+			if _, ok := scalarString(ev); ok {
+				fmt.Fprintf(w, "%s- %s\n", pad, yamlScalar(ev))
+				continue
+			}
+			// Nested containers in lists aren't something we need, keep
+			// them valid by writing them inline as JSON, which is YAML too
+			b, _ := json.Marshal(ev.Interface())
+			fmt.Fprintf(w, "%s- %s\n", pad, b)
+		}
+	default:
+		fmt.Fprintf(w, "%s%s\n", pad, yamlScalar(v))
+	}
+}
+
+// writeText writes struct v as aligned "key: value" lines, with nested
+// values flattened into dotted keys
+func writeText(w io.Writer, v interface{}) {
+	var lines [][2]string
+	flattenText(reflect.ValueOf(v), "", &lines)
+
+	width := 0
+	for _, l := range lines {
+		if len(l[0]) > width {
+			width = len(l[0])
+		}
+	}
+	for _, l := range lines {
+		fmt.Fprintf(w, "%-*s %s\n", width+1, l[0]+":", l[1])
+	}
+}
+
+func flattenText(v reflect.Value, prefix string, lines *[][2]string) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	if s, ok := scalarString(v); ok {
+		*lines = append(*lines, [2]string{prefix, s})
+		return
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, f := range jsonFields(v) {
+			flattenText(f.value, join(f.name), lines)
+		}
+	case reflect.Map:
+		for _, k := range sortedMapKeys(v) {
+			flattenText(v.MapIndex(k), join(fmt.Sprint(k)), lines)
+		}
+	case reflect.Slice, reflect.Array:
+		parts := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s, ok := scalarString(v.Index(i))
+			if !ok {
+				b, _ := json.Marshal(v.Index(i).Interface())
+				s = string(b)
+			}
+			parts = append(parts, s)
+		}
+		*lines = append(*lines, [2]string{prefix, strings.Join(parts, ", ")})
+	}
+}
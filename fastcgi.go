@@ -0,0 +1,251 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Just enough of a FastCGI client to run scripts with php-fpm and the like,
+// one connection per request
+
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	// Records can't hold more than this
+	fcgiMaxContent = 65535
+	// Bodies without a length are read into memory to find it, up to this
+	fcgiMaxBufferedBody = 32 << 20
+)
+
+// The only request on each connection
+const fcgiRequestID = 1
+
+func writeFCGIRecord(w io.Writer, typ byte, content []byte) error {
+	header := [8]byte{fcgiVersion, typ}
+	binary.BigEndian.PutUint16(header[2:], fcgiRequestID)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// writeFCGIStream writes what's in r as records of typ, ending with an
+// empty one
+func writeFCGIStream(w io.Writer, typ byte, r io.Reader) error {
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := writeFCGIRecord(w, typ, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writeFCGIRecord(w, typ, nil)
+}
+
+func appendFCGILength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+func encodeFCGIParams(params map[string]string) []byte {
+	var b []byte
+	for k, v := range params {
+		b = appendFCGILength(b, len(k))
+		b = appendFCGILength(b, len(v))
+		b = append(b, k...)
+		b = append(b, v...)
+	}
+	return b
+}
+
+// fcgiReader reads a response's stdout, passing what's written to stderr
+// on to stderr a record at a time, so a chatty script isn't kept in memory
+type fcgiReader struct {
+	r      *bufio.Reader
+	buf    []byte
+	stderr io.Writer
+	done   bool
+}
+
+func (f *fcgiReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		var header [8]byte
+		if _, err := io.ReadFull(f.r, header[:]); err != nil {
+			// Hanging up before the end of the request cuts the response
+			// short, it isn't the end of it
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(header[4:]))
+		content := make([]byte, n+int(header[6]))
+		if _, err := io.ReadFull(f.r, content); err != nil {
+			return 0, err
+		}
+		switch header[1] {
+		case fcgiStdout:
+			f.buf = content[:n]
+		case fcgiStderr:
+			if n > 0 && f.stderr != nil {
+				f.stderr.Write(content[:n])
+			}
+		case fcgiEndRequest:
+			f.done = true
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+func (h *scriptHandler) serveFastCGI(w http.ResponseWriter, r *http.Request, script, pathInfo string) {
+	env := h.scriptEnv(r, script, pathInfo)
+
+	var body io.Reader = http.NoBody
+	if r.Body != nil {
+		body = r.Body
+	}
+	if r.ContentLength < 0 {
+		// FastCGI servers want to know how long the body is up front
+		b, err := io.ReadAll(io.LimitReader(r.Body, fcgiMaxBufferedBody+1))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if len(b) > fcgiMaxBufferedBody {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		env["CONTENT_LENGTH"] = strconv.Itoa(len(b))
+		body = bytes.NewReader(b)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(h.conf.Timeout))
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, h.network, h.address)
+	if err != nil {
+		log.Errorf("FastCGI for %s: %v", h.host, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// Give up on the script when the client does
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	sent := make(chan error, 1)
+	go func() {
+		bw := bufio.NewWriter(conn)
+		begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+		err := writeFCGIRecord(bw, fcgiBeginRequest, begin)
+		if err == nil {
+			err = writeFCGIStream(bw, fcgiParams, bytes.NewReader(encodeFCGIParams(env)))
+		}
+		if err == nil {
+			err = writeFCGIStream(bw, fcgiStdin, body)
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		sent <- err
+	}()
+
+	fr := &fcgiReader{r: bufio.NewReader(conn), stderr: scriptStderr{h.host + script}}
+	err = h.writeFCGIResponse(w, fr)
+	// The script can answer without reading all of the body
+	conn.Close()
+	<-sent
+	if err != nil {
+		log.Errorf("FastCGI for %s%s: %v", h.host, script, err)
+	}
+}
+
+// errFCGIHeaders is a response that went wrong before anything was sent
+var errFCGIHeaders = errors.New("bad response headers")
+
+// writeFCGIResponse sends on the CGI response read from fr
+func (h *scriptHandler) writeFCGIResponse(w http.ResponseWriter, fr *fcgiReader) error {
+	br := bufio.NewReader(fr)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return fmt.Errorf("%v: %v", errFCGIHeaders, err)
+	}
+
+	code := http.StatusOK
+	if status := header.Get("Status"); status != "" {
+		code, err = strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil || code < 100 || code > 999 {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return fmt.Errorf("%v: status %q", errFCGIHeaders, status)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		code = http.StatusFound
+	}
+
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(code)
+	_, err = io.Copy(w, br)
+	return err
+}
@@ -0,0 +1,355 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testFCGIRecord struct {
+	typ     byte
+	id      uint16
+	content []byte
+}
+
+func readTestFCGIRecord(r io.Reader) (testFCGIRecord, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return testFCGIRecord{}, err
+	}
+	content := make([]byte, int(binary.BigEndian.Uint16(header[4:]))+int(header[6]))
+	if _, err := io.ReadFull(r, content); err != nil {
+		return testFCGIRecord{}, err
+	}
+	return testFCGIRecord{header[1], binary.BigEndian.Uint16(header[2:]), content[:binary.BigEndian.Uint16(header[4:])]}, nil
+}
+
+// testFCGIRecordBytes is a record with padding, which we never send but
+// servers can
+func testFCGIRecordBytes(typ byte, content string, padding int) []byte {
+	b := []byte{fcgiVersion, typ, 0, fcgiRequestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(content)))
+	b = append(b, content...)
+	return append(b, make([]byte, padding)...)
+}
+
+func decodeTestFCGIParams(t *testing.T, b []byte) map[string]string {
+	length := func() int {
+		if len(b) == 0 {
+			t.Fatal("params cut short")
+		}
+		if b[0]&0x80 == 0 {
+			n := int(b[0])
+			b = b[1:]
+			return n
+		}
+		if len(b) < 4 {
+			t.Fatal("params cut short")
+		}
+		n := int(binary.BigEndian.Uint32(b) &^ (1 << 31))
+		b = b[4:]
+		return n
+	}
+
+	params := map[string]string{}
+	for len(b) > 0 {
+		kn, vn := length(), length()
+		if kn+vn > len(b) {
+			t.Fatal("params cut short")
+		}
+		params[string(b[:kn])] = string(b[kn : kn+vn])
+		b = b[kn+vn:]
+	}
+	return params
+}
+
+func TestWriteFCGIStream(t *testing.T) {
+	for _, n := range []int{0, 1, fcgiMaxContent, fcgiMaxContent + 1, 3*fcgiMaxContent + 7} {
+		body := bytes.Repeat([]byte("x"), n)
+		var out bytes.Buffer
+		if err := writeFCGIStream(&out, fcgiStdin, bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []byte
+		for {
+			rec, err := readTestFCGIRecord(&out)
+			if err != nil {
+				t.Fatalf("%d: %v", n, err)
+			}
+			if rec.typ != fcgiStdin || rec.id != fcgiRequestID {
+				t.Fatalf("%d: record is %d for request %d", n, rec.typ, rec.id)
+			}
+			if len(rec.content) > fcgiMaxContent {
+				t.Fatalf("%d: record holds %d", n, len(rec.content))
+			}
+			if len(rec.content) == 0 {
+				break
+			}
+			got = append(got, rec.content...)
+		}
+		if !bytes.Equal(got, body) || out.Len() != 0 {
+			t.Errorf("%d: got %d back with %d left over", n, len(got), out.Len())
+		}
+	}
+}
+
+func TestEncodeFCGIParams(t *testing.T) {
+	params := map[string]string{
+		"EMPTY":                          "",
+		"SHORT":                          "value",
+		strings.Repeat("K", 127):         strings.Repeat("v", 128),
+		"HTTP_COOKIE":                    strings.Repeat("c", 70000),
+		strings.Repeat("LONG_NAME_", 20): "x",
+	}
+	got := decodeTestFCGIParams(t, encodeFCGIParams(params))
+	if len(got) != len(params) {
+		t.Fatalf("got %d params, want %d", len(got), len(params))
+	}
+	for k, v := range params {
+		if got[k] != v {
+			t.Errorf("%.20s is %.20q, want %.20q", k, got[k], v)
+		}
+	}
+
+	if b := appendFCGILength(nil, 127); !bytes.Equal(b, []byte{127}) {
+		t.Errorf("127 is %x", b)
+	}
+	if b := appendFCGILength(nil, 128); !bytes.Equal(b, []byte{0x80, 0, 0, 128}) {
+		t.Errorf("128 is %x", b)
+	}
+}
+
+func TestFCGIReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]byte
+		stdout  string
+		stderr  string
+		err     bool
+	}{
+		{"stdout", [][]byte{testFCGIRecordBytes(fcgiStdout, "hello ", 0), testFCGIRecordBytes(fcgiStdout, "world", 0), testFCGIRecordBytes(fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0)}, "hello world", "", false},
+		{"padding", [][]byte{testFCGIRecordBytes(fcgiStdout, "abc", 5), testFCGIRecordBytes(fcgiStdout, "", 0), testFCGIRecordBytes(fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0)}, "abc", "", false},
+		{"stderr", [][]byte{testFCGIRecordBytes(fcgiStderr, "PHP Warning", 1), testFCGIRecordBytes(fcgiStdout, "ok", 0), testFCGIRecordBytes(fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0)}, "ok", "PHP Warning", false},
+		{"nothing after end", [][]byte{testFCGIRecordBytes(fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0), testFCGIRecordBytes(fcgiStdout, "late", 0)}, "", "", false},
+		{"no end", [][]byte{testFCGIRecordBytes(fcgiStdout, "cut", 0)}, "cut", "", true},
+		{"short record", [][]byte{testFCGIRecordBytes(fcgiStdout, "cut short", 0)[:12]}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			fr := &fcgiReader{r: bufio.NewReader(bytes.NewReader(bytes.Join(tt.records, nil))), stderr: &stderr}
+			b, err := io.ReadAll(fr)
+			if (err != nil) != tt.err {
+				t.Errorf("got %v", err)
+			}
+			if string(b) != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("got %q and %q on stderr", b, stderr.String())
+			}
+		})
+	}
+}
+
+// testStderr keeps each write to it separately
+type testStderr [][]byte
+
+func (s *testStderr) Write(b []byte) (int, error) {
+	*s = append(*s, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// A script writing lots to stderr has it passed on as it comes, rather than
+// kept until the end
+func TestFCGIReaderStderr(t *testing.T) {
+	var records []byte
+	for i := 0; i < 3; i++ {
+		records = append(records, testFCGIRecordBytes(fcgiStderr, strings.Repeat("x", fcgiMaxContent), 0)...)
+	}
+	records = append(records, testFCGIRecordBytes(fcgiStderr, "", 0)...)
+	records = append(records, testFCGIRecordBytes(fcgiStdout, "ok", 0)...)
+	records = append(records, testFCGIRecordBytes(fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0)...)
+
+	var stderr testStderr
+	fr := &fcgiReader{r: bufio.NewReader(bytes.NewReader(records)), stderr: &stderr}
+	p := make([]byte, 1)
+	if _, err := fr.Read(p); err != nil || string(p) != "o" {
+		t.Fatalf("read %q, %v", p, err)
+	}
+	if len(stderr) != 3 {
+		t.Fatalf("got %d writes to stderr, want 3", len(stderr))
+	}
+	for i, b := range stderr {
+		if len(b) != fcgiMaxContent {
+			t.Errorf("write %d is %d bytes", i+1, len(b))
+		}
+	}
+	if len(fr.buf) != 1 {
+		t.Errorf("%d bytes of stdout left, want 1", len(fr.buf))
+	}
+}
+
+func TestWriteFCGIResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdout   string
+		code     int
+		location string
+		body     string
+		err      bool
+	}{
+		{"no status", "Content-Type: text/html\r\n\r\nhi", 200, "", "hi", false},
+		{"status", "Status: 404 Not Found\r\nContent-Type: text/plain\r\n\r\ngone", 404, "", "gone", false},
+		{"bare newlines", "Status: 201\nContent-Type: text/plain\n\nmade", 201, "", "made", false},
+		{"location", "Location: /elsewhere\r\n\r\n", 302, "/elsewhere", "", false},
+		{"location with status", "Status: 301\r\nLocation: /moved\r\n\r\n", 301, "/moved", "", false},
+		{"bad status", "Status: fine\r\n\r\nhi", 502, "", "", true},
+		{"status out of range", "Status: 1000\r\n\r\nhi", 502, "", "", true},
+		{"no headers", "", 502, "", "", true},
+	}
+	h := &scriptHandler{host: "fcgi.test"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := testFCGIRecordBytes(fcgiStdout, tt.stdout, 0)
+			records = append(records, testFCGIRecordBytes(fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0)...)
+			fr := &fcgiReader{r: bufio.NewReader(bytes.NewReader(records))}
+
+			w := httptest.NewRecorder()
+			err := h.writeFCGIResponse(w, fr)
+			if (err != nil) != tt.err {
+				t.Errorf("got %v", err)
+			}
+			if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+				t.Errorf("got %d to %q", w.Code, w.Header().Get("Location"))
+			}
+			if w.Header().Get("Status") != "" {
+				t.Error("status was sent on as a header")
+			}
+			if !tt.err && w.Body.String() != tt.body {
+				t.Errorf("body is %q", w.Body.String())
+			}
+		})
+	}
+}
+
+// testFCGIServer answers a single request on l, echoing the params and the
+// body it was sent
+func testFCGIServer(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var params, stdin []byte
+	r := bufio.NewReader(conn)
+	for done := false; !done; {
+		rec, err := readTestFCGIRecord(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		switch rec.typ {
+		case fcgiBeginRequest:
+			if rec.content[1] != fcgiResponder {
+				t.Errorf("role is %d", rec.content[1])
+			}
+		case fcgiParams:
+			params = append(params, rec.content...)
+		case fcgiStdin:
+			stdin = append(stdin, rec.content...)
+			done = len(rec.content) == 0
+		}
+	}
+
+	env := decodeTestFCGIParams(t, params)
+	body := env["REQUEST_METHOD"] + " " + env["SCRIPT_FILENAME"] + " " + env["PATH_INFO"] + " " + env["CONTENT_LENGTH"] + " " + string(stdin)
+	w := bufio.NewWriter(conn)
+	w.Write(testFCGIRecordBytes(fcgiStderr, "a notice", 0))
+	w.Write(testFCGIRecordBytes(fcgiStdout, "Status: 201 Created\r\nX-Script: yes\r\n\r\n"+body, 3))
+	w.Write(testFCGIRecordBytes(fcgiEndRequest, "\x00\x00\x00\x00\x00\x00\x00\x00", 0))
+	w.Flush()
+}
+
+func TestServeFastCGI(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	h, err := newScriptHandler("fcgi.test", "fastcgi", &ScriptConfig{Address: l.Addr().String(), Root: "/srv/www"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body io.Reader
+		want string
+	}{
+		{"with a length", strings.NewReader("a=1"), "POST /srv/www/index.php /extra 3 a=1"},
+		// Wrapped so httptest doesn't work out the length for us
+		{"chunked", io.MultiReader(strings.NewReader("a=1&b=2")), "POST /srv/www/index.php /extra 7 a=1&b=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			go testFCGIServer(t, l)
+
+			r := httptest.NewRequest("POST", "http://fcgi.test/index.php/extra", tt.body)
+			w := httptest.NewRecorder()
+			h.serveFastCGI(w, r, "/index.php", "/extra")
+
+			if w.Code != http.StatusCreated || w.Header().Get("X-Script") != "yes" {
+				t.Errorf("got %d with %v", w.Code, w.Header())
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("got %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServeFastCGIDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	h, err := newScriptHandler("fcgi.test", "fastcgi", &ScriptConfig{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.serveFastCGI(w, httptest.NewRequest("GET", "http://fcgi.test/", nil), "/index.php", "")
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got %d", w.Code)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"github.com/go-playground/log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often to look for new database files, MaxMind updates them weekly so
+// there's no rush
+const geoIPReloadInterval = time.Minute
+
+// geoDB is an mmdb file which is reloaded whenever it's replaced on disk
+type geoDB struct {
+	path string
+
+	mu      sync.RWMutex
+	reader  *mmdbReader
+	modTime time.Time
+	size    int64
+}
+
+var (
+	geoCity *geoDB
+	geoASN  *geoDB
+)
+
+// load (re)reads the database if it has changed since we last read it
+func (g *geoDB) load() {
+	fi, err := os.Stat(g.path)
+	if err != nil {
+		g.mu.Lock()
+		if g.reader != nil && os.IsNotExist(err) {
+			log.Warn("GeoIP database " + g.path + " has gone away, keeping the one we have")
+		}
+		g.mu.Unlock()
+		return
+	}
+
+	g.mu.RLock()
+	unchanged := g.reader != nil && fi.ModTime().Equal(g.modTime) && fi.Size() == g.size
+	g.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	r, err := openMMDB(g.path)
+	if err != nil {
+		// Could be half way through being copied in, try again next time
+		log.Error(err)
+		return
+	}
+
+	g.mu.Lock()
+	g.reader = r
+	g.modTime = fi.ModTime()
+	g.size = fi.Size()
+	g.mu.Unlock()
+	log.Infof("Loaded GeoIP database %s (%s)", g.path, r.databaseType)
+}
+
+func (g *geoDB) lookup(ip net.IP) interface{} {
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	r := g.reader
+	g.mu.RUnlock()
+	if r == nil {
+		return nil
+	}
+
+	v, err := r.lookup(ip)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return v
+}
+
+// startGeoIP loads the databases that exist and watches for them being
+// replaced
+func startGeoIP() {
+	if *geoIPCity != "" {
+		geoCity = &geoDB{path: *geoIPCity}
+	}
+	if *geoIPASN != "" {
+		geoASN = &geoDB{path: *geoIPASN}
+	}
+
+	for _, g := range []*geoDB{geoCity, geoASN} {
+		if g == nil {
+			continue
+		}
+		g.load()
+		if g.reader == nil {
+			log.Info("No GeoIP database at " + g.path + ", will load it when it turns up")
+		}
+		go func(g *geoDB) {
+			for range time.Tick(geoIPReloadInterval) {
+				g.load()
+			}
+		}(g)
+	}
+}
+
+// geoInfo is what we know about where an ip is
+type geoInfo struct {
+	Country      string
+	CountryCode  string
+	Region       string
+	City         string
+	Latitude     float64
+	Longitude    float64
+	TimeZone     string
+	ASN          uint
+	Organization string
+}
+
+// geoLookup looks ip up in whichever databases are loaded, everything is
+// left empty when we don't know
+func geoLookup(ip string) geoInfo {
+	var info geoInfo
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return info
+	}
+
+	if rec := geoCity.lookup(parsed); rec != nil {
+		info.Country, _ = mmdbPath(rec, "country", "names", "en").(string)
+		info.CountryCode, _ = mmdbPath(rec, "country", "iso_code").(string)
+		info.Region, _ = mmdbPath(rec, "subdivisions", 0, "names", "en").(string)
+		info.City, _ = mmdbPath(rec, "city", "names", "en").(string)
+		info.Latitude, _ = mmdbPath(rec, "location", "latitude").(float64)
+		info.Longitude, _ = mmdbPath(rec, "location", "longitude").(float64)
+		info.TimeZone, _ = mmdbPath(rec, "location", "time_zone").(string)
+	}
+	if rec := geoASN.lookup(parsed); rec != nil {
+		info.ASN = uint(mmdbUint(mmdbPath(rec, "autonomous_system_number")))
+		info.Organization, _ = mmdbPath(rec, "autonomous_system_organization").(string)
+	}
+
+	return info
+}
@@ -21,7 +21,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/go-playground/log"
+	"github.com/gorilla/mux"
+	"html/template"
+	"mime"
+	"net"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -35,14 +47,448 @@ func GetIP(r *http.Request) string {
 	return ip
 }
 
-func ifcfgRootHandler(w http.ResponseWriter, r *http.Request) {
+// GetPort returns the remote port of the request
+func GetPort(r *http.Request) int {
+	_, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// ifcfgInfo is everything ifcfg can tell you about your request
+type ifcfgInfo struct {
+	XMLName        xml.Name     `json:"-" xml:"ifcfg"`
+	IP             string       `json:"ip" xml:"ip"`
+	Hostname       string       `json:"hostname,omitempty" xml:"hostname,omitempty"`
+	IPVersion      int          `json:"ip_version" xml:"ip_version"`
+	Port           int          `json:"port" xml:"port"`
+	Protocol       string       `json:"protocol" xml:"protocol"`
+	TLSVersion     string       `json:"tls_version,omitempty" xml:"tls_version,omitempty"`
+	UserAgent      string       `json:"user_agent" xml:"user_agent"`
+	AcceptLanguage string       `json:"accept_language,omitempty" xml:"accept_language,omitempty"`
+	Country        string       `json:"country,omitempty" xml:"country,omitempty"`
+	CountryCode    string       `json:"country_code,omitempty" xml:"country_code,omitempty"`
+	Region         string       `json:"region,omitempty" xml:"region,omitempty"`
+	City           string       `json:"city,omitempty" xml:"city,omitempty"`
+	Latitude       float64      `json:"latitude,omitempty" xml:"latitude,omitempty"`
+	Longitude      float64      `json:"longitude,omitempty" xml:"longitude,omitempty"`
+	TimeZone       string       `json:"time_zone,omitempty" xml:"time_zone,omitempty"`
+	ASN            uint         `json:"asn,omitempty" xml:"asn,omitempty"`
+	Organization   string       `json:"organization,omitempty" xml:"organization,omitempty"`
+	Headers        ifcfgHeaders `json:"headers" xml:"headers"`
+}
+
+// ifcfgHeaders are the request headers, with repeated headers joined by commas
+type ifcfgHeaders map[string]string
+
+// MarshalXML writes the headers as <header name="...">value</header>, xml
+// can't do maps by itself
+func (h ifcfgHeaders) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		el := struct {
+			XMLName xml.Name `xml:"header"`
+			Name    string   `xml:"name,attr"`
+			Value   string   `xml:",chardata"`
+		}{Name: name, Value: h[name]}
+		if err := e.Encode(el); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func requestHeaders(r *http.Request) ifcfgHeaders {
+	h := ifcfgHeaders{}
+	for name, values := range r.Header {
+		h[name] = strings.Join(values, ", ")
+	}
+	// net/http takes Host out of the headers
+	h["Host"] = r.Host
+	return h
+}
+
+func ipVersion(ip string) int {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0
+	}
+	if parsed.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+// newIfcfgInfo is what we know about r. The hostname is only looked up
+// when withHostname is set, responses without it shouldn't wait on DNS
+func newIfcfgInfo(r *http.Request, withHostname bool) *ifcfgInfo {
 	ip := GetIP(r)
+	geo := geoLookup(ip)
+	info := &ifcfgInfo{
+		IP:             ip,
+		IPVersion:      ipVersion(ip),
+		Port:           GetPort(r),
+		Protocol:       r.Proto,
+		UserAgent:      r.UserAgent(),
+		AcceptLanguage: r.Header.Get("Accept-Language"),
+		Country:        geo.Country,
+		CountryCode:    geo.CountryCode,
+		Region:         geo.Region,
+		City:           geo.City,
+		Latitude:       geo.Latitude,
+		Longitude:      geo.Longitude,
+		TimeZone:       geo.TimeZone,
+		ASN:            geo.ASN,
+		Organization:   geo.Organization,
+		Headers:        requestHeaders(r),
+	}
+	if withHostname {
+		info.Hostname = lookupHostname(ip)
+	}
+	if r.TLS != nil {
+		if v, ok := tlsVersionNames[r.TLS.Version]; ok {
+			info.TLSVersion = "TLS " + v
+		}
+	}
+	return info
+}
+
+var ifcfgMediaTypes = map[string]string{
+	"application/json":   "json",
+	"application/xml":    "xml",
+	"text/xml":           "xml",
+	"application/yaml":   "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml":          "yaml",
+	"text/x-yaml":        "yaml",
+	"text/plain":         "text",
+}
+
+var ifcfgContentTypes = map[string]string{
+	"json": "application/json",
+	"xml":  "application/xml; charset=utf-8",
+	"yaml": "application/yaml; charset=utf-8",
+	"text": "text/plain; charset=utf-8",
+}
+
+// ifcfgFormat picks the format the client asked for, going by the
+// /json, /xml or /yaml path, then ?format=, then the Accept header. It's
+// empty when they didn't ask for anything we have in particular
+func ifcfgFormat(r *http.Request) string {
+	if f := mux.Vars(r)["format"]; f != "" {
+		return f
+	}
+	if f := strings.ToLower(r.URL.Query().Get("format")); ifcfgContentTypes[f] != "" {
+		return f
+	}
+
+	// Wildcards don't count, browsers and curl send them and we don't want
+	// to guess on their behalf. Nor does anything the client likes no more
+	// than html, browsers ask for application/xml too
+	best, bestQ, htmlQ := "", 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if mt == "text/html" && q > htmlQ {
+			htmlQ = q
+		}
+		if f := ifcfgMediaTypes[mt]; f != "" && q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	if htmlQ >= bestQ {
+		return ""
+	}
+	return best
+}
+
+// ifcfgRespond writes v in format, or text when format is "text", and
+// logs the request
+func ifcfgRespond(w http.ResponseWriter, r *http.Request, format string, v interface{}, text string) {
+	ifcfgRespondCode(w, r, http.StatusOK, format, v, text)
+}
+
+// ifcfgRespondCode is ifcfgRespond with a status code other than 200
+func ifcfgRespondCode(w http.ResponseWriter, r *http.Request, code int, format string, v interface{}, text string) {
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	case "xml":
+		buf.WriteString(xml.Header)
+		enc := xml.NewEncoder(&buf)
+		enc.Indent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			log.Error(err)
+		}
+		buf.WriteString("\n")
+	case "yaml":
+		writeYAML(&buf, v)
+	default:
+		format = "text"
+		buf.WriteString(text)
+	}
+
 	w.Header().Set("Server", "ifcfg.org")
+	w.Header().Set("Content-Type", ifcfgContentTypes[format])
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(code)
+	n, _ := buf.WriteTo(w)
+	go logRequest(w, r, n, code)
+}
 
-	if strings.Contains(r.Header.Get("User-Agent"), "curl") || r.Header.Get("Accept") == "text/plain" {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(ip + "\n"))
+// setupIfcfgRoutes adds the ifcfg endpoints to r. family is 4 or 6 for
+// hosts that only answer over that version of IP, 0 for either
+func setupIfcfgRoutes(r *mux.Router, family int) {
+	r.Use(ifcfgCORS)
+	if family != 0 {
+		r.Use(requireFamily(family))
+	} else {
+		r.Path("/dualstack").HandlerFunc(ifcfgDualStackHandler)
+	}
+	r.Path("/{format:json|xml|yaml}").HandlerFunc(ifcfgRootHandler)
+	r.Path("/all").HandlerFunc(ifcfgAllHandler)
+	r.Path("/ip").HandlerFunc(ifcfgFieldHandler("ip"))
+	r.Path("/host").HandlerFunc(ifcfgFieldHandler("hostname"))
+	r.Path("/port").HandlerFunc(ifcfgFieldHandler("port"))
+	r.Path("/port/{port:[0-9]+}").HandlerFunc(ifcfgPortCheckHandler)
+	r.Path("/ua").HandlerFunc(ifcfgFieldHandler("user_agent"))
+	r.Path("/headers").HandlerFunc(ifcfgFieldHandler("headers"))
+	r.Path("/echo").HandlerFunc(ifcfgEchoHandler)
+	r.Path("/update").HandlerFunc(dyndnsUpdateHandler)
+	r.Path("/nic/update").HandlerFunc(dyndnsUpdateHandler)
+	r.Path("/watch").Handler(withWriteTimeout(0, http.HandlerFunc(ifcfgWatchHandler)))
+	r.Path("/country").HandlerFunc(ifcfgFieldHandler("country_code"))
+	r.Path("/city").HandlerFunc(ifcfgFieldHandler("city"))
+	r.Path("/asn").HandlerFunc(ifcfgFieldHandler("asn"))
+	r.Path("/org").HandlerFunc(ifcfgFieldHandler("organization"))
+	r.PathPrefix("/").HandlerFunc(ifcfgRootHandler)
+}
+
+func ifcfgRootHandler(w http.ResponseWriter, r *http.Request) {
+	format := ifcfgFormat(r)
+	if format != "" && format != "text" {
+		ifcfgRespond(w, r, format, newIfcfgInfo(r, true), "")
+		return
+	}
+
+	ip := GetIP(r)
+	if format == "text" || strings.Contains(r.Header.Get("User-Agent"), "curl") {
+		ifcfgRespond(w, r, "text", nil, ip+"\n")
 		return
 	}
-	w.Write([]byte(ip))
+
+	w.Header().Set("Server", "ifcfg.org")
+	n, _ := w.Write([]byte(ip))
+	go logRequest(w, r, int64(n), http.StatusOK)
+}
+
+// ifcfgAllHandler is everything, as "key: value" text unless asked otherwise
+func ifcfgAllHandler(w http.ResponseWriter, r *http.Request) {
+	info := newIfcfgInfo(r, true)
+	var buf bytes.Buffer
+	writeText(&buf, info)
+	ifcfgRespond(w, r, ifcfgFormat(r), info, buf.String())
+}
+
+// ifcfgFieldHandler responds with just the json field name from ifcfgInfo,
+// on its own in text, or as {"name": value} in the other formats
+func ifcfgFieldHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := newIfcfgInfo(r, name == "hostname")
+
+		var value interface{}
+		var text string
+		switch name {
+		case "headers":
+			var buf bytes.Buffer
+			names := make([]string, 0, len(info.Headers))
+			for n := range info.Headers {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			for _, n := range names {
+				buf.WriteString(n + ": " + info.Headers[n] + "\n")
+			}
+			value, text = info.Headers, buf.String()
+		default:
+			// The geo fields are left out when we don't know them, which
+			// comes out as an empty response
+			for _, f := range jsonFields(reflect.ValueOf(*info)) {
+				if f.name == name {
+					value = f.value.Interface()
+					s, _ := scalarString(f.value)
+					text = s + "\n"
+				}
+			}
+			if value == nil {
+				text = ""
+			}
+		}
+
+		format := ifcfgFormat(r)
+		if format == "xml" {
+			// A map won't do for xml, it needs a named root element
+			ifcfgRespond(w, r, format, ifcfgField{XMLName: xml.Name{Local: name}, Value: value}, text)
+			return
+		}
+		ifcfgRespond(w, r, format, map[string]interface{}{name: value}, text)
+	}
+}
+
+// ifcfgField is a single field of ifcfgInfo, for xml
+type ifcfgField struct {
+	XMLName xml.Name
+	Value   interface{}
+}
+
+func (f ifcfgField) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(f.Value, xml.StartElement{Name: f.XMLName})
+}
+
+// ifcfgCORS lets any page read ifcfg responses, they're only ever about
+// the client asking
+func ifcfgCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ifcfgError is the response when ifcfg won't answer a request
+type ifcfgError struct {
+	XMLName   xml.Name `json:"-" xml:"error"`
+	Error     string   `json:"error" xml:"message"`
+	IP        string   `json:"ip" xml:"ip"`
+	IPVersion int      `json:"ip_version" xml:"ip_version"`
+}
+
+// requireFamily turns away connections which aren't over IPv4 or IPv6, as
+// family says. A stray AAAA record for v4.ifcfg.org would otherwise have it
+// happily report a v6 address
+func requireFamily(family int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := GetIP(r)
+			version := ipVersion(ip)
+			if version == family {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			msg := fmt.Sprintf("%s only answers over IPv%d, but this connection is over IPv%d", r.Host, family, version)
+			format := ifcfgFormat(r)
+			if format == "" {
+				format = "text"
+			}
+			ifcfgRespondCode(w, r, http.StatusMisdirectedRequest, format, ifcfgError{Error: msg, IP: ip, IPVersion: version}, msg+"\n")
+		})
+	}
+}
+
+func ifcfgDualStackHandler(w http.ResponseWriter, r *http.Request) {
+	// The page fetches from the v4 and v6 hosts of whichever ifcfg.org
+	// it's on, so it works on a dev server too
+	base := r.Host
+	if r.TLS != nil {
+		base = "https://" + base
+	} else {
+		base = "http://" + base
+	}
+
+	var buf bytes.Buffer
+	if err := ifcfgDualStackPage.Execute(&buf, base); err != nil {
+		log.Error(err)
+	}
+	w.Header().Set("Server", "ifcfg.org")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	n, _ := buf.WriteTo(w)
+	go logRequest(w, r, n, http.StatusOK)
 }
+
+var ifcfgDualStackPage = template.Must(template.New("dualstack").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ifcfg.org - IPv4 and IPv6</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+dt { font-weight: bold; margin-top: 1em; }
+dd { font-family: monospace; font-size: 1.4em; margin: 0.2em 0; }
+.none { color: #999; }
+</style>
+</head>
+<body>
+<h1>Your addresses</h1>
+<dl>
+<dt>IPv4</dt><dd id="v4">Checking...</dd>
+<dt>IPv6</dt><dd id="v6">Checking...</dd>
+</dl>
+<p id="summary"></p>
+<script>
+var base = {{.}};
+var hosts = {v4: base.replace("://", "://v4."), v6: base.replace("://", "://v6.")};
+var found = {};
+
+function check(family) {
+	var el = document.getElementById(family);
+	var ctrl = new AbortController();
+	var timer = setTimeout(function() { ctrl.abort(); }, 5000);
+	return fetch(hosts[family] + "/json", {signal: ctrl.signal, headers: {"Accept": "application/json"}})
+		.then(function(res) { return res.json(); })
+		.then(function(info) {
+			if (info.error) {
+				throw new Error(info.error);
+			}
+			el.textContent = info.ip;
+			found[family] = true;
+		})
+		.catch(function() {
+			el.textContent = "Not available";
+			el.className = "none";
+		})
+		.then(function() { clearTimeout(timer); });
+}
+
+Promise.all([check("v4"), check("v6")]).then(function() {
+	var summary = "Neither worked, you don't seem to be connected.";
+	if (found.v4 && found.v6) {
+		summary = "You're dual stack, with both IPv4 and IPv6.";
+	} else if (found.v4) {
+		summary = "You only have IPv4.";
+	} else if (found.v6) {
+		summary = "You only have IPv6.";
+	}
+	document.getElementById("summary").textContent = summary;
+});
+</script>
+</body>
+</html>
+`))
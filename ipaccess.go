@@ -0,0 +1,321 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessRules let some IPs in and keep others out, for every host, one
+// host or a site route. Every level a request goes through has to let it
+// in, and a deny beats an allow
+type AccessRules struct {
+	// Addresses and CIDRs let in, when there are any nobody else is
+	Allow []string `json:"allow,omitempty"`
+	// Addresses and CIDRs kept out
+	Deny []string `json:"deny,omitempty"`
+	// Files of addresses and CIDRs, one a line, reread when they change
+	AllowFiles []string `json:"allow_files,omitempty"`
+	DenyFiles  []string `json:"deny_files,omitempty"`
+	// The status code for whoever's kept out, 403 by default
+	Status int `json:"status,omitempty"`
+
+	allow []*ipList
+	deny  []*ipList
+}
+
+// ipList is a list of prefixes from the config or a file
+type ipList struct {
+	file *watchedFile
+
+	mu       sync.RWMutex
+	prefixes []netip.Prefix
+}
+
+func (a *AccessRules) compile() error {
+	if a.Status == 0 {
+		a.Status = http.StatusForbidden
+	}
+	if a.Status < 400 || a.Status > 599 {
+		return fmt.Errorf("status %d isn't an error", a.Status)
+	}
+
+	a.allow, a.deny = nil, nil
+	for _, set := range []struct {
+		lists        *[]*ipList
+		inline, file []string
+	}{{&a.allow, a.Allow, a.AllowFiles}, {&a.deny, a.Deny, a.DenyFiles}} {
+		if len(set.inline) > 0 {
+			l := &ipList{}
+			for _, s := range set.inline {
+				p, err := parsePrefix(s)
+				if err != nil {
+					return err
+				}
+				l.prefixes = append(l.prefixes, p)
+			}
+			*set.lists = append(*set.lists, l)
+		}
+		for _, path := range set.file {
+			l := &ipList{file: &watchedFile{path: path}}
+			l.file.changed()
+			if err := l.load(); err != nil {
+				return err
+			}
+			*set.lists = append(*set.lists, l)
+		}
+	}
+	return nil
+}
+
+// parsePrefix reads a CIDR, or an address as a prefix of just itself
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	// Addresses are unmapped before they're matched, so ::ffff:10.0.0.0/104
+	// has to be 10.0.0.0/8
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// load rereads the file, skipping lines that aren't addresses
+func (l *ipList) load() error {
+	f, err := os.Open(l.file.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		p, err := parsePrefix(line)
+		if err != nil {
+			log.Warnf("%s line %d: %v, skipping it", l.file.path, n, err)
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.prefixes = prefixes
+	l.mu.Unlock()
+	return nil
+}
+
+// match returns the prefix containing addr, if there is one
+func (l *ipList) match(addr netip.Addr) (netip.Prefix, bool) {
+	if l.file != nil && l.file.changed() {
+		if err := l.load(); err != nil {
+			log.Error(err)
+		} else {
+			log.Infof("Reloaded %s", l.file.path)
+		}
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, p := range l.prefixes {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// check says why addr is kept out, or "" when it isn't. level is where the
+// rules came from, for the log
+func (a *AccessRules) check(addr netip.Addr, level string) string {
+	for _, l := range a.deny {
+		if p, ok := l.match(addr); ok {
+			rule := "ip:" + level + ":deny:" + p.String()
+			if l.file != nil {
+				rule += "@" + url.PathEscape(l.file.path)
+			}
+			return rule
+		}
+	}
+	if len(a.allow) == 0 {
+		return ""
+	}
+	for _, l := range a.allow {
+		if _, ok := l.match(addr); ok {
+			return ""
+		}
+	}
+	return "ip:" + level + ":not-allowed"
+}
+
+// compileHostAccess checks the rules for each host, lowercasing the hosts
+func compileHostAccess(hosts map[string]*AccessRules) (map[string]*AccessRules, error) {
+	lower := make(map[string]*AccessRules, len(hosts))
+	for host, rules := range hosts {
+		host = strings.ToLower(host)
+		if !validDomain(host) {
+			return nil, fmt.Errorf("host_access %q isn't a valid host", host)
+		}
+		if err := rules.compile(); err != nil {
+			return nil, fmt.Errorf("host_access %s: %v", host, err)
+		}
+		lower[host] = rules
+	}
+	return lower, nil
+}
+
+// accessMiddleware turns away requests from addresses kept out by the
+// global, host or site route rules
+func accessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := config()
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		var route *AccessRules
+		if rt := findSiteRoute(host, r.URL.Path); rt != nil {
+			route = rt.Access
+		}
+		if c.Access == nil && c.HostAccess[host] == nil && route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		levels := []struct {
+			name  string
+			rules *AccessRules
+		}{{"global", c.Access}, {"host", c.HostAccess[host]}, {"route", route}}
+
+		addr, err := netip.ParseAddr(clientIP(r))
+		if err != nil {
+			// Requests over a unix socket have no address, anything else
+			// without one we can't vouch for
+			if l, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && l.Network() == "unix" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, level := range levels {
+				if level.rules != nil {
+					log.Warnf("Turned away %q from %s%s, it's not an address", clientIP(r), host, r.URL.Path)
+					denyAccess(w, r, level.rules.Status, "ip:"+level.name+":bad-address")
+					return
+				}
+			}
+		}
+		addr = addr.Unmap()
+
+		for _, level := range levels {
+			if level.rules == nil {
+				continue
+			}
+			if rule := level.rules.check(addr, level.name); rule != "" {
+				log.Debugf("Turned away %s from %s%s by %s", addr, host, r.URL.Path, rule)
+				denyAccess(w, r, level.rules.Status, rule)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// denyAccess answers r with status, logging the rule that turned it away
+func denyAccess(w http.ResponseWriter, r *http.Request, status int, rule string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	n, _ := io.WriteString(w, http.StatusText(status)+"\n")
+	go logRequest(w, withAuthIdentity(r, rule), int64(n), status)
+}
+
+// How often to look at a watched file for changes
+const fileCheckInterval = 2 * time.Second
+
+// watchedFile notices when a file we've read is changed
+type watchedFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	checked time.Time
+	missing bool
+}
+
+// changed says whether the file is different since the last time we asked,
+// looking at most every fileCheckInterval. A file that's gone hasn't
+// changed, we keep what we read from it
+func (f *watchedFile) changed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) < fileCheckInterval {
+		return false
+	}
+	f.checked = time.Now()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		if !f.missing {
+			log.Warnf("Can't read %s, keeping what we had from it: %v", f.path, err)
+		}
+		f.missing = true
+		return false
+	}
+	f.missing = false
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return false
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return true
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"192.0.2.77/24", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::1/64", "2001:db8::/64"},
+		{"::ffff:192.0.2.1", "192.0.2.1/32"},
+		{"::ffff:10.1.2.3/104", "10.0.0.0/8"},
+		{"nonsense", ""},
+		{"192.0.2.0/33", ""},
+	}
+	for _, tt := range tests {
+		p, err := parsePrefix(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parsePrefix(%q) = %s, want an error", tt.in, p)
+			}
+			continue
+		}
+		if err != nil || p.String() != tt.want {
+			t.Errorf("parsePrefix(%q) = %s, %v, want %s", tt.in, p, err, tt.want)
+		}
+	}
+}
+
+func TestAccessRulesCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   AccessRules
+		status  int
+		wantErr bool
+	}{
+		{"default status", AccessRules{Deny: []string{"192.0.2.1"}}, http.StatusForbidden, false},
+		{"custom status", AccessRules{Deny: []string{"192.0.2.1"}, Status: http.StatusNotFound}, http.StatusNotFound, false},
+		{"not an error", AccessRules{Status: http.StatusFound}, 0, true},
+		{"too big", AccessRules{Status: 600}, 0, true},
+		{"bad address", AccessRules{Allow: []string{"192.0.2.300"}}, 0, true},
+		{"missing file", AccessRules{DenyFiles: []string{"missing.txt"}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.compile()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("compiled, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rules.Status != tt.status {
+				t.Errorf("status %d, want %d", tt.rules.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestAccessRulesCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules AccessRules
+		addr  string
+		want  string
+	}{
+		{"no rules", AccessRules{}, "192.0.2.1", ""},
+		{"denied", AccessRules{Deny: []string{"192.0.2.0/24"}}, "192.0.2.1", "ip:host:deny:192.0.2.0/24"},
+		{"not denied", AccessRules{Deny: []string{"192.0.2.0/24"}}, "198.51.100.1", ""},
+		{"allowed", AccessRules{Allow: []string{"192.0.2.0/24"}}, "192.0.2.1", ""},
+		{"not allowed", AccessRules{Allow: []string{"192.0.2.0/24"}}, "198.51.100.1", "ip:host:not-allowed"},
+		{"deny beats allow", AccessRules{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.1"}}, "192.0.2.1", "ip:host:deny:192.0.2.1/32"},
+		{"allowed next to a deny", AccessRules{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.1"}}, "192.0.2.2", ""},
+		{"v6", AccessRules{Deny: []string{"2001:db8::/32"}}, "2001:db8:1::1", "ip:host:deny:2001:db8::/32"},
+		{"v4 rules leave v6 alone", AccessRules{Deny: []string{"0.0.0.0/0"}}, "2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rules.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.rules.check(netip.MustParseAddr(tt.addr), "host"); got != tt.want {
+				t.Errorf("check(%s) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessRulesFiles(t *testing.T) {
+	dir := t.TempDir()
+	allow := filepath.Join(dir, "allow.txt")
+	deny := filepath.Join(dir, "deny.txt")
+	if err := os.WriteFile(allow, []byte("# the office\n192.0.2.0/24\nnot an address\n2001:db8::/32 # and its v6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(deny, []byte("192.0.2.66\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := &AccessRules{AllowFiles: []string{allow}, DenyFiles: []string{deny}}
+	if err := rules.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr, want string
+	}{
+		{"192.0.2.1", ""},
+		{"2001:db8::1", ""},
+		{"192.0.2.66", "ip:global:deny:192.0.2.66/32@" + url.PathEscape(deny)},
+		{"198.51.100.1", "ip:global:not-allowed"},
+	}
+	for _, tt := range tests {
+		if got := rules.check(netip.MustParseAddr(tt.addr), "global"); got != tt.want {
+			t.Errorf("check(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+
+	// Changing the file takes effect without a reload, the next time it's
+	// looked at
+	if err := os.WriteFile(deny, []byte("198.51.100.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(deny, future, future)
+	rules.deny[0].file.mu.Lock()
+	rules.deny[0].file.checked = time.Time{}
+	rules.deny[0].file.mu.Unlock()
+	if got := rules.check(netip.MustParseAddr("192.0.2.66"), "global"); got != "" {
+		t.Errorf("after the change 192.0.2.66 got %q, want it let in", got)
+	}
+	if got := rules.check(netip.MustParseAddr("198.51.100.1"), "global"); got != "ip:global:deny:198.51.100.0/24@"+url.PathEscape(deny) {
+		t.Errorf("after the change 198.51.100.1 got %q, want it denied", got)
+	}
+}
+
+func TestAccessMiddleware(t *testing.T) {
+	c := &Config{
+		Access: &AccessRules{Deny: []string{"203.0.113.0/24"}},
+		HostAccess: map[string]*AccessRules{
+			"Example.com":      {Allow: []string{"192.0.2.0/24", "198.51.100.0/24"}, Status: http.StatusNotFound},
+			"open.example.com": {Deny: []string{"198.51.100.1"}},
+		},
+		Sites: map[string][]*SiteRoute{
+			"example.com": {
+				{Path: "/private", Access: &AccessRules{Allow: []string{"192.0.2.1"}}},
+			},
+			"nohost.example.com": {
+				{Path: "/private", Access: &AccessRules{Deny: []string{"192.0.2.0/24"}, Status: http.StatusUnauthorized}},
+			},
+		},
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, c)
+	h := accessMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		host   string
+		path   string
+		remote string
+		xrip   string
+		unix   bool
+		want   int
+	}{
+		{"global deny", "other.com", "/", "203.0.113.1:1234", "", false, http.StatusForbidden},
+		{"no rules", "other.com", "/", "192.0.2.1:1234", "", false, http.StatusNoContent},
+		{"global deny beats host allow", "example.com", "/", "203.0.113.1:1234", "", false, http.StatusForbidden},
+		{"host allow", "example.com:443", "/", "192.0.2.2:1234", "", false, http.StatusNoContent},
+		{"host not allowed", "EXAMPLE.com", "/", "10.0.0.1:1234", "", false, http.StatusNotFound},
+		{"host deny", "open.example.com", "/", "198.51.100.1:1234", "", false, http.StatusForbidden},
+		{"route allow", "example.com", "/private/x", "192.0.2.1:1234", "", false, http.StatusNoContent},
+		{"host allows but route doesn't", "example.com", "/private", "192.0.2.2:1234", "", false, http.StatusForbidden},
+		{"route only applies under its path", "example.com", "/privateer", "192.0.2.2:1234", "", false, http.StatusNoContent},
+		{"route can't let in who the host keeps out", "example.com", "/private", "10.0.0.1:1234", "", false, http.StatusNotFound},
+		{"route deny without host rules", "nohost.example.com", "/private", "192.0.2.1:1234", "", false, http.StatusUnauthorized},
+		{"mapped v4", "example.com", "/", "[::ffff:192.0.2.2]:1234", "", false, http.StatusNoContent},
+		{"behind a local proxy", "example.com", "/", "127.0.0.1:1234", "192.0.2.2", false, http.StatusNoContent},
+		{"bad address", "example.com", "/", "127.0.0.1:1234", "not an address", false, http.StatusForbidden},
+		{"bad address takes the first level's status", "nohost.example.com", "/private", "127.0.0.1:1234", "bogus", false, http.StatusForbidden},
+		{"bad address over a unix socket", "example.com", "/", "@", "", true, http.StatusNoContent},
+		{"bad address over tcp", "example.com", "/", "@", "", false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+			r.RemoteAddr = tt.remote
+			if tt.xrip != "" {
+				r.Header.Set("X-Real-IP", tt.xrip)
+			}
+			var local net.Addr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}
+			if tt.unix {
+				local = &net.UnixAddr{Name: "henry.sites.sock", Net: "unix"}
+			}
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+			if w.Code != http.StatusNoContent && w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control %q on a denial", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
@@ -0,0 +1,548 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logDir        = ".logs"
+	logTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// Matches the line written by logRequest:
+// remote_addr user [local_time] "method host path query protocol" response_code bytes_written "referer" "user_agent"
+var logLineRe = regexp.MustCompile(`^(\S+) (\S+) \[([^\]]+)\] "(\S+) (\S*) (.*) (\S*) (\S+)" (-?\d+) (-?\d+) "(.*?)" "(.*?)"(?: "([A-Z]{2}|-)" "(AS\d+|-)")?$`)
+
+type logEntry struct {
+	IP        string    `json:"ip"`
+	User      string    `json:"user,omitempty"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	ASN       string    `json:"asn,omitempty"`
+}
+
+func parseLogLine(line string) (*logEntry, error) {
+	m := logLineRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, errors.New("unrecognised log line")
+	}
+
+	t, err := time.Parse(logTimeFormat, m[3])
+	if err != nil {
+		return nil, err
+	}
+	status, err := strconv.Atoi(m[9])
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := strconv.ParseInt(m[10], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &logEntry{
+		IP:        m[1],
+		Time:      t,
+		Method:    m[4],
+		Host:      m[5],
+		Path:      m[6],
+		Query:     m[7],
+		Proto:     m[8],
+		Status:    status,
+		Bytes:     bytes,
+		Referer:   m[11],
+		UserAgent: m[12],
+	}
+	if m[2] != "-" {
+		e.User = m[2]
+	}
+	if m[13] != "-" {
+		e.Country = m[13]
+	}
+	if m[14] != "-" {
+		e.ASN = m[14]
+	}
+	return e, nil
+}
+
+// logFilter decides which access log lines we care about, the zero value
+// matches everything
+type logFilter struct {
+	Host      string
+	StatusMin int
+	StatusMax int
+	Nets      []*net.IPNet
+	PathGlob  string
+	Since     time.Time
+	Until     time.Time
+}
+
+// newLogFilter builds a filter from the same strings taken by the logs
+// command and the logs api, empty strings don't filter on anything
+//
+// status can be a code (404), a class (4xx) or a range (400-499), ips is a
+// comma separated list of addresses or CIDRs, since and until can be either
+// a duration before now (1h30m) or a time in RFC3339 or access log format
+func newLogFilter(host, status, ips, pathGlob, since, until string) (*logFilter, error) {
+	f := &logFilter{
+		Host:     strings.ToLower(host),
+		PathGlob: pathGlob,
+	}
+	if f.Host != "" && !logHostRe.MatchString(f.Host) {
+		return nil, fmt.Errorf("%q isn't a host", host)
+	}
+
+	var err error
+	if f.StatusMin, f.StatusMax, err = parseStatusRange(status); err != nil {
+		return nil, err
+	}
+
+	for _, s := range strings.Split(ips, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		f.Nets = append(f.Nets, n)
+	}
+
+	if pathGlob != "" {
+		if _, err := path.Match(pathGlob, "/"); err != nil {
+			return nil, fmt.Errorf("bad path glob %q: %v", pathGlob, err)
+		}
+	}
+
+	if f.Since, err = parseLogTime(since); err != nil {
+		return nil, err
+	}
+	if f.Until, err = parseLogTime(until); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func parseStatusRange(s string) (int, int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, 0, nil
+	}
+
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad status %q", s)
+		}
+		return class * 100, class*100 + 99, nil
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad status %q", s)
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("bad status %q", s)
+		}
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("bad status %q", s)
+	}
+	return min, max, nil
+}
+
+func parseLogTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, logTimeFormat, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
+}
+
+// filtering reports whether the filter would drop anything at all
+func (f *logFilter) filtering() bool {
+	return f.Host != "" || f.StatusMax != 0 || len(f.Nets) > 0 || f.PathGlob != "" || !f.Since.IsZero() || !f.Until.IsZero()
+}
+
+func (f *logFilter) match(e *logEntry) bool {
+	if f.Host != "" && strings.ToLower(e.Host) != f.Host {
+		return false
+	}
+	if f.StatusMax != 0 && (e.Status < f.StatusMin || e.Status > f.StatusMax) {
+		return false
+	}
+	if len(f.Nets) > 0 {
+		ip := net.ParseIP(e.IP)
+		found := false
+		for _, n := range f.Nets {
+			if ip != nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.PathGlob != "" {
+		if ok, _ := path.Match(f.PathGlob, e.Path); !ok {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// logHostRe is what a host has to look like to have a log of its own, it
+// keeps whatever's asked for from being a path or a glob
+var logHostRe = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// logFiles returns the access log for host (or the combined log when host is
+// empty) along with any rotated copies of it, oldest first
+func logFiles(host string) ([]string, string, error) {
+	if host != "" && !logHostRe.MatchString(strings.ToLower(host)) {
+		return nil, "", fmt.Errorf("%q isn't a host", host)
+	}
+	current := filepath.Join(logDir, strings.ToLower(host)+".access.log")
+	files, err := filepath.Glob(current + "*")
+	if err != nil {
+		return nil, "", err
+	}
+
+	type logFile struct {
+		name string
+		mod  time.Time
+	}
+	var rotated []logFile
+	for _, name := range files {
+		if name == current {
+			continue
+		}
+		inf, err := os.Stat(name)
+		if err != nil || inf.IsDir() {
+			continue
+		}
+		rotated = append(rotated, logFile{name, inf.ModTime()})
+	}
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].mod.Before(rotated[j].mod) })
+
+	names := make([]string, 0, len(rotated)+1)
+	for _, f := range rotated {
+		names = append(names, f.name)
+	}
+	if _, err := os.Stat(current); err == nil {
+		names = append(names, current)
+	}
+	return names, current, nil
+}
+
+type logQuery struct {
+	Filter *logFilter
+	// Only the last Limit matching lines from before we started, 0 for all
+	Limit  int
+	Follow bool
+	// Done stops following when closed
+	Done <-chan struct{}
+}
+
+// run calls emit with every line matching the query, and then if following,
+// every new matching line written until q.Done is closed. entry is nil when
+// the line couldn't be parsed, which only happens when nothing is filtered
+func (q *logQuery) run(emit func(line string, entry *logEntry) error) error {
+	files, current, err := logFiles(q.Filter.Host)
+	if err != nil {
+		return err
+	}
+
+	type match struct {
+		line  string
+		entry *logEntry
+	}
+	var backlog []match
+
+	handle := func(line string) error {
+		e, err := parseLogLine(line)
+		if err != nil {
+			if q.Filter.filtering() {
+				return nil
+			}
+			e = nil
+		} else if !q.Filter.match(e) {
+			return nil
+		}
+		if q.Limit > 0 {
+			backlog = append(backlog, match{line, e})
+			if len(backlog) > q.Limit {
+				backlog = backlog[1:]
+			}
+			return nil
+		}
+		return emit(line, e)
+	}
+
+	var offset int64
+	for _, name := range files {
+		n, err := scanLogFile(name, 0, handle)
+		if err != nil {
+			return err
+		}
+		if name == current {
+			offset = n
+		}
+	}
+
+	for _, m := range backlog {
+		if err := emit(m.line, m.entry); err != nil {
+			return err
+		}
+	}
+
+	if !q.Follow {
+		return nil
+	}
+
+	q.Limit = 0
+	return followLogFile(current, offset, q.Done, handle)
+}
+
+// scanLogFile calls handle for every complete line in name after offset,
+// returning the offset just past the last complete line
+func scanLogFile(name string, offset int64, handle func(string) error) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	} else if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			// Leave any partial line for next time, it's still being written
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+		if err := handle(strings.TrimRight(line, "\r\n")); err != nil {
+			return offset, err
+		}
+	}
+}
+
+// followLogFile keeps reading name from offset as it grows, starting over
+// from the top when it gets truncated or rotated out from under us
+func followLogFile(name string, offset int64, done <-chan struct{}, handle func(string) error) error {
+	last, _ := os.Stat(name)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+
+		inf, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if last != nil && !os.SameFile(last, inf) || inf.Size() < offset {
+			offset = 0
+		}
+		last = inf
+		if inf.Size() == offset {
+			continue
+		}
+
+		if offset, err = scanLogFile(name, offset, handle); err != nil {
+			return err
+		}
+	}
+}
+
+// logsCommand implements `henry.sites logs`
+func logsCommand(args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	host := fs.String("host", "", "Only show requests for this host, reads the host's own log")
+	status := fs.String("status", "", "Only show these response codes: 404, 4xx or 400-499")
+	ips := fs.String("ip", "", "Only show requests from these comma separated IPs or CIDRs")
+	pathGlob := fs.String("path", "", "Only show requests for paths matching this glob")
+	since := fs.String("since", "", "Only show requests after this time, or this long ago (1h)")
+	until := fs.String("until", "", "Only show requests before this time, or this long ago")
+	follow := fs.Bool("f", false, "Keep printing new requests as they come in")
+	limit := fs.Int("n", 0, "Only print the last n matching lines before following, 0 for all")
+	asJSON := fs.Bool("json", false, "Print each request as a JSON object")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	filter, err := newLogFilter(*host, *status, *ips, *pathGlob, *since, *until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	done := make(chan struct{})
+	q := &logQuery{Filter: filter, Limit: *limit, Follow: *follow, Done: done}
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	err = q.run(func(line string, e *logEntry) error {
+		var err error
+		if *asJSON {
+			if e == nil {
+				return nil
+			}
+			err = enc.Encode(e)
+		} else {
+			_, err = fmt.Fprintln(out, line)
+		}
+		if err != nil {
+			return err
+		}
+		if *follow {
+			return out.Flush()
+		}
+		return nil
+	})
+	out.Flush()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// logsAPIHandler serves the same queries as the logs command, taking its
+// flags as query parameters, plus format=json. With follow=1 the response is
+// kept open and new lines are streamed as they're written
+func logsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	filter, err := newLogFilter(v.Get("host"), v.Get("status"), v.Get("ip"), v.Get("path"), v.Get("since"), v.Get("until"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	follow := v.Get("follow") == "1" || v.Get("follow") == "true"
+	asJSON := v.Get("format") == "json"
+	flusher, _ := w.(http.Flusher)
+
+	if asJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	q := &logQuery{Filter: filter, Limit: queryInt(r, "n", 0), Follow: follow, Done: r.Context().Done()}
+	enc := json.NewEncoder(w)
+	err = q.run(func(line string, e *logEntry) error {
+		var err error
+		if asJSON {
+			if e == nil {
+				return nil
+			}
+			err = enc.Encode(e)
+		} else {
+			_, err = io.WriteString(w, line+"\n")
+		}
+		if err == nil && follow && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want *logEntry
+	}{
+		{
+			`192.0.2.1 - [02/Jan/2017:15:04:05 -0600] "GET henry.sites /index.html  HTTP/1.1" 200 512 "" "curl/7.52.1"`,
+			&logEntry{IP: "192.0.2.1", Method: "GET", Host: "henry.sites", Path: "/index.html", Proto: "HTTP/1.1", Status: 200, Bytes: 512, UserAgent: "curl/7.52.1"},
+		},
+		{
+			`2001:db8::1 henry [02/Jan/2017:15:04:05 -0600] "POST henry.sites /a b/c x=1&y=2 HTTP/2.0" 404 0 "https://example.com/" "Mozilla/5.0 (X11; Linux)" "US" "AS64496"`,
+			&logEntry{IP: "2001:db8::1", User: "henry", Method: "POST", Host: "henry.sites", Path: "/a b/c", Query: "x=1&y=2", Proto: "HTTP/2.0", Status: 404, Referer: "https://example.com/", UserAgent: "Mozilla/5.0 (X11; Linux)", Country: "US", ASN: "AS64496"},
+		},
+		{
+			`192.0.2.1 - [02/Jan/2017:15:04:05 -0600] "BINDING stun / port=3478 STUN/UDP" 200 88 "" "" "-" "-"`,
+			&logEntry{IP: "192.0.2.1", Method: "BINDING", Host: "stun", Path: "/", Query: "port=3478", Proto: "STUN/UDP", Status: 200, Bytes: 88},
+		},
+	}
+	for _, tt := range tests {
+		e, err := parseLogLine(tt.line)
+		if err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+			continue
+		}
+		if e.Time.Unix() != 1483391045 {
+			t.Errorf("%s: time is %v", tt.line, e.Time)
+		}
+		tt.want.Time = e.Time
+		if *e != *tt.want {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.line, e, tt.want)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"hello",
+		`192.0.2.1 - [yesterday] "GET henry.sites / HTTP/1.1" 200 512 "" ""`,
+		`192.0.2.1 - [02/Jan/2017:15:04:05 -0600] "GET henry.sites / HTTP/1.1" 200 lots "" ""`,
+		`192.0.2.1 - [02/Jan/2017:15:04:05 -0600] "GET henry.sites / HTTP/1.1" 200 512 "" "" "USA" "-"`,
+		`192.0.2.1 - [02/Jan/2017:15:04:05 -0600] "GET henry.sites / HTTP/1.1" 99999999999999999999 512 "" ""`,
+	} {
+		if e, err := parseLogLine(line); err == nil {
+			t.Errorf("%q parsed as %+v", line, e)
+		}
+	}
+}
+
+// Whatever writeAccessLog writes has to come back out of parseLogLine
+func TestParseLogLineWritten(t *testing.T) {
+	writeAccessLog("198.51.100.7", "-", "GET", "written.test", "/x", "q=1", "HTTP/1.1", 301, 42, "", "test agent")
+
+	b, err := os.ReadFile(filepath.Join(logDir, "written.test.access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	e, err := parseLogLine(lines[len(lines)-1])
+	if err != nil {
+		t.Fatalf("%s: %v", lines[len(lines)-1], err)
+	}
+	if e.IP != "198.51.100.7" || e.Path != "/x" || e.Query != "q=1" || e.Status != 301 || e.Bytes != 42 || e.UserAgent != "test agent" {
+		t.Errorf("got %+v", e)
+	}
+	if time.Since(e.Time) > time.Minute {
+		t.Errorf("time is %v", e.Time)
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max int
+		err      bool
+	}{
+		{"", 0, 0, false},
+		{"404", 404, 404, false},
+		{"4xx", 400, 499, false},
+		{" 5XX ", 500, 599, false},
+		{"200-299", 200, 299, false},
+		{"299-200", 0, 0, true},
+		{"xxx", 0, 0, true},
+		{"ok", 0, 0, true},
+		{"200-", 0, 0, true},
+	}
+	for _, tt := range tests {
+		min, max, err := parseStatusRange(tt.in)
+		if (err != nil) != tt.err || min != tt.min || max != tt.max {
+			t.Errorf("%q got %d-%d, %v", tt.in, min, max, err)
+		}
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	e := &logEntry{IP: "192.0.2.10", Host: "Henry.Sites", Path: "/blog/post", Status: 404, Time: time.Now().Add(-time.Hour)}
+
+	tests := []struct {
+		host, status, ips, glob, since, until string
+		match                                 bool
+	}{
+		{"", "", "", "", "", "", true},
+		{"henry.sites", "", "", "", "", "", true},
+		{"other.sites", "", "", "", "", "", false},
+		{"", "4xx", "", "", "", "", true},
+		{"", "200-399", "", "", "", "", false},
+		{"", "", "192.0.2.0/24", "", "", "", true},
+		{"", "", "192.0.2.11, 2001:db8::1", "", "", "", false},
+		{"", "", "2001:db8::/32,192.0.2.10", "", "", "", true},
+		{"", "", "", "/blog/*", "", "", true},
+		{"", "", "", "/*", "", "", false},
+		{"", "", "", "", "2h", "", true},
+		{"", "", "", "", "30m", "", false},
+		{"", "", "", "", "", "2h", false},
+		{"", "", "", "", "2h", "30m", true},
+	}
+	for _, tt := range tests {
+		f, err := newLogFilter(tt.host, tt.status, tt.ips, tt.glob, tt.since, tt.until)
+		if err != nil {
+			t.Errorf("%+v: %v", tt, err)
+			continue
+		}
+		if got := f.match(e); got != tt.match {
+			t.Errorf("%+v matched %v", tt, got)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"", "bad", "", "", "", ""},
+		{"", "", "192.0.2.300", "", "", ""},
+		{"", "", "", "[", "", ""},
+		{"", "", "", "", "last tuesday", ""},
+		{"../secrets", "", "", "", "", ""},
+		{"henry..sites", "", "", "", "", ""},
+		{"*", "", "", "", "", ""},
+		{"henry.site?", "", "", "", "", ""},
+		{"[a-z]*", "", "", "", "", ""},
+	} {
+		if _, err := newLogFilter(args[0], args[1], args[2], args[3], args[4], args[5]); err == nil {
+			t.Errorf("%q got no error", args)
+		}
+	}
+}
+
+func TestLogFilesHost(t *testing.T) {
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"", true},
+		{"henry.sites", true},
+		{"Henry.Sites", true},
+		{"stun", true},
+		{"192.0.2.1", true},
+		{"_dmarc.henry.sites", true},
+		{"..", false},
+		{"../henry.sites", false},
+		{"henry..sites", false},
+		{".henry.sites", false},
+		{"*", false},
+		{"henry.site?", false},
+		{"[h]enry.sites", false},
+		{"henry.sites/../x", false},
+	}
+	for _, tt := range tests {
+		_, current, err := logFiles(tt.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("logFiles(%q) got error %v, want ok %v", tt.host, err, tt.ok)
+			continue
+		}
+		if tt.ok && filepath.Dir(current) != logDir {
+			t.Errorf("logFiles(%q) reads %s, outside %s", tt.host, current, logDir)
+		}
+	}
+}
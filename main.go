@@ -21,15 +21,12 @@
 package main
 
 import (
-	"bufio"
 	"crypto/tls"
 	"flag"
 	"github.com/go-playground/log"
 	"github.com/go-playground/log/handlers/console"
-	"golang.org/x/crypto/acme"
-	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/http2"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
@@ -41,21 +38,47 @@ var (
 	devMode            = flag.Bool("dev", false, "Puts the server in developer mode, will bind to :34265 and will not autocert")
 	accessLogInConsole = flag.Bool("console-access", false, "Whether or not to print access log lines to the console")
 	listen             = flag.String("listen", ":https", "The address to listen on")
+	adminHost          = flag.String("admin-host", "", "The host to serve the admin pages, like analytics, on. Disabled when empty")
+	adminListen        = flag.String("admin-listen", "127.0.0.1:34266", "The address for the admin listener, serving /metrics and the admin pages. Disabled when empty")
+	adminSocket        = flag.String("admin-socket", "admin.sock", "The unix socket for the admin listener, which needs no token. Disabled when empty")
+	approveDomains     = flag.Bool("approve-domains", false, "Hold new domains for approval through the admin api instead of registering them straight away")
+	configPath         = flag.String("config", "config.json", "The path to the config file")
+	redirectsPath      = flag.String("redirects", "redirects.json", "The path to the redirect rules")
+	dbPath             = flag.String("db", "henry.sites.db", "The path to the database file")
+	geoIPCity          = flag.String("geoip-city", "GeoLite2-City.mmdb", "The path to a MaxMind City database, for ifcfg and the access log. Disabled when empty")
+	geoIPASN           = flag.String("geoip-asn", "GeoLite2-ASN.mmdb", "The path to a MaxMind ASN database, for ifcfg and the access log. Disabled when empty")
+	resolverAddr       = flag.String("resolver", "", "The DNS server to use for reverse lookups, like 127.0.0.1:53. Uses the system resolver when empty")
+	dnsListen          = flag.String("dns-listen", "", "The address to serve DNS for -dns-zone on, over UDP and TCP, like :53. Disabled when empty")
+	dnsZoneName        = flag.String("dns-zone", "dns.ifcfg.org", "The zone to answer DNS queries for with the address of whoever asked")
+	dyndnsZoneName     = flag.String("dyndns-zone", "dyn.ifcfg.org", "The zone dynamic DNS hostnames are in, served by the DNS server")
+	stunListen         = flag.String("stun-listen", "", "The address to serve STUN on, over UDP and TCP, like :3478. Disabled when empty")
+	portCheckDeny      = flag.String("portcheck-deny", "0,19,25,135,137,138,139,445,465,587", "Comma separated ports ifcfg won't check with /port/<n>")
+	proxyCacheDir      = flag.String("proxy-cache-dir", "proxy-cache", "Where proxied responses are cached on disk. Only cached in memory when empty")
+	proxyCacheMemory   = flag.Int("proxy-cache-memory", 64, "How many MB of proxied responses to cache in memory")
+	proxyCacheDisk     = flag.Int("proxy-cache-disk", 1024, "How many MB of proxied responses to cache on disk")
+	accessLogGeo       = flag.Bool("access-log-geo", false, "Add the country and ASN of the client to access log lines")
 	cookieSecret       string
 	buildTime          string
 	commit             string
-	domainList         = []string{}
-	m                  autocert.Manager
 )
 
 func init() {
-	flag.Parse()
+	flag.Usage = usage
 	cLog := console.New(true)
 	cLog.SetTimestampFormat(time.RFC3339)
 	log.AddHandler(cLog, log.AllLevels...)
 }
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	flag.Parse()
+	serve()
+}
+
+// serve runs the server, configured by the flags on flag.CommandLine
+func serve() {
 	log.Info("Starting henry.sites")
 	if buildTime != "" {
 		log.Info("Built: " + buildTime)
@@ -65,28 +88,52 @@ func main() {
 	}
 	log.Info("Go: " + runtime.Version())
 
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+	if err := loadRedirects(); err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+	openDB()
+	loadDomainList()
+	startAnalytics()
+	startShortLinks()
+	startGeoIP()
+	startProxyCache()
 	setupRouter()
+	startAdminListener()
+	startDNS()
+	startSTUN()
 
 	if *devMode {
 		srv := &http.Server{
-			Addr:    ":34265",
-			Handler: router,
+			Addr:        ":34265",
+			Handler:     router,
+			ConnContext: echoConnContext,
 		}
 
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Fatal(err)
+			panic(err)
+		}
 		log.Info("Listening on :34265")
-		srv.ListenAndServe()
+		srv.Serve(headerRecordingListener{l})
 	}
 
-	m = autocert.Manager{
-		Cache:  autocert.DirCache("certs"),
-		Prompt: autocert.AcceptTOS,
+	m = newCertManager()
+	if *adminHost != "" && !domainIsRegistered(*adminHost) {
+		addToDomainList(*adminHost, true)
 	}
-	loadDomainList()
 
 	tlsConf := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		PreferServerCipherSuites: true,
-		GetCertificate:           m.GetCertificate,
+		GetCertificate:           getCertificate,
+		VerifyConnection:         countHandshake,
+		GetConfigForClient:       captureClientHello,
 
 		CurvePreferences: []tls.CurveID{
 			tls.CurveP256,
@@ -104,90 +151,35 @@ func main() {
 	}
 
 	rootSrv := &http.Server{
-		Addr:      *listen,
-		Handler:   router,
-		TLSConfig: tlsConf,
+		Addr:        *listen,
+		Handler:     withConnTLS(router),
+		TLSConfig:   tlsConf,
+		ErrorLog:    newServerErrorLog(),
+		ConnState:   forgetConn,
+		ConnContext: echoConnContext,
 
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
-	go http.ListenAndServe(":http", m.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		addToDomainList(req.Host, !domainIsRegistered(req.Host))
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seenDomain(req.Host)
 		w.Header().Set("Connection", "close")
 		url := "https://" + req.Host + req.URL.String()
 		http.Redirect(w, req, url, http.StatusMovedPermanently)
-	})))
+	})
+	go http.ListenAndServe(":http", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The manager can be swapped out from under us by renewCert
+		certManager().HTTPHandler(redirect).ServeHTTP(w, req)
+	}))
 
 	log.Infof("Listening on %s", *listen)
 
 	http2.ConfigureServer(rootSrv, &http2.Server{})
-	log.Fatal(rootSrv.ListenAndServeTLS("", ""))
-}
-
-func domainIsRegistered(domain string) bool {
-	for _, d := range domainList {
-		if d == domain {
-			return true
-		}
-	}
-	return false
-}
-
-func addToDomainList(domain string, isNew bool) {
-	if domain == "" {
-		log.Warn("Cannot use an empty string as a domain")
-		return
-	}
-	for _, d := range domainList {
-		if d == domain {
-			log.Noticef("%s already in domain list, returning\n", domain)
-			return
-		}
-	}
-	domainList = append(domainList, domain)
-
-	err := ioutil.WriteFile("domains.txt", []byte(strings.Join(domainList, "\n")), os.ModeAppend)
-	if err != nil {
-		log.Fatal(err)
-		panic(err)
-	}
-
-	m.HostPolicy = autocert.HostWhitelist(domainList...)
-	if isNew {
-		log.Noticef("Added %s to registered domains", domain)
-	}
-
-	acme.RateLimit(err)
-}
-
-func loadDomainList() {
-	var f *os.File
-	var err error
-	if _, err = os.Stat("domains.txt"); os.IsNotExist(err) {
-		f, err = os.Create("domains.txt")
-		if err != nil {
-			log.Fatal(err)
-			panic(err)
-		}
-	} else {
-		f, err = os.Open("domains.txt")
-		if err != nil {
-			log.Fatal(err)
-			panic(err)
-		}
-	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
+	l, err := net.Listen("tcp", *listen)
 	if err != nil {
 		log.Fatal(err)
 		panic(err)
 	}
-
-	for scanner.Scan() {
-		addToDomainList(scanner.Text(), false)
-	}
-
-	log.Noticef("There are now %d domains registered\n", len(domainList))
+	log.Fatal(rootSrv.Serve(newTLSRecordingListener(l, rootSrv.TLSConfig, rootSrv.ReadTimeout, isEchoHost)))
 }
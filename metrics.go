@@ -0,0 +1,510 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme/autocert"
+	"io"
+	stdlog "log"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny implementation of the prometheus text format, we only need
+// counters, gauges and histograms and don't want to pull in the client
+// library for them
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	metrics = append(metrics, m)
+	metricsMu.Unlock()
+}
+
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders names and values as {a="b",c="d"}, with extra
+// appended as-is for things like histogram buckets
+func formatLabels(names, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type labeledValue struct {
+	labels []string
+	value  float64
+}
+
+// counterVec is a counter split up by a set of labels
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*labeledValue
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]*labeledValue{}}
+	registerMetric(c)
+	return c
+}
+
+func (c *counterVec) add(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	c.mu.Lock()
+	lv := c.values[key]
+	if lv == nil {
+		lv = &labeledValue{labels: labels}
+		c.values[key] = lv
+	}
+	lv.value += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labels ...string) {
+	c.add(1, labels...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeMetricHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		lv := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, lv.labels, ""), formatFloat(lv.value))
+	}
+}
+
+func sortedKeys(m map[string]*labeledValue) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// gaugeFunc is a gauge, or a counter, whose value is read when scraped
+type gaugeFunc struct {
+	name, help, typ string
+	labels          []string
+	values          func() []labeledValue
+}
+
+func newGaugeFunc(name, help string, f func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, typ: "gauge", values: func() []labeledValue {
+		return []labeledValue{{value: f()}}
+	}}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeMetricHeader(w, g.name, g.help, g.typ)
+	for _, lv := range g.values() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, lv.labels, ""), formatFloat(lv.value))
+	}
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram split up by a set of labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+	registerMetric(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	h.mu.Lock()
+	hv := h.values[key]
+	if hv == nil {
+		hv = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hv.labels, `le="`+formatFloat(b)+`"`), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hv.labels, `le="+Inf"`), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, hv.labels, ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, hv.labels, ""), hv.count)
+	}
+}
+
+var (
+	startTime = time.Now()
+
+	httpRequests = newCounterVec("henry_sites_http_requests_total",
+		"Requests served, by vhost, route and status code.", "host", "route", "code")
+	httpDuration = newHistogramVec("henry_sites_http_request_duration_seconds",
+		"Time taken to serve requests, by vhost and route.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "host", "route")
+	httpResponseSize = newHistogramVec("henry_sites_http_response_size_bytes",
+		"Size of response bodies, by vhost and route.",
+		[]float64{100, 1000, 10000, 100000, 1000000, 10000000, 100000000}, "host", "route")
+
+	tlsHandshakes = newCounterVec("henry_sites_tls_handshakes_total",
+		"Completed TLS handshakes, by protocol version.", "version")
+	tlsHandshakeErrors = newCounterVec("henry_sites_tls_handshake_errors_total",
+		"TLS handshakes that failed.")
+
+	autocertCerts = newCounterVec("henry_sites_autocert_certificates_total",
+		"Certificates obtained from the CA, by whether they were new or a renewal.", "outcome")
+	autocertErrors = newCounterVec("henry_sites_autocert_errors_total",
+		"Handshakes where no certificate could be found or obtained.")
+
+	fileSumLookups = newCounterVec("henry_sites_filesum_cache_lookups_total",
+		"Lookups in the file checksum cache, by whether they were a hit or a miss.", "result")
+
+	dnsQueries = newCounterVec("henry_sites_dns_queries_total",
+		"DNS queries answered, by transport, query type and response code.", "proto", "type", "rcode")
+	accessLogDropped = newCounterVec("henry_sites_access_log_dropped_total",
+		"Access log lines for DNS and STUN dropped because the writer was behind.")
+
+	stunRequests = newCounterVec("henry_sites_stun_requests_total",
+		"STUN messages received, by transport and whether they were answered, an error, an indication, unsupported or invalid.", "proto", "result")
+
+	portChecks = newCounterVec("henry_sites_ifcfg_port_checks_total",
+		"Port reachability checks, by whether the port was open, closed or filtered.", "state")
+
+	proxyRequests = newCounterVec("henry_sites_proxy_upstream_requests_total",
+		"Requests sent to proxy upstreams, by upstream and whether they got a response, failed or were retried elsewhere.", "upstream", "result")
+
+	proxyCacheLookups = newCounterVec("henry_sites_proxy_cache_lookups_total",
+		"Proxied requests by how the cache answered them, a hit, stale, revalidated, a miss or bypassed.", "result")
+
+	rateLimited = newCounterVec("henry_sites_rate_limited_total",
+		"Requests turned away by rate limits, by vhost and site route, empty for the vhost's own limit.", "host", "route")
+
+	rdnsLookups = newCounterVec("henry_sites_rdns_lookups_total",
+		"Reverse DNS lookups for ifcfg, by whether they were cached, confirmed, unconfirmed, had no name or failed.", "result")
+
+	_ = newGaugeFunc("henry_sites_domains", "Domains registered for certificates.", func() float64 {
+		domains, _ := listDomains()
+		return float64(len(domains))
+	})
+	_ = newGaugeFunc("henry_sites_pending_domains", "Domains waiting to be approved.", func() float64 {
+		_, pending := listDomains()
+		return float64(len(pending))
+	})
+	_ = newGaugeFunc("henry_sites_proxy_cache_memory_bytes", "Size of the proxy cache in memory.", func() float64 {
+		if proxyCache == nil {
+			return 0
+		}
+		mem, _ := proxyCache.sizes()
+		return float64(mem)
+	})
+	_ = newGaugeFunc("henry_sites_proxy_cache_disk_bytes", "Size of the proxy cache on disk.", func() float64 {
+		if proxyCache == nil {
+			return 0
+		}
+		_, disk := proxyCache.sizes()
+		return float64(disk)
+	})
+	_ = newGaugeFunc("henry_sites_rate_limit_keys", "Clients, and the like, being tracked by rate limiters.", func() float64 {
+		return float64(rateLimitBuckets())
+	})
+	_ = newGaugeFunc("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", func() float64 {
+		return float64(startTime.UnixNano()) / 1e9
+	})
+)
+
+func init() {
+	registerMetric(&gaugeFunc{name: "go_info", help: "Information about the Go environment.", typ: "gauge", labels: []string{"version"}, values: func() []labeledValue {
+		return []labeledValue{{labels: []string{runtime.Version()}, value: 1}}
+	}})
+	newGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	newGaugeFunc("go_threads", "Number of OS threads created.", func() float64 {
+		return float64(pprof.Lookup("threadcreate").Count())
+	})
+
+	memStat := func(name, help, typ string, f func(*runtime.MemStats) float64) {
+		registerMetric(&gaugeFunc{name: name, help: help, typ: typ, values: func() []labeledValue {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			return []labeledValue{{value: f(&ms)}}
+		}})
+	}
+	memStat("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge",
+		func(ms *runtime.MemStats) float64 { return float64(ms.Alloc) })
+	memStat("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", "counter",
+		func(ms *runtime.MemStats) float64 { return float64(ms.TotalAlloc) })
+	memStat("go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge",
+		func(ms *runtime.MemStats) float64 { return float64(ms.Sys) })
+	memStat("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", "gauge",
+		func(ms *runtime.MemStats) float64 { return float64(ms.HeapInuse) })
+	memStat("go_memstats_heap_objects", "Number of allocated objects.", "gauge",
+		func(ms *runtime.MemStats) float64 { return float64(ms.HeapObjects) })
+	memStat("go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", "gauge",
+		func(ms *runtime.MemStats) float64 { return float64(ms.LastGC) / 1e9 })
+	memStat("go_memstats_gc_total", "Number of completed GC cycles.", "counter",
+		func(ms *runtime.MemStats) float64 { return float64(ms.NumGC) })
+	memStat("go_memstats_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", "counter",
+		func(ms *runtime.MemStats) float64 { return float64(ms.PauseTotalNs) / 1e9 })
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metricsMu.Lock()
+	ms := append([]metric{}, metrics...)
+	metricsMu.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range ms {
+		m.write(&buf)
+	}
+	buf.WriteTo(w)
+}
+
+// statusRecorder remembers the status code and body size of a response,
+// while still letting handlers flush and hijack the connection
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is for http.ResponseController, so handlers can get at the
+// connection's deadlines
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", s.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// routeLabels names the route a request matched for metrics, using the
+// host template so the catch-all can't blow up the number of series
+func routeLabels(r *http.Request) (string, string) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", ""
+	}
+	host, err := route.GetHostTemplate()
+	if err != nil {
+		host = "*"
+	}
+	name := route.GetName()
+	if name == "" {
+		if name, err = route.GetPathTemplate(); err != nil {
+			name = ""
+		}
+	}
+	return host, name
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		host, route := routeLabels(r)
+		httpRequests.inc(host, route, strconv.Itoa(rec.code))
+		httpDuration.observe(time.Since(start).Seconds(), host, route)
+		httpResponseSize.observe(float64(rec.bytes), host, route)
+	})
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+// countHandshake is used as tls.Config.VerifyConnection, which gets called
+// once for every handshake that makes it to the end
+func countHandshake(cs tls.ConnectionState) error {
+	version, ok := tlsVersionNames[cs.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", cs.Version)
+	}
+	tlsHandshakes.inc(version)
+	return nil
+}
+
+// handshakeErrorLog is used as the http.Server.ErrorLog so we can count the
+// handshakes that fail, net/http doesn't tell us about them any other way
+type handshakeErrorLog struct{}
+
+func (handshakeErrorLog) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		tlsHandshakeErrors.inc()
+	}
+	return stdlog.Writer().Write(p)
+}
+
+func newServerErrorLog() *stdlog.Logger {
+	return stdlog.New(handshakeErrorLog{}, "", stdlog.LstdFlags)
+}
+
+// metricsCache wraps the autocert cache to count certificates as the manager
+// stores them, a key that was already there means it was renewed
+type metricsCache struct {
+	autocert.Cache
+}
+
+func (c metricsCache) Put(ctx context.Context, key string, data []byte) error {
+	// Account keys and challenge responses aren't certificates we asked for
+	if strings.HasPrefix(key, "acme_account") || strings.HasPrefix(key, "http-01-") || strings.HasSuffix(key, ".acme.invalid") {
+		return c.Cache.Put(ctx, key, data)
+	}
+
+	outcome := "issued"
+	if _, err := c.Cache.Get(ctx, key); err == nil {
+		outcome = "renewed"
+	}
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	autocertCerts.inc(outcome)
+	return nil
+}
+
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := certManager().GetCertificate(hello)
+	if err != nil {
+		autocertErrors.inc()
+	}
+	return cert, err
+}
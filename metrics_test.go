@@ -0,0 +1,172 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCounterVecWrite(t *testing.T) {
+	c := &counterVec{name: "test_total", help: "Things.", labels: []string{"kind", "code"}, values: map[string]*labeledValue{}}
+	c.inc("b", "200")
+	c.add(2.5, "a", "404")
+	c.inc("b", "200")
+	c.inc(`quote " and \ and`+"\n", "500")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	want := `# HELP test_total Things.
+# TYPE test_total counter
+test_total{kind="a",code="404"} 2.5
+test_total{kind="b",code="200"} 2
+test_total{kind="quote \" and \\ and\n",code="500"} 1
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	// Counters without labels are there from the start
+	buf.Reset()
+	(&counterVec{name: "empty_total", help: "Nothing yet.", values: map[string]*labeledValue{}}).write(&buf)
+	if !strings.HasSuffix(buf.String(), "\nempty_total 0\n") {
+		t.Errorf("an unused counter wrote\n%s", buf.String())
+	}
+}
+
+func TestHistogramVecWrite(t *testing.T) {
+	h := &histogramVec{name: "test_seconds", help: "Time.", labels: []string{"host"}, buckets: []float64{.1, 1}, values: map[string]*histogramValue{}}
+	for _, v := range []float64{.05, .5, .5, 3} {
+		h.observe(v, "example.com")
+	}
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP test_seconds Time.
+# TYPE test_seconds histogram
+test_seconds_bucket{host="example.com",le="0.1"} 1
+test_seconds_bucket{host="example.com",le="1"} 3
+test_seconds_bucket{host="example.com",le="+Inf"} 4
+test_seconds_sum{host="example.com"} 4.05
+test_seconds_count{host="example.com"} 4
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestGaugeFuncWrite(t *testing.T) {
+	g := &gaugeFunc{name: "test_gauge", help: "Level.", typ: "gauge", values: func() []labeledValue {
+		return []labeledValue{{value: math.Inf(1)}}
+	}}
+	var buf bytes.Buffer
+	g.write(&buf)
+	if want := "# HELP test_gauge Level.\n# TYPE test_gauge gauge\ntest_gauge +Inf\n"; buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+var (
+	metricSampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{([a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*",?)*\})? (\S+)$`)
+	metricTypeLine   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|histogram)$`)
+)
+
+// TestMetricsHandler checks everything we export can be scraped
+func TestMetricsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is %q", ct)
+	}
+
+	typed := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+		case strings.HasPrefix(line, "# TYPE "):
+			m := metricTypeLine.FindStringSubmatch(line)
+			if m == nil {
+				t.Errorf("bad type line %q", line)
+				continue
+			}
+			if typed[m[1]] {
+				t.Errorf("%s is exported twice", m[1])
+			}
+			typed[m[1]] = true
+		default:
+			m := metricSampleLine.FindStringSubmatch(line)
+			if m == nil {
+				t.Errorf("bad sample %q", line)
+				continue
+			}
+			name := m[1]
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if base := strings.TrimSuffix(name, suffix); base != name && typed[base] {
+					name = base
+				}
+			}
+			if !typed[name] {
+				t.Errorf("%s has no TYPE before it", m[1])
+			}
+		}
+	}
+	for _, name := range []string{"henry_sites_http_requests_total", "henry_sites_tls_handshakes_total", "process_start_time_seconds"} {
+		if !typed[name] {
+			t.Errorf("%s is missing", name)
+		}
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(metricsMiddleware)
+	r.Host("metrics.test").Path("/thing/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+	r.Host("metrics.test").Path("/named").Name("named").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	count := func(host, route, code string) float64 {
+		httpRequests.mu.Lock()
+		defer httpRequests.mu.Unlock()
+		if lv := httpRequests.values[strings.Join([]string{host, route, code}, "\xff")]; lv != nil {
+			return lv.value
+		}
+		return 0
+	}
+	teapots, named := count("metrics.test", "/thing/{id}", "418"), count("metrics.test", "named", "200")
+
+	for _, path := range []string{"/thing/1", "/thing/2", "/named"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://metrics.test"+path, nil))
+	}
+	if got := count("metrics.test", "/thing/{id}", "418") - teapots; got != 2 {
+		t.Errorf("counted %v requests to /thing/{id}, want 2 under the template", got)
+	}
+	if got := count("metrics.test", "named", "200") - named; got != 1 {
+		t.Errorf("counted %v requests to the named route, want 1 with the default 200", got)
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// A reader for MaxMind DB files, like the GeoLite2 databases, see
+// https://maxmind.github.io/MaxMind-DB/ for the format. The whole file is
+// read into memory, they're small enough
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBCorrupt = errors.New("mmdb: corrupt database")
+
+type mmdbReader struct {
+	buf          []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	// The node IPv4 addresses start from in an IPv6 tree
+	ipv4Start uint
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: no metadata, is this a MaxMind DB file?")
+	}
+	metaStart := i + len(mmdbMetadataMarker)
+
+	d := mmdbDecoder{buf: buf[metaStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+
+	r := &mmdbReader{buf: buf}
+	r.nodeCount = uint(mmdbUint(meta["node_count"]))
+	r.recordSize = uint(mmdbUint(meta["record_size"]))
+	r.ipVersion = uint(mmdbUint(meta["ip_version"]))
+	r.databaseType, _ = meta["database_type"].(string)
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	dataStart := treeSize + 16
+	if dataStart > uint(i) {
+		return nil, errMMDBCorrupt
+	}
+	r.data = buf[dataStart:i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < r.nodeCount; n++ {
+			if node, err = r.readNode(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+func mmdbUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case uint32:
+		return uint64(n)
+	case uint16:
+		return uint64(n)
+	}
+	return 0
+}
+
+func (r *mmdbReader) readNode(node uint, bit uint) (uint, error) {
+	off := node * r.recordSize / 4
+	if off+r.recordSize/4 > uint(len(r.buf)) {
+		return 0, errMMDBCorrupt
+	}
+	b := r.buf[off:]
+
+	switch r.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4])), nil
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8])), nil
+	}
+}
+
+// lookup returns the record for ip, or nil when there isn't one
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	var err error
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		if node, err = r.readNode(node, bit); err != nil {
+			return nil, err
+		}
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errMMDBCorrupt
+	}
+
+	off := node - r.nodeCount - 16
+	if off >= uint(len(r.data)) {
+		return nil, errMMDBCorrupt
+	}
+	d := mmdbDecoder{buf: r.data}
+	v, _, err := d.decode(off, 0)
+	return v, err
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEnd       = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+func (d *mmdbDecoder) need(off, n uint) error {
+	if off+n > uint(len(d.buf)) {
+		return errMMDBCorrupt
+	}
+	return nil
+}
+
+// How deep maps, arrays and pointers can nest, real databases don't come
+// close, a corrupt one could loop forever
+const mmdbMaxDepth = 32
+
+// decode decodes the value at off, depth levels down, returning it and the
+// offset after it
+func (d *mmdbDecoder) decode(off, depth uint) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	if err := d.need(off, 1); err != nil {
+		return nil, 0, err
+	}
+	ctrl := d.buf[off]
+	off++
+
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == 0 {
+		if err := d.need(off, 1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if err := d.need(off, n); err != nil {
+			return nil, 0, err
+		}
+		extra := uint(0)
+		for _, b := range d.buf[off : off+n] {
+			extra = extra<<8 | uint(b)
+		}
+		off += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		// The sizes come from the file, so they're not trusted to size
+		// anything up front
+		m := map[string]interface{}{}
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := []interface{}{}
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	case mmdbEnd, mmdbContainer:
+		return nil, off, nil
+	}
+
+	if err := d.need(off, size); err != nil {
+		return nil, 0, err
+	}
+	b := d.buf[off : off+size]
+	off += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbBytes:
+		return append([]byte{}, b...), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			// Nothing we look at is this big, keep the low 64 bits
+			b = b[size-8:]
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	case mmdbInt32:
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(n)), off, nil
+		}
+		return int64(n), off, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unknown data type %d", typ)
+}
+
+func (d *mmdbDecoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	n := uint((ctrl>>3)&0x3) + 1
+	if err := d.need(off, n); err != nil {
+		return 0, 0, err
+	}
+	b := d.buf[off : off+n]
+	v := uint(ctrl & 0x7)
+
+	var ptr uint
+	switch n {
+	case 1:
+		ptr = v<<8 | uint(b[0])
+	case 2:
+		ptr = (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 3:
+		ptr = (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		ptr = uint(binary.BigEndian.Uint32(b))
+	}
+	return ptr, off + n, nil
+}
+
+// mmdbPath walks down nested maps and arrays, keys are strings for maps
+// and ints for arrays
+func mmdbPath(v interface{}, path ...interface{}) interface{} {
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || k >= len(a) {
+				return nil
+			}
+			v = a[k]
+		}
+	}
+	return v
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMMDBDecode(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 40)
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"string", []byte{0x42, 'h', 'i'}, "hi"},
+		{"empty string", []byte{0x40}, ""},
+		{"long string", append([]byte{0x5D, 40 - 29}, long...), string(long)},
+		{"uint16", []byte{0xA2, 0x01, 0x2C}, uint64(300)},
+		{"uint32", []byte{0xC1, 0x05}, uint64(5)},
+		{"uint64", []byte{0x01, 0x02, 0x07}, uint64(7)},
+		{"uint128 keeps the low bits", append([]byte{0x10, 0x03}, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2), uint64(2)},
+		{"int32", []byte{0x04, 0x01, 0xFF, 0xFF, 0xFF, 0xFF}, int64(-1)},
+		{"short int32", []byte{0x02, 0x01, 0x01, 0x00}, int64(256)},
+		{"double", []byte{0x68, 0x3F, 0xF8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{"float", []byte{0x04, 0x08, 0x3F, 0xC0, 0, 0}, 1.5},
+		{"true", []byte{0x01, 0x07}, true},
+		{"false", []byte{0x00, 0x07}, false},
+		{"bytes", []byte{0x82, 0xDE, 0xAD}, []byte{0xDE, 0xAD}},
+		{"map", []byte{0xE2, 0x41, 'a', 0x41, 'b', 0x41, 'n', 0xC1, 0x02}, map[string]interface{}{"a": "b", "n": uint64(2)}},
+		{"empty map", []byte{0xE0}, map[string]interface{}{}},
+		{"array", []byte{0x02, 0x04, 0xC1, 0x01, 0x42, 'h', 'i'}, []interface{}{uint64(1), "hi"}},
+		{"empty array", []byte{0x00, 0x04}, []interface{}{}},
+		{"nested", []byte{0xE1, 0x41, 'a', 0x01, 0x04, 0xE1, 0x41, 'b', 0x01, 0x07}, map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": true}}}},
+		// A map whose value is a pointer to the string after it
+		{"pointer", []byte{0xE1, 0x41, 'a', 0x20, 0x05, 0x42, 'h', 'i'}, map[string]interface{}{"a": "hi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := mmdbDecoder{buf: tt.data}
+			got, _, err := d.decode(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMMDBDecodeCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated string", []byte{0x45, 'a'}},
+		{"truncated size", []byte{0x5E, 0x01}},
+		{"truncated pointer", []byte{0x28, 0x00}},
+		{"truncated map", []byte{0xE2, 0x41, 'a', 0x41, 'b'}},
+		{"map key isn't a string", []byte{0xE1, 0xC1, 0x01, 0x41, 'b'}},
+		{"double isn't 8 bytes", []byte{0x64, 0, 0, 0, 0}},
+		{"float isn't 4 bytes", []byte{0x02, 0x08, 0, 0}},
+		{"unknown type", []byte{0x00, 0x09}},
+		{"pointer to itself", []byte{0x20, 0x00}},
+		{"map containing itself", []byte{0xE1, 0x41, 'a', 0x20, 0x00}},
+		{"pointer past the end", []byte{0x27, 0xFF}},
+		// A map claiming millions of entries in a few bytes
+		{"huge map", []byte{0xFF, 0xFF, 0xFF, 0xFF}},
+		{"huge array", []byte{0x1F, 0x04, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := mmdbDecoder{buf: tt.data}
+			if v, _, err := d.decode(0, 0); err == nil {
+				t.Errorf("decoded %#v", v)
+			}
+		})
+	}
+}
+
+func TestMMDBDecodeDepth(t *testing.T) {
+	nest := func(n int) []byte {
+		var b []byte
+		for i := 0; i < n; i++ {
+			b = append(b, 0x01, 0x04)
+		}
+		return append(b, 0x40)
+	}
+	d := mmdbDecoder{buf: nest(mmdbMaxDepth)}
+	if _, _, err := d.decode(0, 0); err != nil {
+		t.Errorf("%d arrays deep: %v", mmdbMaxDepth, err)
+	}
+	d = mmdbDecoder{buf: nest(mmdbMaxDepth + 1)}
+	if _, _, err := d.decode(0, 0); err != errMMDBCorrupt {
+		t.Errorf("%d arrays deep got %v, want errMMDBCorrupt", mmdbMaxDepth+1, err)
+	}
+}
+
+// encodeMMDB writes v in the MaxMind DB data format, for the few types the
+// tests need
+func encodeMMDB(v interface{}) []byte {
+	ctrl := func(typ, size int) []byte {
+		var b []byte
+		var extra []byte
+		switch {
+		case size >= 285:
+			b = []byte{30}
+			extra = []byte{byte((size - 285) >> 8), byte(size - 285)}
+		case size >= 29:
+			b = []byte{29}
+			extra = []byte{byte(size - 29)}
+		default:
+			b = []byte{byte(size)}
+		}
+		if typ > 7 {
+			b = append(b, byte(typ-7))
+		} else {
+			b[0] |= byte(typ << 5)
+		}
+		return append(b, extra...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(mmdbString, len(v)), v...)
+	case uint32:
+		return append(ctrl(mmdbUint32, 4), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	case float64:
+		bits := math.Float64bits(v)
+		b := ctrl(mmdbDouble, 8)
+		for i := 7; i >= 0; i-- {
+			b = append(b, byte(bits>>(8*i)))
+		}
+		return b
+	case []interface{}:
+		b := ctrl(mmdbArray, len(v))
+		for _, e := range v {
+			b = append(b, encodeMMDB(e)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := ctrl(mmdbMap, len(v))
+		for _, k := range keys {
+			b = append(b, encodeMMDB(k)...)
+			b = append(b, encodeMMDB(v[k])...)
+		}
+		return b
+	}
+	panic("can't encode that")
+}
+
+// buildMMDB makes an IPv4 database with 24 bit records, holding record for
+// every address in the /8 network
+func buildMMDB(network byte, record interface{}) []byte {
+	const nodeCount = 8
+	var tree []byte
+	for i := 0; i < nodeCount; i++ {
+		next := [2]uint{nodeCount, nodeCount}
+		bit := network >> (7 - uint(i)) & 1
+		if i < nodeCount-1 {
+			next[bit] = uint(i + 1)
+		} else {
+			// The record, past the tree and the 16 byte separator
+			next[bit] = nodeCount + 16
+		}
+		for _, n := range next {
+			tree = append(tree, byte(n>>16), byte(n>>8), byte(n))
+		}
+	}
+	b := append(tree, make([]byte, 16)...)
+	b = append(b, encodeMMDB(record)...)
+	b = append(b, mmdbMetadataMarker...)
+	return append(b, encodeMMDB(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(4),
+		"database_type": "Test-City",
+	})...)
+}
+
+func TestMMDBLookup(t *testing.T) {
+	record := map[string]interface{}{
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": "Testville"}},
+		"subdivisions": []interface{}{map[string]interface{}{"names": map[string]interface{}{"en": "Testshire"}}},
+		"location":     map[string]interface{}{"latitude": 41.5},
+	}
+	r, err := newMMDBReader(buildMMDB(10, record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.databaseType != "Test-City" {
+		t.Errorf("database type is %q", r.databaseType)
+	}
+
+	rec, err := r.lookup(net.ParseIP("10.1.2.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path []interface{}
+		want interface{}
+	}{
+		{[]interface{}{"city", "names", "en"}, "Testville"},
+		{[]interface{}{"subdivisions", 0, "names", "en"}, "Testshire"},
+		{[]interface{}{"location", "latitude"}, 41.5},
+		{[]interface{}{"subdivisions", 1, "names"}, nil},
+		{[]interface{}{"city", 0}, nil},
+		{[]interface{}{"country", "iso_code"}, nil},
+	} {
+		if got := mmdbPath(rec, tt.path...); got != tt.want {
+			t.Errorf("%v is %#v, want %#v", tt.path, got, tt.want)
+		}
+	}
+
+	for _, ip := range []string{"11.1.2.3", "192.0.2.1", "2001:db8::1"} {
+		if rec, err := r.lookup(net.ParseIP(ip)); rec != nil || err != nil {
+			t.Errorf("%s found %v, %v", ip, rec, err)
+		}
+	}
+}
+
+func TestMMDBReaderCorrupt(t *testing.T) {
+	good := buildMMDB(10, map[string]interface{}{"a": "b"})
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"not a database", []byte("hello")},
+		{"bad metadata", append(append([]byte{}, mmdbMetadataMarker...), 0x45)},
+		{"metadata isn't a map", append(append([]byte{}, mmdbMetadataMarker...), encodeMMDB("x")...)},
+		{"tree past the metadata", append(append([]byte{}, mmdbMetadataMarker...), encodeMMDB(map[string]interface{}{
+			"node_count": uint32(1000), "record_size": uint32(24), "ip_version": uint32(4),
+		})...)},
+		{"bad record size", append(good[:bytes.LastIndex(good, mmdbMetadataMarker)+len(mmdbMetadataMarker)], encodeMMDB(map[string]interface{}{
+			"node_count": uint32(8), "record_size": uint32(20), "ip_version": uint32(4),
+		})...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newMMDBReader(tt.buf); err == nil {
+				t.Error("opened it")
+			}
+		})
+	}
+}
@@ -0,0 +1,729 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig logs people in with an OpenID Connect provider before they get
+// to a route
+type OIDCConfig struct {
+	// The provider, its endpoints are found at
+	// <issuer>/.well-known/openid-configuration
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// Where the provider sends people back to, it has to end in
+	// oauth2/callback under the route's path. Worked out from the request
+	// by default, set it when there's a proxy in front of us
+	RedirectURL string `json:"redirect_url,omitempty"`
+	// Asked for on login, openid email profile by default
+	Scopes []string `json:"scopes,omitempty"`
+	// Who is let in, anyone matching one of these. Emails have to be
+	// verified by the provider
+	AllowedEmails  []string `json:"allowed_emails,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	AllowedGroups  []string `json:"allowed_groups,omitempty"`
+	// The claim with someone's groups in it, groups by default
+	GroupsClaim string `json:"groups_claim,omitempty"`
+	// How long a login lasts, 12h by default
+	Session duration `json:"session,omitempty"`
+}
+
+// How long someone has to log in with the provider
+const oidcLoginTTL = 10 * time.Minute
+
+// Browsers give up on cookies much bigger than this
+const maxCookieSize = 4000
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// siteOIDC is the OpenID Connect login for a route
+type siteOIDC struct {
+	host     string
+	conf     *OIDCConfig
+	cookie   string
+	callback string
+	logout   string
+
+	mu       sync.Mutex
+	provider *oidcProvider
+}
+
+// oidcProvider is what we've found out about the provider, fetched the
+// first time someone needs to log in
+type oidcProvider struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidcSession is who someone logged in as, kept in a sealed cookie
+type oidcSession struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+// oidcLogin is what we need to remember while someone logs in with the
+// provider
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+func newSiteOIDC(host, path string, conf *OIDCConfig) (*siteOIDC, error) {
+	u, err := url.Parse(conf.Issuer)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, errors.New("oidc needs an issuer url")
+	}
+	if conf.ClientID == "" {
+		return nil, errors.New("oidc needs a client_id")
+	}
+	if len(conf.AllowedEmails) == 0 && len(conf.AllowedDomains) == 0 && len(conf.AllowedGroups) == 0 {
+		return nil, errors.New("oidc needs allowed_emails, allowed_domains or allowed_groups, or anyone with an account could log in")
+	}
+	for i, e := range conf.AllowedEmails {
+		conf.AllowedEmails[i] = strings.ToLower(e)
+	}
+	for i, d := range conf.AllowedDomains {
+		conf.AllowedDomains[i] = strings.ToLower(strings.TrimPrefix(d, "@"))
+	}
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email", "profile"}
+	}
+	if conf.GroupsClaim == "" {
+		conf.GroupsClaim = "groups"
+	}
+	if conf.Session <= 0 {
+		conf.Session = duration(12 * time.Hour)
+	}
+
+	base := strings.TrimSuffix(path, "/") + "/"
+	if conf.RedirectURL != "" {
+		r, err := url.Parse(conf.RedirectURL)
+		if err != nil || r.Path != base+"oauth2/callback" {
+			return nil, fmt.Errorf("redirect_url has to be a url for %soauth2/callback", base)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(host + path))
+	return &siteOIDC{
+		host:     host,
+		conf:     conf,
+		cookie:   "henry.sites-oidc-" + hex.EncodeToString(sum[:4]),
+		callback: base + "oauth2/callback",
+		logout:   base + "oauth2/logout",
+	}, nil
+}
+
+// authorize lets r through with the identity of whoever's logged in,
+// otherwise it sends them off to log in. Returns nil when r has been
+// answered
+func (o *siteOIDC) authorize(w http.ResponseWriter, r *http.Request) *http.Request {
+	switch r.URL.Path {
+	case o.callback:
+		o.finishLogin(w, r)
+		return nil
+	case o.logout:
+		http.SetCookie(w, &http.Cookie{Name: o.cookie, Path: o.cookiePath(), MaxAge: -1, HttpOnly: true})
+		o.respond(w, r, http.StatusOK, "You've been logged out")
+		return nil
+	}
+
+	if s := o.session(r); s != nil {
+		who := s.identity()
+		if !o.allowed(s) {
+			o.respond(w, withAuthIdentity(r, "denied:"+who), http.StatusForbidden, s.Email+" isn't allowed here")
+			return nil
+		}
+		removeCookie(r, o.cookie)
+		setIdentityHeaders(r, s.Subject, s.Email, s.Name, s.Groups)
+		return withAuthIdentity(r, who)
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		o.respond(w, r, http.StatusUnauthorized, "You need to log in")
+		return nil
+	}
+	o.startLogin(w, r)
+	return nil
+}
+
+// cookiePath keeps our cookies to the route
+func (o *siteOIDC) cookiePath() string {
+	return strings.TrimSuffix(o.callback, "oauth2/callback")
+}
+
+func (o *siteOIDC) session(r *http.Request) *oidcSession {
+	c, err := r.Cookie(o.cookie)
+	if err != nil {
+		return nil
+	}
+	v, err := openCookie(o.cookie, c.Value)
+	if err != nil {
+		return nil
+	}
+	s := &oidcSession{}
+	if err := json.Unmarshal([]byte(v), s); err != nil {
+		return nil
+	}
+	return s
+}
+
+// identity is who s is in the access log
+func (s *oidcSession) identity() string {
+	if s.Email != "" {
+		return url.PathEscape(s.Email)
+	}
+	return url.PathEscape(s.Subject)
+}
+
+// allowed checks s against the allowed emails, domains and groups, it's
+// checked on every request so taking someone off works straight away
+func (o *siteOIDC) allowed(s *oidcSession) bool {
+	email := strings.ToLower(s.Email)
+	if email != "" {
+		for _, e := range o.conf.AllowedEmails {
+			if email == e {
+				return true
+			}
+		}
+		for _, d := range o.conf.AllowedDomains {
+			if strings.HasSuffix(email, "@"+d) {
+				return true
+			}
+		}
+	}
+	for _, want := range o.conf.AllowedGroups {
+		for _, g := range s.Groups {
+			if g == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redirectURL is where the provider sends people back to
+func (o *siteOIDC) redirectURL(r *http.Request) string {
+	if o.conf.RedirectURL != "" {
+		return o.conf.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + o.callback
+}
+
+// startLogin sends someone off to the provider, remembering where they
+// were going
+func (o *siteOIDC) startLogin(w http.ResponseWriter, r *http.Request) {
+	p, err := o.getProvider()
+	if err != nil {
+		log.Errorf("OIDC provider for %s: %v", o.host, err)
+		o.respond(w, r, http.StatusBadGateway, "Couldn't reach the login provider")
+		return
+	}
+
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Next:     r.URL.RequestURI(),
+	}
+	b, _ := json.Marshal(login)
+	value, err := sealCookie(o.cookie+"-login", string(b), time.Now().Add(oidcLoginTTL))
+	if err != nil {
+		log.Error(err)
+		o.respond(w, r, http.StatusInternalServerError, "Logging in needs a cookie secret")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     o.cookie + "-login",
+		Value:    value,
+		Path:     o.cookiePath(),
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.conf.ClientID},
+		"redirect_uri":          {o.redirectURL(r)},
+		"scope":                 {strings.Join(o.conf.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthEndpoint, "?") {
+		sep = "&"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, p.AuthEndpoint+sep+q.Encode(), http.StatusFound)
+	go logRequest(w, r, 0, http.StatusFound)
+}
+
+// finishLogin is where the provider sends people back to with a code we
+// swap for their identity
+func (o *siteOIDC) finishLogin(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	c, err := r.Cookie(o.cookie + "-login")
+	if err == nil {
+		var v string
+		if v, err = openCookie(o.cookie+"-login", c.Value); err == nil {
+			err = json.Unmarshal([]byte(v), &login)
+		}
+	}
+	q := r.URL.Query()
+	if err != nil || login.State == "" || q.Get("state") != login.State {
+		o.respond(w, r, http.StatusBadRequest, "That login has expired or wasn't started here, try again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: o.cookie + "-login", Path: o.cookiePath(), MaxAge: -1, HttpOnly: true})
+
+	if e := q.Get("error"); e != "" {
+		log.Warnf("OIDC login for %s failed: %s %s", o.host, e, q.Get("error_description"))
+		o.respond(w, r, http.StatusForbidden, "The login provider said: "+e)
+		return
+	}
+
+	p, err := o.getProvider()
+	if err != nil {
+		log.Errorf("OIDC provider for %s: %v", o.host, err)
+		o.respond(w, r, http.StatusBadGateway, "Couldn't reach the login provider")
+		return
+	}
+	s, err := o.exchange(r, p, q.Get("code"), login)
+	if err != nil {
+		log.Errorf("OIDC login for %s: %v", o.host, err)
+		o.respond(w, r, http.StatusBadGateway, "Couldn't finish logging in")
+		return
+	}
+	if !o.allowed(s) {
+		log.Warnf("OIDC login for %s by %s (%s) isn't allowed", o.host, s.Email, s.Subject)
+		o.respond(w, withAuthIdentity(r, "denied:"+s.identity()), http.StatusForbidden, s.Email+" isn't allowed here")
+		return
+	}
+
+	expires := time.Now().Add(time.Duration(o.conf.Session))
+	b, _ := json.Marshal(s)
+	value, err := sealCookie(o.cookie, string(b), expires)
+	if err == nil && len(value) > maxCookieSize && len(o.conf.AllowedGroups) > 0 {
+		// Some people are in a lot of groups, only keep the ones we care
+		// about
+		s.Groups = o.allowedGroups(s.Groups)
+		b, _ = json.Marshal(s)
+		value, err = sealCookie(o.cookie, string(b), expires)
+	}
+	if err != nil {
+		log.Error(err)
+		o.respond(w, r, http.StatusInternalServerError, "Logging in needs a cookie secret")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     o.cookie,
+		Value:    value,
+		Path:     o.cookiePath(),
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, safeNext(login.Next), http.StatusFound)
+	go logRequest(w, withAuthIdentity(r, s.identity()), 0, http.StatusFound)
+}
+
+func (o *siteOIDC) allowedGroups(groups []string) []string {
+	var keep []string
+	for _, g := range groups {
+		for _, want := range o.conf.AllowedGroups {
+			if g == want {
+				keep = append(keep, g)
+			}
+		}
+	}
+	return keep
+}
+
+// exchange swaps code for an id token and returns who it says logged in
+func (o *siteOIDC) exchange(r *http.Request, p *oidcProvider, code string, login oidcLogin) (*oidcSession, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.redirectURL(r)},
+		"client_id":     {o.conf.ClientID},
+		"code_verifier": {login.Verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.conf.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.conf.ClientID), url.QueryEscape(o.conf.ClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token endpoint returned %s: %v", resp.Status, err)
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", tok.Error, tok.Description)
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("token endpoint didn't return an id token")
+	}
+
+	claims, err := p.verify(tok.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	return o.checkClaims(p, claims, login.Nonce)
+}
+
+// checkClaims makes sure an id token is for us and this login, and turns
+// it into a session
+func (o *siteOIDC) checkClaims(p *oidcProvider, claims map[string]interface{}, nonce string) (*oidcSession, error) {
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, fmt.Errorf("id token is from %q, not %q", iss, p.Issuer)
+	}
+	forUs := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		forUs = aud == o.conf.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			forUs = forUs || a == o.conf.ClientID
+		}
+	}
+	if !forUs {
+		return nil, errors.New("id token isn't for our client id")
+	}
+	// A minute either way for clocks being off
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); !ok || exp < now-60 {
+		return nil, errors.New("id token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && iat > now+60 {
+		return nil, errors.New("id token was issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("id token is for a different login")
+	}
+
+	s := &oidcSession{}
+	s.Subject, _ = claims["sub"].(string)
+	if s.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	// An email the provider hasn't said it checked could be anyone's
+	if verified, ok := claims["email_verified"].(bool); ok && verified {
+		s.Email, _ = claims["email"].(string)
+	}
+	if s.Name, _ = claims["preferred_username"].(string); s.Name == "" {
+		s.Name, _ = claims["name"].(string)
+	}
+	switch groups := claims[o.conf.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				s.Groups = append(s.Groups, g)
+			}
+		}
+	case string:
+		s.Groups = strings.Fields(groups)
+	}
+	return s, nil
+}
+
+// respond answers r with a short message
+func (o *siteOIDC) respond(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	n, _ := io.WriteString(w, msg+"\n")
+	go logRequest(w, r, int64(n), code)
+}
+
+// getProvider returns the provider's configuration, fetching it if we
+// haven't yet
+func (o *siteOIDC) getProvider() (*oidcProvider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+
+	resp, err := oidcClient.Get(strings.TrimSuffix(o.conf.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+	p := &oidcProvider{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(p); err != nil {
+		return nil, err
+	}
+	if p.Issuer != o.conf.Issuer {
+		return nil, fmt.Errorf("the provider says its issuer is %q, not %q", p.Issuer, o.conf.Issuer)
+	}
+	if p.AuthEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, errors.New("the provider's configuration is missing endpoints")
+	}
+	o.provider = p
+	return p, nil
+}
+
+// verify checks the signature on an id token and returns its claims
+func (p *oidcProvider) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token isn't a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := p.signingKeys(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	ok := false
+	for _, key := range keys {
+		if verifyJWS(header.Alg, key, signed, sig) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("id token signature (%s) doesn't check out", header.Alg)
+	}
+
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// signingKeys returns the provider's key with id kid, or all of them
+// without one. The keys are fetched again when kid is new to us, providers
+// rotate them, but not more than once a minute
+func (p *oidcProvider) signingKeys(kid string) ([]crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, known := p.keys[kid]
+	if p.keys == nil || (kid != "" && !known && time.Since(p.keysFetched) > time.Minute) {
+		keys, err := fetchJWKS(p.JWKSURI)
+		if err != nil {
+			return nil, err
+		}
+		p.keys, p.keysFetched = keys, time.Now()
+	}
+
+	if kid != "" {
+		if key, ok := p.keys[kid]; ok {
+			return []crypto.PublicKey{key}, nil
+		}
+		return nil, fmt.Errorf("the provider has no key %q", kid)
+	}
+	var all []crypto.PublicKey
+	for _, key := range p.keys {
+		all = append(all, key)
+	}
+	return all, nil
+}
+
+func fetchJWKS(uri string) (map[string]crypto.PublicKey, error) {
+	resp, err := oidcClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks returned %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		id := k.Kid
+		if id == "" {
+			id = fmt.Sprintf("#%d", i)
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(k.N)
+		e, _ := base64.RawURLEncoding.DecodeString(k.E)
+		x, _ := base64.RawURLEncoding.DecodeString(k.X)
+		y, _ := base64.RawURLEncoding.DecodeString(k.Y)
+
+		switch {
+		case k.Kty == "RSA" && len(n) > 0 && len(e) > 0:
+			keys[id] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			if !ok {
+				continue
+			}
+			size := (curve.Params().BitSize + 7) / 8
+			if len(x) != size || len(y) != size {
+				continue
+			}
+			key, err := ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+			if err != nil {
+				continue
+			}
+			keys[id] = key
+		case k.Kty == "OKP" && k.Crv == "Ed25519" && len(x) == ed25519.PublicKeySize:
+			keys[id] = ed25519.PublicKey(x)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the provider has no keys we can use")
+	}
+	return keys, nil
+}
+
+// verifyJWS checks sig over signed with key, for the algorithms providers
+// sign id tokens with. Never none or HMAC, the secret for those is ours
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	if k, ok := key.(ed25519.PublicKey); ok {
+		return alg == "EdDSA" && ed25519.Verify(k, signed, sig)
+	}
+
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 {
+		return false
+	}
+	h, ok := hashes[alg[2:]]
+	if !ok {
+		return false
+	}
+	hh := h.New()
+	hh.Write(signed)
+	digest := hh.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, h, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(k, h, digest, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// randomToken is 128 random bits for states, nonces and the like
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
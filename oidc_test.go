@@ -0,0 +1,327 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is just enough of an OpenID Connect provider to log in
+// with, it hands out a code for whatever claims the test wants
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]interface{}
+	codes  map[string]mockCode
+}
+
+type mockCode struct {
+	nonce     string
+	challenge string
+	redirect  string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, codes: map[string]mockCode{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		p.mu.Lock()
+		c, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		claims := map[string]interface{}{}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		p.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		switch {
+		case user != "client" || pass != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		case !ok || r.FormValue("redirect_uri") != c.redirect || base64.RawURLEncoding.EncodeToString(verifier[:]) != c.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims["nonce"] = c.nonce
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, claims)})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// sign makes an RS256 id token
+func (p *mockProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// login plays the browser and the provider's login page, following the
+// redirect to the provider and back. It returns the callback's response
+func (p *mockProvider) login(t *testing.T, o *siteOIDC, path string, claims map[string]interface{}) *http.Response {
+	w := httptest.NewRecorder()
+	if r := o.authorize(w, httptest.NewRequest("GET", "http://site.test"+path, nil)); r != nil {
+		t.Fatal("let in without logging in")
+	}
+	resp := w.Result()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("starting the login got %d, want 302", resp.StatusCode)
+	}
+	to, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(to.String(), p.URL+"/authorize?") {
+		t.Fatalf("sent to %q, not the provider", resp.Header.Get("Location"))
+	}
+	q := to.Query()
+	if q.Get("client_id") != "client" || q.Get("code_challenge_method") != "S256" || q.Get("redirect_uri") != "http://site.test/oauth2/callback" {
+		t.Fatalf("bad authorization request %s", to.RawQuery)
+	}
+
+	code := randomToken()
+	p.mu.Lock()
+	p.claims = claims
+	p.codes[code] = mockCode{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirect: q.Get("redirect_uri")}
+	p.mu.Unlock()
+
+	back := httptest.NewRequest("GET", q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), nil)
+	for _, c := range resp.Cookies() {
+		back.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	o.authorize(w, back)
+	return w.Result()
+}
+
+func newTestOIDC(t *testing.T, p *mockProvider, conf *OIDCConfig) *siteOIDC {
+	setTestConfig(t, &Config{CookieSecret: "a secret just for the tests"})
+	conf.Issuer, conf.ClientID, conf.ClientSecret = p.URL, "client", "secret"
+	o, err := newSiteOIDC("site.test", "/", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newMockProvider(t)
+	o := newTestOIDC(t, p, &OIDCConfig{AllowedDomains: []string{"example.com"}})
+
+	resp := p.login(t, o, "/private?page=2", map[string]interface{}{
+		"iss":            p.URL,
+		"aud":            "client",
+		"sub":            "1234",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+		"groups":         []string{"staff"},
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+	})
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/private?page=2" {
+		t.Fatalf("callback got %d to %q, want 302 back to /private?page=2", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == o.cookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no session cookie")
+	}
+
+	r := httptest.NewRequest("GET", "http://site.test/private", nil)
+	r.Header.Set("X-Forwarded-Email", "mallory@example.com")
+	stripIdentityHeaders(r)
+	r.AddCookie(session)
+	r.AddCookie(&http.Cookie{Name: "other", Value: "kept"})
+	w := httptest.NewRecorder()
+	r = o.authorize(w, r)
+	if r == nil {
+		t.Fatalf("logged in but turned away with %d", w.Code)
+	}
+	if got := authIdentity(r); got != "alice@example.com" {
+		t.Errorf("identity is %q, want alice@example.com", got)
+	}
+	for h, want := range map[string]string{
+		"X-Forwarded-User":               "1234",
+		"X-Forwarded-Email":              "alice@example.com",
+		"X-Forwarded-Preferred-Username": "Alice",
+		"X-Forwarded-Groups":             "staff",
+	} {
+		if got := r.Header.Get(h); got != want {
+			t.Errorf("%s is %q, want %q", h, got, want)
+		}
+	}
+	if _, err := r.Cookie(o.cookie); err == nil {
+		t.Error("the session cookie was passed on")
+	}
+	if c, err := r.Cookie("other"); err != nil || c.Value != "kept" {
+		t.Error("other cookies weren't passed on")
+	}
+
+	// Logging out drops the cookie
+	w = httptest.NewRecorder()
+	o.authorize(w, httptest.NewRequest("GET", "http://site.test/oauth2/logout", nil))
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Name != o.cookie || c[0].MaxAge >= 0 {
+		t.Errorf("logging out set %v", c)
+	}
+}
+
+func TestOIDCLoginDenied(t *testing.T) {
+	p := newMockProvider(t)
+	o := newTestOIDC(t, p, &OIDCConfig{AllowedEmails: []string{"alice@example.com"}, AllowedGroups: []string{"admins"}})
+
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss":            p.URL,
+			"aud":            "client",
+			"sub":            "1234",
+			"email":          "alice@example.com",
+			"email_verified": true,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		code   int
+	}{
+		{"allowed", valid(nil), http.StatusFound},
+		{"allowed group", valid(map[string]interface{}{"email": "bob@example.com", "groups": []string{"admins"}}), http.StatusFound},
+		{"other email", valid(map[string]interface{}{"email": "bob@example.com"}), http.StatusForbidden},
+		{"unverified email", valid(map[string]interface{}{"email_verified": false}), http.StatusForbidden},
+		{"no email_verified", valid(map[string]interface{}{"email_verified": nil}), http.StatusForbidden},
+		{"other audience", valid(map[string]interface{}{"aud": "someone-else"}), http.StatusBadGateway},
+		{"audience list", valid(map[string]interface{}{"aud": []string{"someone-else", "client"}}), http.StatusFound},
+		{"other issuer", valid(map[string]interface{}{"iss": "https://evil.test"}), http.StatusBadGateway},
+		{"expired", valid(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), http.StatusBadGateway},
+		{"from the future", valid(map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()}), http.StatusBadGateway},
+		{"no subject", valid(map[string]interface{}{"sub": nil}), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := p.login(t, o, "/", tt.claims); resp.StatusCode != tt.code {
+				t.Errorf("got %d, want %d", resp.StatusCode, tt.code)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	p := newMockProvider(t)
+	o := newTestOIDC(t, p, &OIDCConfig{AllowedDomains: []string{"example.com"}})
+
+	w := httptest.NewRecorder()
+	o.authorize(w, httptest.NewRequest("GET", "http://site.test/", nil))
+	login := w.Result().Cookies()
+
+	tests := []struct {
+		name    string
+		query   string
+		cookies []*http.Cookie
+	}{
+		{"no login cookie", "code=x&state=y", nil},
+		{"wrong state", "code=x&state=y", login},
+		{"forged cookie", "code=x&state=y", []*http.Cookie{{Name: o.cookie + "-login", Value: "bm90IHNlYWxlZA"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://site.test/oauth2/callback?"+tt.query, nil)
+			for _, c := range tt.cookies {
+				r.AddCookie(c)
+			}
+			w := httptest.NewRecorder()
+			o.authorize(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestOIDCOnlyGetStartsLogin(t *testing.T) {
+	p := newMockProvider(t)
+	o := newTestOIDC(t, p, &OIDCConfig{AllowedDomains: []string{"example.com"}})
+
+	w := httptest.NewRecorder()
+	if o.authorize(w, httptest.NewRequest("POST", "http://site.test/form", nil)) != nil || w.Code != http.StatusUnauthorized {
+		t.Errorf("POST without a session got %d, want 401", w.Code)
+	}
+}
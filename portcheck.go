@@ -0,0 +1,139 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ifcfg's /port/<n> tries connecting back to the client on port n, to see
+// if it's reachable from the internet. It only ever connects to the ip the
+// request came from
+
+const (
+	portCheckTimeout = 3 * time.Second
+	// The most checks running at once, across everyone
+	portCheckConcurrency = 64
+)
+
+var (
+	// 5 checks, then one every 10 seconds, for an IP or IPv6 /64
+	portCheckLimiter = newRateLimiter(0.1, 5)
+	portCheckSlots   = make(chan struct{}, portCheckConcurrency)
+)
+
+// ifcfgPortCheck is the result of checking a port
+type ifcfgPortCheck struct {
+	XMLName xml.Name `json:"-" xml:"portcheck"`
+	IP      string   `json:"ip" xml:"ip"`
+	Port    int      `json:"port" xml:"port"`
+	State   string   `json:"state" xml:"state"`
+	// How long it took to connect, or to be refused, in milliseconds
+	Time float64 `json:"time_ms" xml:"time_ms"`
+}
+
+// portCheckDenied says whether port is on -portcheck-deny
+func portCheckDenied(port int) bool {
+	for _, s := range strings.Split(*portCheckDeny, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && n == port {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPort connects to ip on port, and says whether it's open, closed, as
+// in something said no, or filtered, as in nothing said anything
+func checkPort(ip string, port int) (string, time.Duration) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), portCheckTimeout)
+	took := time.Since(start)
+	if err == nil {
+		conn.Close()
+		return "open", took
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "closed", took
+	}
+	return "filtered", took
+}
+
+func ifcfgPortCheckHandler(w http.ResponseWriter, r *http.Request) {
+	format := ifcfgFormat(r)
+	if format == "" {
+		format = "text"
+	}
+	ip := GetIP(r)
+	fail := func(code int, msg string) {
+		ifcfgRespondCode(w, r, code, format, ifcfgError{Error: msg, IP: ip, IPVersion: ipVersion(ip)}, msg+"\n")
+	}
+
+	port, err := strconv.Atoi(mux.Vars(r)["port"])
+	if err != nil || port < 1 || port > 65535 {
+		fail(http.StatusBadRequest, "The port has to be between 1 and 65535")
+		return
+	}
+	if portCheckDenied(port) {
+		fail(http.StatusForbidden, fmt.Sprintf("Port %d can't be checked", port))
+		return
+	}
+	// Behind a proxy everyone is loopback, and we'd be checking ourselves
+	if parsed := net.ParseIP(ip); parsed == nil || (parsed.IsLoopback() && !*devMode) ||
+		parsed.IsUnspecified() || parsed.IsMulticast() {
+		fail(http.StatusForbidden, "Your address can't be checked")
+		return
+	}
+
+	if ok, wait := portCheckLimiter.take(clientKey64(ip)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		fail(http.StatusTooManyRequests, "Too many checks, try again in a little while")
+		return
+	}
+	select {
+	case portCheckSlots <- struct{}{}:
+		defer func() { <-portCheckSlots }()
+	default:
+		w.Header().Set("Retry-After", "5")
+		fail(http.StatusServiceUnavailable, "Too many checks running, try again in a little while")
+		return
+	}
+
+	state, took := checkPort(ip, port)
+	portChecks.inc(state)
+
+	result := ifcfgPortCheck{
+		IP:    ip,
+		Port:  port,
+		State: state,
+		Time:  math.Round(took.Seconds()*1e5) / 100,
+	}
+	ifcfgRespond(w, r, format, result, state+"\n")
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyConfig is where a proxy route sends its requests
+type ProxyConfig struct {
+	// Backends, http://host:port, https://host:port or unix:/path/to.sock
+	Upstreams []string `json:"upstreams"`
+	// Take the route's path off the front before passing requests on
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+	// Pass on the Host the client asked for, instead of the upstream's.
+	// Always on for unix sockets
+	PreserveHost bool `json:"preserve_host,omitempty"`
+	// Headers to set on requests to the upstream and on the responses sent
+	// back, an empty value removes the header
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	// How to pick an upstream, round_robin (the default), least_conn or
+	// ip_hash, which keeps each client on the same upstream
+	LoadBalancing string             `json:"load_balancing,omitempty"`
+	HealthCheck   *HealthCheckConfig `json:"health_check,omitempty"`
+	// Take an upstream out for fail_timeout after this many errors in a
+	// row, never when 0
+	MaxFails    int      `json:"max_fails,omitempty"`
+	FailTimeout duration `json:"fail_timeout,omitempty"`
+	// How many other upstreams to try when one can't be reached, for
+	// requests that are safe to send again
+	Retries int `json:"retries,omitempty"`
+	// Cache the responses upstreams say can be cached
+	Cache *ProxyCacheConfig `json:"cache,omitempty"`
+}
+
+// siteProxy serves a proxy route, balancing requests between its upstreams
+type siteProxy struct {
+	host      string
+	path      string
+	conf      *ProxyConfig
+	upstreams []*proxyUpstream
+	byHost    map[string]*proxyUpstream
+	next      uint32
+	proxy     *httputil.ReverseProxy
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+}
+
+type proxyStateKey struct{}
+
+// proxyState is what RoundTrip needs to send a request to another upstream
+type proxyState struct {
+	ip   string
+	url  *url.URL
+	host string
+}
+
+func newSiteProxy(host, path string, conf *ProxyConfig) (*siteProxy, error) {
+	if len(conf.Upstreams) == 0 {
+		return nil, errors.New("proxy needs at least one upstream")
+	}
+	p := &siteProxy{
+		host:   host,
+		path:   path,
+		conf:   conf,
+		byHost: map[string]*proxyUpstream{},
+		stop:   make(chan struct{}),
+	}
+	switch conf.LoadBalancing {
+	case "", "round_robin", "least_conn", "ip_hash":
+	default:
+		return nil, fmt.Errorf("unknown load_balancing %q, use round_robin, least_conn or ip_hash", conf.LoadBalancing)
+	}
+	if conf.MaxFails < 0 || conf.Retries < 0 {
+		return nil, errors.New("max_fails and retries can't be negative")
+	}
+	if conf.MaxFails > 0 && conf.FailTimeout <= 0 {
+		conf.FailTimeout = duration(30 * time.Second)
+	}
+	if err := conf.HealthCheck.compile(); err != nil {
+		return nil, err
+	}
+	if err := conf.Cache.compile(); err != nil {
+		return nil, err
+	}
+	for i, raw := range conf.Upstreams {
+		u, err := newProxyUpstream(i, raw)
+		if err != nil {
+			return nil, err
+		}
+		if p.byHost[u.target.Host] != nil {
+			return nil, fmt.Errorf("upstream %q is there twice", raw)
+		}
+		p.upstreams = append(p.upstreams, u)
+		p.byHost[u.target.Host] = u
+	}
+
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      p,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.errorHandler,
+		ErrorLog:       newServerErrorLog(),
+	}
+	return p, nil
+}
+
+func (p *siteProxy) rewrite(pr *httputil.ProxyRequest) {
+	state := &proxyState{ip: GetIP(pr.In), host: pr.In.Host}
+	if p.conf.StripPrefix {
+		prefix := strings.TrimSuffix(p.path, "/")
+		pr.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(pr.Out.URL.Path, prefix), "/")
+		pr.Out.URL.RawPath = ""
+	}
+	u := *pr.Out.URL
+	state.url = &u
+
+	pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), proxyStateKey{}, state))
+	p.direct(pr.Out, state, p.pick(state.ip, nil))
+
+	pr.SetXForwarded()
+	pr.Out.Header.Set("X-Real-IP", GetIP(pr.In))
+	for k, v := range p.conf.RequestHeaders {
+		if v == "" {
+			pr.Out.Header.Del(k)
+		} else {
+			pr.Out.Header.Set(k, v)
+		}
+	}
+}
+
+// direct points out at u
+func (p *siteProxy) direct(out *http.Request, state *proxyState, u *proxyUpstream) {
+	target := *state.url
+	out.URL = &target
+	(&httputil.ProxyRequest{Out: out}).SetURL(u.target)
+	if p.conf.PreserveHost || u.unix {
+		out.Host = state.host
+	}
+}
+
+// RoundTrip sends req to the upstream rewrite picked, trying others if it
+// can't be reached and the request can be sent again
+func (p *siteProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := p.byHost[req.URL.Host]
+	state, _ := req.Context().Value(proxyStateKey{}).(*proxyState)
+	if u == nil || state == nil {
+		return nil, fmt.Errorf("no upstream for %s", req.URL.Host)
+	}
+
+	tried := map[*proxyUpstream]bool{}
+	for {
+		tried[u] = true
+		resp, err := u.roundTrip(req, p.conf)
+		if err == nil || len(tried) > p.conf.Retries || !retryable(req) || req.Context().Err() != nil {
+			return resp, err
+		}
+		next := p.pick(state.ip, tried)
+		if next == nil {
+			return nil, err
+		}
+		log.Warnf("Retrying %s%s on %s: %v", state.host, state.url.Path, next.name, err)
+		proxyRequests.inc(u.name, "retried")
+
+		req = req.Clone(req.Context())
+		p.direct(req, state, next)
+		u = next
+	}
+}
+
+// retryable is whether req can be sent again without anything happening
+// twice
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (p *siteProxy) modifyResponse(resp *http.Response) error {
+	for k, v := range p.conf.ResponseHeaders {
+		if v == "" {
+			resp.Header.Del(k)
+		} else {
+			resp.Header.Set(k, v)
+		}
+	}
+	return nil
+}
+
+func (p *siteProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		// The client went away
+		w.WriteHeader(499)
+		return
+	}
+	log.Warnf("Proxying %s%s: %v", r.Host, r.URL.Path, err)
+	code := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = http.StatusGatewayTimeout
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+func (p *siteProxy) serveSite(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	rec := &statusRecorder{ResponseWriter: w}
+	rc := http.NewResponseController(w)
+	if r.Header.Get("Upgrade") != "" {
+		// Upgraded connections can go on for as long as either end likes
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	} else {
+		rc.SetReadDeadline(time.Now().Add(proxyReadTimeout))
+		rc.SetWriteDeadline(time.Now().Add(proxyWriteTimeout))
+	}
+
+	dw := &deadlineWriter{statusRecorder: rec, rc: rc}
+	if p.conf.Cache != nil && proxyCache != nil {
+		proxyCache.serve(dw, r, p.conf.Cache, p.proxy)
+	} else {
+		p.proxy.ServeHTTP(dw, r)
+	}
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	go logRequest(rec, r, rec.bytes, rec.code)
+}
+
+// How long a proxied request's body has to arrive, and how long a proxied
+// response can go without anything being sent
+const (
+	proxyReadTimeout  = 5 * time.Minute
+	proxyWriteTimeout = time.Minute
+)
+
+// deadlineWriter keeps pushing the write deadline back while a proxied
+// response is sent, so a big one can take as long as it needs but a client
+// that stops reading is let go. Event streams can be quiet for a long
+// time, so they don't get one
+type deadlineWriter struct {
+	*statusRecorder
+	rc     *http.ResponseController
+	stream bool
+}
+
+func (d *deadlineWriter) WriteHeader(code int) {
+	if !d.stream && code >= 200 && strings.HasPrefix(d.Header().Get("Content-Type"), "text/event-stream") {
+		d.stream = true
+		d.rc.SetWriteDeadline(time.Time{})
+	}
+	d.statusRecorder.WriteHeader(code)
+}
+
+func (d *deadlineWriter) Write(b []byte) (int, error) {
+	if d.code == 0 {
+		d.WriteHeader(http.StatusOK)
+	}
+	if !d.stream {
+		d.rc.SetWriteDeadline(time.Now().Add(proxyWriteTimeout))
+	}
+	return d.statusRecorder.Write(b)
+}
+
+// open starts the health checks, if there are any
+func (p *siteProxy) open() {
+	if p.conf.HealthCheck == nil {
+		return
+	}
+	p.startOnce.Do(func() {
+		go p.healthChecks()
+	})
+}
+
+func (p *siteProxy) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	for _, u := range p.upstreams {
+		u.transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBackend is an upstream which answers with what it was sent
+type testBackend struct {
+	*httptest.Server
+	name   string
+	hits   int32
+	status int32
+}
+
+type testBackendSeen struct {
+	Backend string            `json:"backend"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Query   string            `json:"query"`
+	Host    string            `json:"host"`
+	Header  map[string]string `json:"header"`
+}
+
+func newTestBackend(t *testing.T, name string) *testBackend {
+	b := &testBackend{name: name, status: http.StatusOK}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&b.hits, 1)
+		seen := testBackendSeen{Backend: name, Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Host: r.Host, Header: map[string]string{}}
+		for k := range r.Header {
+			seen.Header[k] = r.Header.Get(k)
+		}
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Backend", name)
+		w.WriteHeader(int(atomic.LoadInt32(&b.status)))
+		json.NewEncoder(w).Encode(seen)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *testBackend) count() int {
+	return int(atomic.LoadInt32(&b.hits))
+}
+
+// deadUpstream is an address nothing listens on
+func deadUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "http://" + l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func newTestProxy(t *testing.T, path string, conf *ProxyConfig) *siteProxy {
+	p, err := newSiteProxy("proxy.test", path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.close)
+	return p
+}
+
+// proxyGet sends a request through p, returning the response and what the
+// backend saw, if it got that far
+func proxyGet(t *testing.T, p *siteProxy, method, target string, header ...string) (*httptest.ResponseRecorder, *testBackendSeen) {
+	var body *strings.Reader
+	if method == "POST" {
+		body = strings.NewReader("posted")
+	}
+	r := httptest.NewRequest(method, target, nil)
+	if body != nil {
+		r = httptest.NewRequest(method, target, body)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	p.proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	seen := &testBackendSeen{}
+	if err := json.Unmarshal(w.Body.Bytes(), seen); err != nil {
+		t.Fatalf("%s: %q", err, w.Body.String())
+	}
+	return w, seen
+}
+
+func TestNewSiteProxyErrors(t *testing.T) {
+	for _, conf := range []*ProxyConfig{
+		{},
+		{Upstreams: []string{"http://127.0.0.1:1"}, LoadBalancing: "random"},
+		{Upstreams: []string{"http://127.0.0.1:1"}, Retries: -1},
+		{Upstreams: []string{"http://127.0.0.1:1", "http://127.0.0.1:1"}},
+		{Upstreams: []string{"ftp://127.0.0.1:1"}},
+		{Upstreams: []string{"127.0.0.1:1"}},
+		{Upstreams: []string{"http://127.0.0.1:1/?a=b"}},
+		{Upstreams: []string{"unix:"}},
+		{Upstreams: []string{"http://127.0.0.1:1"}, HealthCheck: &HealthCheckConfig{Path: "health"}},
+	} {
+		if _, err := newSiteProxy("proxy.test", "/", conf); err == nil {
+			t.Errorf("%+v got no error", conf)
+		}
+	}
+}
+
+func TestProxyRewrite(t *testing.T) {
+	b := newTestBackend(t, "a")
+	backendHost := strings.TrimPrefix(b.URL, "http://")
+
+	tests := []struct {
+		name   string
+		path   string
+		conf   ProxyConfig
+		target string
+		header []string
+		want   testBackendSeen
+	}{
+		{"as is", "/app/", ProxyConfig{}, "http://proxy.test/app/x?y=1", nil,
+			testBackendSeen{Path: "/app/x", Query: "y=1", Host: backendHost}},
+		{"strip prefix", "/app/", ProxyConfig{StripPrefix: true}, "http://proxy.test/app/x/z?y=1", nil,
+			testBackendSeen{Path: "/x/z", Query: "y=1", Host: backendHost}},
+		{"strip prefix to the root", "/app/", ProxyConfig{StripPrefix: true}, "http://proxy.test/app", nil,
+			testBackendSeen{Path: "/", Host: backendHost}},
+		{"strip the root", "/", ProxyConfig{StripPrefix: true}, "http://proxy.test/x", nil,
+			testBackendSeen{Path: "/x", Host: backendHost}},
+		{"preserve host", "/", ProxyConfig{PreserveHost: true}, "http://proxy.test/", nil,
+			testBackendSeen{Path: "/", Host: "proxy.test"}},
+		{"forwarded", "/", ProxyConfig{}, "http://proxy.test/", []string{"X-Forwarded-For", "203.0.113.9", "X-Real-IP", "203.0.113.9"},
+			testBackendSeen{Path: "/", Host: backendHost, Header: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Host":  "proxy.test",
+				"X-Forwarded-Proto": "http",
+				"X-Real-Ip":         "192.0.2.1",
+			}}},
+		{"request headers", "/", ProxyConfig{RequestHeaders: map[string]string{"X-Added": "yes", "Cookie": ""}}, "http://proxy.test/", []string{"Cookie", "a=b", "X-Added", "no"},
+			testBackendSeen{Path: "/", Host: backendHost, Header: map[string]string{"X-Added": "yes", "Cookie": ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			conf.Upstreams = []string{b.URL}
+			p := newTestProxy(t, tt.path, &conf)
+			_, seen := proxyGet(t, p, "GET", tt.target, tt.header...)
+			if seen == nil {
+				t.Fatal("didn't get to the backend")
+			}
+			if seen.Path != tt.want.Path || seen.Query != tt.want.Query || seen.Host != tt.want.Host {
+				t.Errorf("got %s?%s for %s, want %s?%s for %s", seen.Path, seen.Query, seen.Host, tt.want.Path, tt.want.Query, tt.want.Host)
+			}
+			for k, v := range tt.want.Header {
+				if seen.Header[k] != v {
+					t.Errorf("%s is %q, want %q", k, seen.Header[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyResponseHeaders(t *testing.T) {
+	b := newTestBackend(t, "a")
+	p := newTestProxy(t, "/", &ProxyConfig{Upstreams: []string{b.URL}, ResponseHeaders: map[string]string{"Server": "", "X-Frame-Options": "DENY"}})
+	w, _ := proxyGet(t, p, "GET", "http://proxy.test/")
+	if w.Header().Get("Server") != "" || w.Header().Get("X-Frame-Options") != "DENY" || w.Header().Get("X-Backend") != "a" {
+		t.Errorf("got %v", w.Header())
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		method string
+		body   bool
+		want   bool
+	}{
+		{"GET", false, true},
+		{"HEAD", false, true},
+		{"OPTIONS", false, true},
+		{"PUT", false, true},
+		{"DELETE", false, true},
+		{"PUT", true, false},
+		{"POST", false, false},
+		{"PATCH", false, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://proxy.test/", nil)
+		if tt.body {
+			r = httptest.NewRequest(tt.method, "http://proxy.test/", strings.NewReader("x"))
+		}
+		if got := retryable(r); got != tt.want {
+			t.Errorf("%s with a body %v got %v", tt.method, tt.body, got)
+		}
+	}
+}
+
+func TestProxyRetries(t *testing.T) {
+	live := newTestBackend(t, "live")
+
+	tests := []struct {
+		name      string
+		upstreams []string
+		retries   int
+		method    string
+		code      int
+	}{
+		{"retried", []string{deadUpstream(t), live.URL}, 1, "GET", 200},
+		{"no retries", []string{deadUpstream(t), live.URL}, 0, "GET", 502},
+		{"not for posts", []string{deadUpstream(t), live.URL}, 1, "POST", 502},
+		{"everything's down", []string{deadUpstream(t), deadUpstream(t), deadUpstream(t)}, 5, "GET", 502},
+		{"enough retries", []string{deadUpstream(t), deadUpstream(t), live.URL}, 2, "GET", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Round robin starts with the first, which is always dead
+			p := newTestProxy(t, "/", &ProxyConfig{Upstreams: tt.upstreams, Retries: tt.retries})
+			w, seen := proxyGet(t, p, tt.method, "http://proxy.test/")
+			if w.Code != tt.code {
+				t.Fatalf("got %d: %s", w.Code, w.Body.String())
+			}
+			if seen != nil && seen.Backend != "live" {
+				t.Errorf("got to %s", seen.Backend)
+			}
+		})
+	}
+}
+
+// Each upstream is tried once at most, and no more than retries others
+func TestProxyRetriesTried(t *testing.T) {
+	for _, tt := range []struct{ retries, tries int }{{0, 1}, {1, 2}, {2, 3}, {5, 3}} {
+		p := newTestProxy(t, "/", &ProxyConfig{Upstreams: []string{deadUpstream(t), deadUpstream(t), deadUpstream(t)}, Retries: tt.retries})
+		if w, _ := proxyGet(t, p, "GET", "http://proxy.test/"); w.Code != http.StatusBadGateway {
+			t.Errorf("got %d", w.Code)
+		}
+		tries := 0
+		for _, u := range p.upstreams {
+			if u.fails > 1 {
+				t.Errorf("%s was tried %d times", u.name, u.fails)
+			}
+			tries += u.fails
+		}
+		if tries != tt.tries {
+			t.Errorf("%d retries made %d tries, want %d", tt.retries, tries, tt.tries)
+		}
+	}
+}
+
+func TestProxyMaxFails(t *testing.T) {
+	live := newTestBackend(t, "live")
+	dead := deadUpstream(t)
+	p := newTestProxy(t, "/", &ProxyConfig{Upstreams: []string{dead, live.URL}, Retries: 1, MaxFails: 1, FailTimeout: duration(time.Minute)})
+
+	if w, _ := proxyGet(t, p, "GET", "http://proxy.test/"); w.Code != 200 {
+		t.Fatalf("got %d", w.Code)
+	}
+	if p.upstreams[0].available(time.Now()) {
+		t.Fatal("the dead upstream wasn't taken out")
+	}
+	if !p.upstreams[0].available(time.Now().Add(2 * time.Minute)) {
+		t.Error("the dead upstream isn't back after fail_timeout")
+	}
+
+	// Without retries, everything still works as it's left out
+	p.conf.Retries = 0
+	for i := 0; i < 4; i++ {
+		if w, _ := proxyGet(t, p, "GET", "http://proxy.test/"); w.Code != 200 {
+			t.Errorf("%d got %d", i, w.Code)
+		}
+	}
+	if live.count() != 5 {
+		t.Errorf("the live upstream got %d", live.count())
+	}
+}
+
+func testPickProxy(t *testing.T, balancing string, n int) *siteProxy {
+	var upstreams []string
+	for i := 0; i < n; i++ {
+		upstreams = append(upstreams, fmt.Sprintf("http://127.0.0.%d:80", i+1))
+	}
+	return newTestProxy(t, "/", &ProxyConfig{Upstreams: upstreams, LoadBalancing: balancing})
+}
+
+func TestPickRoundRobin(t *testing.T) {
+	p := testPickProxy(t, "round_robin", 3)
+	a, b, c := p.upstreams[0], p.upstreams[1], p.upstreams[2]
+
+	var got []*proxyUpstream
+	for i := 0; i < 4; i++ {
+		got = append(got, p.pick("", nil))
+	}
+	if got[0] != a || got[1] != b || got[2] != c || got[3] != a {
+		t.Errorf("didn't go round: %v", got)
+	}
+
+	if u := p.pick("", map[*proxyUpstream]bool{a: true, b: true}); u != c {
+		t.Errorf("got %v, want the one not tried", u)
+	}
+	if u := p.pick("", map[*proxyUpstream]bool{a: true, b: true, c: true}); u != nil {
+		t.Errorf("got %v with them all tried", u)
+	}
+
+	b.down = true
+	for i := 0; i < 4; i++ {
+		if u := p.pick("", nil); u == b {
+			t.Error("picked the one that's down")
+		}
+	}
+	a.down, c.down = true, true
+	if u := p.pick("", nil); u == nil {
+		t.Error("picked nothing with them all down, it should try one anyway")
+	}
+}
+
+func TestPickLeastConn(t *testing.T) {
+	p := testPickProxy(t, "least_conn", 3)
+	a, b, c := p.upstreams[0], p.upstreams[1], p.upstreams[2]
+	a.active, b.active, c.active = 5, 1, 3
+
+	for i := 0; i < 3; i++ {
+		if u := p.pick("", nil); u != b {
+			t.Errorf("got %s, want the one with the fewest", u.name)
+		}
+	}
+	if u := p.pick("", map[*proxyUpstream]bool{b: true}); u != c {
+		t.Errorf("got %s with the least busy tried", u.name)
+	}
+
+	// Ties are spread out
+	b.active = 3
+	seen := map[*proxyUpstream]bool{}
+	for i := 0; i < 6; i++ {
+		seen[p.pick("", nil)] = true
+	}
+	if len(seen) != 2 || seen[a] {
+		t.Errorf("ties went to %d upstreams", len(seen))
+	}
+}
+
+func TestPickIPHash(t *testing.T) {
+	p := testPickProxy(t, "ip_hash", 4)
+
+	before := map[string]*proxyUpstream{}
+	used := map[*proxyUpstream]bool{}
+	for i := 0; i < 100; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		before[ip] = p.pick(ip, nil)
+		used[before[ip]] = true
+		if again := p.pick(ip, nil); again != before[ip] {
+			t.Fatalf("%s moved from %s to %s", ip, before[ip].name, again.name)
+		}
+	}
+	if len(used) != 4 {
+		t.Errorf("only %d upstreams were used", len(used))
+	}
+
+	// Only the clients of the one that went down move
+	gone := p.upstreams[1]
+	gone.down = true
+	for ip, u := range before {
+		after := p.pick(ip, nil)
+		if u == gone && after == gone {
+			t.Errorf("%s stayed on the upstream that's down", ip)
+		}
+		if u != gone && after != u {
+			t.Errorf("%s moved from %s to %s", ip, u.name, after.name)
+		}
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	b := newTestBackend(t, "a")
+	hc := &HealthCheckConfig{Path: "/health"}
+	p := newTestProxy(t, "/", &ProxyConfig{Upstreams: []string{b.URL}, HealthCheck: hc})
+	u := p.upstreams[0]
+	isDown := func() bool {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return u.down
+	}
+
+	steps := []struct {
+		status int32
+		down   bool
+	}{
+		{200, false},
+		{500, false},
+		{500, false},
+		// A success in between starts the count again
+		{200, false},
+		{500, false},
+		{500, false},
+		{500, true},
+		{200, true},
+		{500, true},
+		{200, true},
+		{200, false},
+	}
+	for i, s := range steps {
+		atomic.StoreInt32(&b.status, s.status)
+		p.check(u)
+		if isDown() != s.down {
+			t.Fatalf("check %d (%d) left it down %v", i+1, s.status, isDown())
+		}
+	}
+
+	// A particular status can be asked for
+	hc.Status = http.StatusNoContent
+	for i := 0; i < hc.Unhealthy; i++ {
+		p.check(u)
+	}
+	if !isDown() || !strings.Contains(u.lastError, "200") {
+		t.Errorf("200 passed a check for 204, last error %q", u.lastError)
+	}
+}
@@ -0,0 +1,864 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/go-playground/log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The proxy cache keeps the responses upstreams say can be cached, in memory
+// and on disk, for the proxy routes with a cache section. Entries are keyed
+// by host, path and query, plus the request headers named in Vary
+
+// ProxyCacheConfig turns on caching for a proxy route
+type ProxyCacheConfig struct {
+	// How long to keep serving a stale response while a fresh one is
+	// fetched, and while the upstream is failing, when the upstream doesn't
+	// say in its Cache-Control
+	StaleWhileRevalidate duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         duration `json:"stale_if_error,omitempty"`
+	// Bigger responses aren't cached, 8MB by default
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+}
+
+func (conf *ProxyCacheConfig) compile() error {
+	if conf == nil {
+		return nil
+	}
+	if conf.StaleWhileRevalidate < 0 || conf.StaleIfError < 0 || conf.MaxObjectSize < 0 {
+		return errors.New("cache settings can't be negative")
+	}
+	if conf.MaxObjectSize == 0 {
+		conf.MaxObjectSize = 8 << 20
+	}
+	return nil
+}
+
+// Statuses that can be cached, when the upstream gives them a lifetime
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(d string) bool {
+	_, ok := cc[d]
+	return ok
+}
+
+func (cc cacheControl) seconds(d string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(cc[d], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cachePolicy is how long a response can be kept, and for how long after
+// that it can still be served stale
+type cachePolicy struct {
+	lifetime time.Duration
+	age      time.Duration
+	swr      time.Duration
+	sie      time.Duration
+}
+
+// responsePolicy works out how a response to r can be cached, ok is false
+// when it can't be
+func responsePolicy(r *http.Request, code int, h http.Header, conf *ProxyCacheConfig) (p cachePolicy, ok bool) {
+	if r.Method != "GET" || !cacheableStatuses[code] {
+		return p, false
+	}
+	cc := parseCacheControl(h)
+	if cc.has("no-store") || cc.has("no-cache") || cc.has("private") {
+		return p, false
+	}
+	if h.Get("Set-Cookie") != "" || strings.Contains(h.Get("Vary"), "*") {
+		return p, false
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		return p, false
+	}
+	// Responses for someone who logged in, to the upstream or to us, are
+	// only shared when the upstream says they can be
+	loggedIn := r.Header.Get("Authorization") != "" || r.Header.Get("X-Forwarded-User") != ""
+	if loggedIn && !cc.has("public") && !cc.has("s-maxage") {
+		return p, false
+	}
+
+	if d, ok := cc.seconds("s-maxage"); ok {
+		p.lifetime = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		p.lifetime = d
+	} else if h.Get("Expires") != "" {
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return p, false
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		p.lifetime = expires.Sub(date)
+	}
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		p.age = time.Duration(age) * time.Second
+	}
+	if p.lifetime <= p.age {
+		return p, false
+	}
+
+	p.swr, p.sie = time.Duration(conf.StaleWhileRevalidate), time.Duration(conf.StaleIfError)
+	if d, ok := cc.seconds("stale-while-revalidate"); ok {
+		p.swr = d
+	}
+	if d, ok := cc.seconds("stale-if-error"); ok {
+		p.sie = d
+	}
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		p.swr, p.sie = 0, 0
+	}
+	return p, true
+}
+
+// cacheEntry is a cached response
+type cacheEntry struct {
+	Key     string
+	Primary string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	// When it was stored, how old the upstream said it was then, and when
+	// it goes stale
+	Stored               time.Time
+	Age                  time.Duration
+	Expires              time.Time
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// The ETag is one we made up, not one the upstream knows about
+	GeneratedETag bool
+	Vary          []string
+}
+
+func newCacheEntry(primary string, r *http.Request, code int, header http.Header, body []byte, p cachePolicy) *cacheEntry {
+	now := time.Now()
+	e := &cacheEntry{
+		Primary:              primary,
+		Status:               code,
+		Header:               header.Clone(),
+		Body:                 append([]byte(nil), body...),
+		Stored:               now,
+		Age:                  p.age,
+		Expires:              now.Add(p.lifetime - p.age),
+		StaleWhileRevalidate: p.swr,
+		StaleIfError:         p.sie,
+	}
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				e.Vary = append(e.Vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	e.Key = variantKey(primary, e.Vary, r)
+	if e.Header.Get("ETag") == "" {
+		e.Header.Set("ETag", contentSum(e.Body))
+		e.GeneratedETag = true
+	}
+	return e
+}
+
+// refreshed is e updated by the headers of a 304 from the upstream, or nil
+// if it can't be cached any more
+func (e *cacheEntry) refreshed(r *http.Request, header http.Header, conf *ProxyCacheConfig) *cacheEntry {
+	h := e.Header.Clone()
+	for k, v := range header {
+		if k != "Content-Length" {
+			h[k] = v
+		}
+	}
+	p, ok := responsePolicy(r, e.Status, h, conf)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	n := *e
+	n.Header = h
+	n.Stored = now
+	n.Age = p.age
+	n.Expires = now.Add(p.lifetime - p.age)
+	n.StaleWhileRevalidate, n.StaleIfError = p.swr, p.sie
+	return &n
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Body) + len(e.Key))
+	for k, v := range e.Header {
+		n += int64(len(k))
+		for _, s := range v {
+			n += int64(len(s))
+		}
+	}
+	return n
+}
+
+// serve writes e as the response to r, result says where it came from
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request, result string) {
+	proxyCacheLookups.inc(strings.ToLower(result))
+	h := w.Header()
+	for k, v := range e.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.Itoa(int((e.Age + time.Since(e.Stored)).Seconds())))
+	h.Set("X-Cache", result)
+
+	if etagMatches(r, e.Header.Get("ETag")) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if e.Status != http.StatusNoContent {
+		h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != "HEAD" {
+		w.Write(e.Body)
+	}
+}
+
+// cacheKey is the key for r, before Vary is taken into account
+func cacheKey(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host + r.URL.RequestURI()
+}
+
+func variantKey(primary string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\x00" + name + "=" + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// What a cacheWriter does with the response it's given
+const (
+	// Send it straight on to the client
+	cachePass = iota
+	// Keep it to be cached
+	cacheBuffer
+	// Throw it away, there's a cached response to use instead
+	cacheHold
+)
+
+// cacheWriter takes a response from the upstream, keeping it if it can be
+// cached and passing it on to w if it can't. w is nil for background
+// revalidation
+type cacheWriter struct {
+	w            http.ResponseWriter
+	r            *http.Request
+	conf         *ProxyCacheConfig
+	header       http.Header
+	code         int
+	mode         int
+	policy       cachePolicy
+	buf          bytes.Buffer
+	validating   bool
+	staleOnError bool
+	// Called once the response turns out not to be cacheable, so requests
+	// waiting on it can go to the upstream themselves
+	uncacheable func()
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.code != 0 || code < 200 {
+		return
+	}
+	cw.code = code
+
+	if (cw.validating && code == http.StatusNotModified) || (cw.staleOnError && code >= 500) {
+		cw.mode = cacheHold
+		return
+	}
+	if p, ok := responsePolicy(cw.r, code, cw.header, cw.conf); ok {
+		cw.policy = p
+		cw.mode = cacheBuffer
+		return
+	}
+	cw.pass()
+}
+
+func (cw *cacheWriter) pass() {
+	cw.mode = cachePass
+	cw.uncacheable()
+	if cw.w == nil {
+		return
+	}
+	proxyCacheLookups.inc("miss")
+	h := cw.w.Header()
+	for k, v := range cw.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", "MISS")
+	cw.w.WriteHeader(cw.code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.code == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch cw.mode {
+	case cacheHold:
+		return len(b), nil
+	case cacheBuffer:
+		if int64(cw.buf.Len()+len(b)) <= cw.conf.MaxObjectSize {
+			return cw.buf.Write(b)
+		}
+		// Too big to cache, send on what we've got and carry on without it
+		cw.pass()
+		if cw.w != nil && cw.buf.Len() > 0 {
+			if _, err := cw.w.Write(cw.buf.Bytes()); err != nil {
+				return 0, err
+			}
+		}
+		cw.buf.Reset()
+	}
+	if cw.w == nil {
+		return len(b), nil
+	}
+	return cw.w.Write(b)
+}
+
+func (cw *cacheWriter) Flush() {
+	if cw.mode == cachePass && cw.w != nil {
+		http.NewResponseController(cw.w).Flush()
+	}
+}
+
+// responseCache holds entries in memory, and on disk when there's a
+// directory for it, dropping the least recently used when they're full
+type responseCache struct {
+	mu       sync.Mutex
+	mem      map[string]*list.Element
+	memLRU   *list.List
+	memSize  int64
+	memMax   int64
+	dir      string
+	disk     map[string]*list.Element
+	diskLRU  *list.List
+	diskSize int64
+	diskMax  int64
+	// The Vary headers of the responses for each primary key
+	vary map[string][]string
+	// Fetches from upstreams in flight, so concurrent misses only make one
+	inflight map[string]chan struct{}
+}
+
+// diskItem is an entry on disk
+type diskItem struct {
+	key     string
+	primary string
+	size    int64
+}
+
+var proxyCache *responseCache
+
+// startProxyCache sets up the proxy cache, loading what's on disk
+func startProxyCache() {
+	proxyCache = newResponseCache(*proxyCacheDir, int64(*proxyCacheMemory)<<20, int64(*proxyCacheDisk)<<20)
+	if proxyCache.dir != "" {
+		if err := proxyCache.load(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func newResponseCache(dir string, memMax, diskMax int64) *responseCache {
+	return &responseCache{
+		mem:      map[string]*list.Element{},
+		memLRU:   list.New(),
+		memMax:   memMax,
+		dir:      dir,
+		disk:     map[string]*list.Element{},
+		diskLRU:  list.New(),
+		diskMax:  diskMax,
+		vary:     map[string][]string{},
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+func (c *responseCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// load indexes the entries on disk, oldest first so they're dropped first
+func (c *responseCache) load() error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fi := range files {
+		path := filepath.Join(c.dir, fi.Name())
+		if strings.HasSuffix(path, ".tmp") {
+			// Left over from being stopped halfway through a write
+			os.Remove(path)
+			continue
+		}
+		e, err := readCacheEntry(path)
+		if err != nil {
+			log.Warnf("Removing unreadable cache entry %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		c.vary[e.Primary] = e.Vary
+		c.disk[e.Key] = c.diskLRU.PushFront(&diskItem{e.Key, e.Primary, fi.Size()})
+		c.diskSize += fi.Size()
+	}
+	c.evictDisk()
+	log.Infof("Loaded %d cached responses from %s", len(c.disk), c.dir)
+	return nil
+}
+
+func readCacheEntry(path string) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e := &cacheEntry{}
+	return e, gob.NewDecoder(f).Decode(e)
+}
+
+// get returns the entry for key, from memory or disk
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	if el, ok := c.mem[key]; ok {
+		c.memLRU.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	el, ok := c.disk[key]
+	if ok {
+		c.diskLRU.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	e, err := readCacheEntry(c.path(key))
+	if err != nil {
+		log.Error(err)
+		c.remove(key)
+		return nil
+	}
+	c.mu.Lock()
+	c.putMem(e)
+	c.mu.Unlock()
+	return e
+}
+
+// lookup returns the entry for the variant of primary that r wants
+func (c *responseCache) lookup(primary string, r *http.Request) *cacheEntry {
+	return c.get(c.variantKey(primary, r))
+}
+
+func (c *responseCache) variantKey(primary string, r *http.Request) string {
+	c.mu.Lock()
+	vary := c.vary[primary]
+	c.mu.Unlock()
+	return variantKey(primary, vary, r)
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	c.vary[e.Primary] = e.Vary
+	c.putMem(e)
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		log.Error(err)
+		return
+	}
+	path := c.path(e.Key)
+	if err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0600); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Error(err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.disk[e.Key]; ok {
+		c.diskSize -= el.Value.(*diskItem).size
+		c.diskLRU.Remove(el)
+	}
+	c.disk[e.Key] = c.diskLRU.PushFront(&diskItem{e.Key, e.Primary, int64(buf.Len())})
+	c.diskSize += int64(buf.Len())
+	c.evictDisk()
+}
+
+// putMem keeps e in memory, c.mu has to be held
+func (c *responseCache) putMem(e *cacheEntry) {
+	if el, ok := c.mem[e.Key]; ok {
+		c.memSize -= el.Value.(*cacheEntry).size()
+		c.memLRU.Remove(el)
+		delete(c.mem, e.Key)
+	}
+	if e.size() > c.memMax {
+		return
+	}
+	c.mem[e.Key] = c.memLRU.PushFront(e)
+	c.memSize += e.size()
+	for c.memSize > c.memMax {
+		old := c.memLRU.Remove(c.memLRU.Back()).(*cacheEntry)
+		delete(c.mem, old.Key)
+		c.memSize -= old.size()
+	}
+}
+
+// evictDisk drops entries from disk until they fit, c.mu has to be held
+func (c *responseCache) evictDisk() {
+	for c.diskSize > c.diskMax && c.diskLRU.Len() > 0 {
+		c.removeDisk(c.diskLRU.Back().Value.(*diskItem).key)
+	}
+}
+
+// removeDisk drops key from disk, c.mu has to be held
+func (c *responseCache) removeDisk(key string) {
+	el, ok := c.disk[key]
+	if !ok {
+		return
+	}
+	c.diskSize -= el.Value.(*diskItem).size
+	c.diskLRU.Remove(el)
+	delete(c.disk, key)
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.mem[key]; ok {
+		c.memSize -= el.Value.(*cacheEntry).size()
+		c.memLRU.Remove(el)
+		delete(c.mem, key)
+	}
+	c.removeDisk(key)
+}
+
+// purge drops every entry whose primary key match says to, returning how
+// many there were
+func (c *responseCache) purge(match func(primary string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := map[string]bool{}
+	for key, el := range c.mem {
+		e := el.Value.(*cacheEntry)
+		if match(e.Primary) {
+			c.memSize -= e.size()
+			c.memLRU.Remove(el)
+			delete(c.mem, key)
+			purged[key] = true
+		}
+	}
+	for key, el := range c.disk {
+		if match(el.Value.(*diskItem).primary) {
+			c.removeDisk(key)
+			purged[key] = true
+		}
+	}
+	for primary := range c.vary {
+		if match(primary) {
+			delete(c.vary, primary)
+		}
+	}
+	return len(purged)
+}
+
+// join returns the channel closed when the fetch for key is done, and
+// whether the caller is the one who has to do it
+func (c *responseCache) join(key string) (chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.inflight[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	c.inflight[key] = done
+	return done, true
+}
+
+func (c *responseCache) leave(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+// serve answers r from the cache when it can, and from upstream when it
+// can't, caching what comes back
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, conf *ProxyCacheConfig, upstream http.Handler) {
+	reqCC := parseCacheControl(r.Header)
+	if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Upgrade") != "" || reqCC.has("no-store") {
+		proxyCacheLookups.inc("bypass")
+		upstream.ServeHTTP(w, r)
+		return
+	}
+	primary := cacheKey(r)
+	reload := reqCC.has("no-cache") || reqCC["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache"
+
+	var e *cacheEntry
+	if !reload {
+		e = c.lookup(primary, r)
+	}
+	now := time.Now()
+	if e != nil && now.Before(e.Expires) {
+		e.serve(w, r, "HIT")
+		return
+	}
+	if e != nil && now.Before(e.Expires.Add(e.StaleWhileRevalidate)) {
+		e.serve(w, r, "STALE")
+		go c.revalidate(r.Clone(context.WithoutCancel(r.Context())), conf, upstream, e)
+		return
+	}
+	if r.Method == "HEAD" || reload {
+		c.fetch(w, r, primary, conf, upstream, e, func() {})
+		return
+	}
+
+	// Only one request for a missing response goes to the upstream, the
+	// rest wait to see if it can be cached
+	key := c.variantKey(primary, r)
+	done, leader := c.join(key)
+	if leader {
+		var once sync.Once
+		release := func() {
+			once.Do(func() {
+				c.leave(key, done)
+			})
+		}
+		defer release()
+		c.fetch(w, r, primary, conf, upstream, e, release)
+		return
+	}
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return
+	}
+	if e := c.lookup(primary, r); e != nil && time.Now().Before(e.Expires) {
+		e.serve(w, r, "HIT")
+		return
+	}
+	c.fetch(w, r, primary, conf, upstream, e, func() {})
+}
+
+// fetch gets r from upstream, revalidating stale if there is one, and
+// calls stored once what came back has been cached, or as soon as it's
+// clear it won't be, stored has to be safe to call more than once
+func (c *responseCache) fetch(w http.ResponseWriter, r *http.Request, primary string, conf *ProxyCacheConfig, upstream http.Handler, stale *cacheEntry, stored func()) {
+	cw := &cacheWriter{w: w, r: r, conf: conf, header: http.Header{}, uncacheable: stored}
+	out := r
+	if stale != nil && r.Method == "GET" {
+		etag := stale.Header.Get("ETag")
+		if stale.GeneratedETag {
+			etag = ""
+		}
+		lastModified := stale.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			out = r.Clone(r.Context())
+			out.Header.Del("If-None-Match")
+			out.Header.Del("If-Modified-Since")
+			if etag != "" {
+				out.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				out.Header.Set("If-Modified-Since", lastModified)
+			}
+			cw.validating = true
+		}
+		cw.staleOnError = time.Now().Before(stale.Expires.Add(stale.StaleIfError))
+	}
+	upstream.ServeHTTP(cw, out)
+
+	switch {
+	case cw.mode == cacheHold && cw.code == http.StatusNotModified:
+		if e := stale.refreshed(r, cw.header, conf); e != nil {
+			c.put(e)
+			stale = e
+		} else {
+			c.remove(stale.Key)
+		}
+		stored()
+		if w != nil {
+			stale.serve(w, r, "REVALIDATED")
+		}
+	case cw.mode == cacheHold:
+		// The upstream's failing, the stale response will have to do
+		log.Warnf("Serving stale %s, the upstream returned %d", primary, cw.code)
+		stored()
+		if w != nil {
+			stale.serve(w, r, "STALE")
+		}
+	case cw.mode == cacheBuffer:
+		e := newCacheEntry(primary, r, cw.code, cw.header, cw.buf.Bytes(), cw.policy)
+		c.put(e)
+		stored()
+		if w != nil {
+			e.serve(w, r, "MISS")
+		}
+	}
+}
+
+// revalidate fetches a fresh copy of stale in the background
+func (c *responseCache) revalidate(r *http.Request, conf *ProxyCacheConfig, upstream http.Handler, stale *cacheEntry) {
+	done, leader := c.join(stale.Key)
+	if !leader {
+		return
+	}
+	defer c.leave(stale.Key, done)
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	c.fetch(nil, r.WithContext(ctx), stale.Primary, conf, upstream, stale, func() {})
+}
+
+func (c *responseCache) sizes() (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.memSize, c.diskSize
+}
+
+// purgeMatcher matches the primary keys for rawURL, or when that's empty
+// every url starting with prefix, both without the scheme like
+// example.com/path. One of them has to be given, so a forgotten parameter
+// doesn't empty the whole cache
+func purgeMatcher(rawURL, prefix string) (func(primary string) bool, error) {
+	if rawURL == "" && prefix == "" {
+		return nil, errors.New("url or prefix is required")
+	}
+	trim := func(s string) string {
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+		host, path, _ := strings.Cut(s, "/")
+		return strings.ToLower(host) + "/" + path
+	}
+
+	if rawURL != "" {
+		u, err := url.Parse("http://" + trim(rawURL))
+		if err != nil {
+			return nil, err
+		}
+		key := u.Hostname() + u.RequestURI()
+		return func(primary string) bool {
+			return primary == key
+		}, nil
+	}
+	prefix = trim(prefix)
+	return func(primary string) bool {
+		return strings.HasPrefix(primary, prefix)
+	}, nil
+}
+
+func purgeProxyCacheHandler(w http.ResponseWriter, r *http.Request) {
+	match, err := purgeMatcher(r.FormValue("url"), r.FormValue("prefix"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	n := 0
+	if proxyCache != nil {
+		n = proxyCache.purge(match)
+	}
+	log.Noticef("Purged %d cached responses", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
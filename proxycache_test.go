@@ -0,0 +1,506 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCacheUpstream is an httptest server behind a reverse proxy, counting
+// the requests that get to it
+type testCacheUpstream struct {
+	http.Handler
+	hits     int32
+	requests chan *http.Request
+}
+
+func newTestCacheUpstream(t *testing.T, h http.HandlerFunc) *testCacheUpstream {
+	u := &testCacheUpstream{requests: make(chan *http.Request, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&u.hits, 1)
+		select {
+		case u.requests <- r:
+		default:
+		}
+		h(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	u.Handler = httputil.NewSingleHostReverseProxy(target)
+	return u
+}
+
+func (u *testCacheUpstream) count() int {
+	return int(atomic.LoadInt32(&u.hits))
+}
+
+// waitHits waits for the upstream to have had n requests
+func (u *testCacheUpstream) waitHits(t *testing.T, n int) {
+	for start := time.Now(); u.count() < n; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("the upstream had %d requests, waited for %d", u.count(), n)
+		}
+	}
+}
+
+func cacheGet(c *responseCache, conf *ProxyCacheConfig, upstream http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	c.serve(w, r, conf, upstream)
+	return w
+}
+
+// expireCached makes the entry for key go stale ago
+func expireCached(t *testing.T, c *responseCache, key string, ago time.Duration) {
+	e := c.get(key)
+	if e == nil {
+		t.Fatalf("%s isn't cached", key)
+	}
+	e.Expires = time.Now().Add(-ago)
+}
+
+func testCacheConfig() *ProxyCacheConfig {
+	conf := &ProxyCacheConfig{}
+	conf.compile()
+	return conf
+}
+
+func TestResponsePolicy(t *testing.T) {
+	conf := &ProxyCacheConfig{StaleWhileRevalidate: duration(time.Minute), StaleIfError: duration(time.Hour)}
+	date := time.Now().UTC()
+
+	tests := []struct {
+		name     string
+		method   string
+		code     int
+		header   []string
+		reqAuth  []string
+		ok       bool
+		lifetime time.Duration
+		swr, sie time.Duration
+	}{
+		{"max-age", "GET", 200, []string{"Cache-Control", "max-age=60"}, nil, true, time.Minute, time.Minute, time.Hour},
+		{"s-maxage wins", "GET", 200, []string{"Cache-Control", "max-age=60, s-maxage=120"}, nil, true, 2 * time.Minute, time.Minute, time.Hour},
+		{"expires", "GET", 200, []string{"Expires", date.Add(time.Hour).Format(http.TimeFormat), "Date", date.Format(http.TimeFormat)}, nil, true, time.Hour, time.Minute, time.Hour},
+		{"upstream's stale times", "GET", 404, []string{"Cache-Control", "max-age=60, stale-while-revalidate=5, stale-if-error=10"}, nil, true, time.Minute, 5 * time.Second, 10 * time.Second},
+		{"must-revalidate", "GET", 200, []string{"Cache-Control", "max-age=60, must-revalidate"}, nil, true, time.Minute, 0, 0},
+		{"no lifetime", "GET", 200, nil, nil, false, 0, 0, 0},
+		{"already too old", "GET", 200, []string{"Cache-Control", "max-age=60", "Age", "60"}, nil, false, 0, 0, 0},
+		{"bad expires", "GET", 200, []string{"Expires", "0"}, nil, false, 0, 0, 0},
+		{"no-store", "GET", 200, []string{"Cache-Control", "max-age=60, no-store"}, nil, false, 0, 0, 0},
+		{"private", "GET", 200, []string{"Cache-Control", "private, max-age=60"}, nil, false, 0, 0, 0},
+		{"set-cookie", "GET", 200, []string{"Cache-Control", "max-age=60", "Set-Cookie", "a=b"}, nil, false, 0, 0, 0},
+		{"vary star", "GET", 200, []string{"Cache-Control", "max-age=60", "Vary", "*"}, nil, false, 0, 0, 0},
+		{"event stream", "GET", 200, []string{"Cache-Control", "max-age=60", "Content-Type", "text/event-stream"}, nil, false, 0, 0, 0},
+		{"server error", "GET", 500, []string{"Cache-Control", "max-age=60"}, nil, false, 0, 0, 0},
+		{"post", "POST", 200, []string{"Cache-Control", "max-age=60"}, nil, false, 0, 0, 0},
+		{"authorization", "GET", 200, []string{"Cache-Control", "max-age=60"}, []string{"Authorization", "Basic eDp5"}, false, 0, 0, 0},
+		{"logged in", "GET", 200, []string{"Cache-Control", "max-age=60"}, []string{"X-Forwarded-User", "alice"}, false, 0, 0, 0},
+		{"logged in, public", "GET", 200, []string{"Cache-Control", "public, max-age=60"}, []string{"X-Forwarded-User", "alice"}, true, time.Minute, time.Minute, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://cache.test/", nil)
+			for i := 0; i < len(tt.reqAuth); i += 2 {
+				r.Header.Set(tt.reqAuth[i], tt.reqAuth[i+1])
+			}
+			h := http.Header{}
+			for i := 0; i < len(tt.header); i += 2 {
+				h.Set(tt.header[i], tt.header[i+1])
+			}
+			p, ok := responsePolicy(r, tt.code, h, conf)
+			if ok != tt.ok {
+				t.Fatalf("got %v", ok)
+			}
+			if ok && (p.lifetime.Round(time.Second) != tt.lifetime || p.swr != tt.swr || p.sie != tt.sie) {
+				t.Errorf("got %+v", p)
+			}
+		})
+	}
+}
+
+func TestProxyCacheHit(t *testing.T) {
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "hello")
+	})
+	c, conf := newResponseCache("", 1<<20, 0), testCacheConfig()
+
+	tests := []struct {
+		name   string
+		header []string
+		code   int
+		cache  string
+		hits   int
+	}{
+		{"miss", nil, 200, "MISS", 1},
+		{"hit", nil, 200, "HIT", 1},
+		{"conditional", []string{"If-None-Match", contentSum([]byte("hello"))}, 304, "HIT", 1},
+		{"reload", []string{"Cache-Control", "no-cache"}, 200, "MISS", 2},
+		{"no-store", []string{"Cache-Control", "no-store"}, 200, "", 3},
+	}
+	for _, tt := range tests {
+		w := cacheGet(c, conf, up, "http://cache.test/a", tt.header...)
+		if w.Code != tt.code || w.Header().Get("X-Cache") != tt.cache || up.count() != tt.hits {
+			t.Errorf("%s: got %d %q after %d upstream requests", tt.name, w.Code, w.Header().Get("X-Cache"), up.count())
+		}
+		if tt.code == 200 && w.Body.String() != "hello" {
+			t.Errorf("%s: body is %q", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestProxyCacheVary(t *testing.T) {
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	})
+	c, conf := newResponseCache("", 1<<20, 0), testCacheConfig()
+
+	for i, tt := range []struct {
+		lang, cache string
+		hits        int
+	}{
+		{"en", "MISS", 1},
+		{"fr", "MISS", 2},
+		{"en", "HIT", 2},
+		{"fr", "HIT", 2},
+		{"", "MISS", 3},
+	} {
+		w := cacheGet(c, conf, up, "http://cache.test/v", "Accept-Language", tt.lang)
+		if w.Body.String() != tt.lang || w.Header().Get("X-Cache") != tt.cache || up.count() != tt.hits {
+			t.Errorf("%d: %q got %q %s after %d upstream requests", i, tt.lang, w.Body.String(), w.Header().Get("X-Cache"), up.count())
+		}
+	}
+}
+
+func TestProxyCacheStaleWhileRevalidate(t *testing.T) {
+	var version int32 = 1
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+		fmt.Fprintf(w, "v%d", atomic.LoadInt32(&version))
+	})
+	c, conf := newResponseCache("", 1<<20, 0), testCacheConfig()
+
+	cacheGet(c, conf, up, "http://cache.test/swr")
+	expireCached(t, c, "cache.test/swr", 10*time.Second)
+	atomic.StoreInt32(&version, 2)
+
+	w := cacheGet(c, conf, up, "http://cache.test/swr")
+	if w.Body.String() != "v1" || w.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("got %q %s, want the stale response", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	up.waitHits(t, 2)
+
+	// The background fetch stores the fresh one once it's done
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(5 * time.Millisecond) {
+		if e := c.get("cache.test/swr"); e != nil && string(e.Body) == "v2" {
+			break
+		}
+	}
+	w = cacheGet(c, conf, up, "http://cache.test/swr")
+	if w.Body.String() != "v2" || w.Header().Get("X-Cache") != "HIT" || up.count() != 2 {
+		t.Errorf("got %q %s after %d upstream requests", w.Body.String(), w.Header().Get("X-Cache"), up.count())
+	}
+
+	// Past stale-while-revalidate it has to wait for a fresh one
+	expireCached(t, c, "cache.test/swr", time.Minute)
+	atomic.StoreInt32(&version, 3)
+	if w := cacheGet(c, conf, up, "http://cache.test/swr"); w.Body.String() != "v3" || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("got %q %s", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+}
+
+func TestProxyCacheStaleIfError(t *testing.T) {
+	var failing int32
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=3600")
+		fmt.Fprint(w, "cached")
+	})
+	c, conf := newResponseCache("", 1<<20, 0), testCacheConfig()
+
+	cacheGet(c, conf, up, "http://cache.test/sie")
+	expireCached(t, c, "cache.test/sie", time.Minute)
+	atomic.StoreInt32(&failing, 1)
+
+	w := cacheGet(c, conf, up, "http://cache.test/sie")
+	if w.Code != 200 || w.Body.String() != "cached" || w.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("got %d %q %s, want the stale response", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+
+	// Past stale-if-error the error goes through
+	expireCached(t, c, "cache.test/sie", 2*time.Hour)
+	if w := cacheGet(c, conf, up, "http://cache.test/sie"); w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("got %d %s, want the error", w.Code, w.Header().Get("X-Cache"))
+	}
+}
+
+func TestProxyCacheRevalidate(t *testing.T) {
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("X-Refreshed", "yes")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "body")
+	})
+	c, conf := newResponseCache("", 1<<20, 0), testCacheConfig()
+
+	cacheGet(c, conf, up, "http://cache.test/etag")
+	<-up.requests
+	expireCached(t, c, "cache.test/etag", time.Minute)
+
+	w := cacheGet(c, conf, up, "http://cache.test/etag")
+	if r := <-up.requests; r.Header.Get("If-None-Match") != `"v1"` {
+		t.Errorf("revalidated with If-None-Match %q", r.Header.Get("If-None-Match"))
+	}
+	if w.Code != 200 || w.Body.String() != "body" || w.Header().Get("X-Cache") != "REVALIDATED" || w.Header().Get("X-Refreshed") != "yes" {
+		t.Errorf("got %d %q %s %v", w.Code, w.Body.String(), w.Header().Get("X-Cache"), w.Header())
+	}
+	if w := cacheGet(c, conf, up, "http://cache.test/etag"); w.Header().Get("X-Cache") != "HIT" || up.count() != 2 {
+		t.Errorf("got %s after %d upstream requests, the 304 should have freshened it", w.Header().Get("X-Cache"), up.count())
+	}
+}
+
+func TestProxyCacheCoalesces(t *testing.T) {
+	release := make(chan struct{})
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "once")
+	})
+	c, conf := newResponseCache("", 1<<20, 0), testCacheConfig()
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 10)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = cacheGet(c, conf, up, "http://cache.test/c").Body.String()
+		}(i)
+	}
+	up.waitHits(t, 1)
+	// Give the rest time to pile up behind the first
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if up.count() != 1 {
+		t.Errorf("the upstream had %d requests", up.count())
+	}
+	for i, b := range bodies {
+		if b != "once" {
+			t.Errorf("%d got %q", i, b)
+		}
+	}
+}
+
+// Requests waiting on a response that can't be cached go to the upstream
+// as soon as that's known, not when it's finished
+func TestProxyCacheCoalescedUncacheable(t *testing.T) {
+	release := make(chan struct{})
+	var first int32
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if atomic.CompareAndSwapInt32(&first, 0, 1) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-release
+		}
+		fmt.Fprint(w, "streamed")
+	})
+	c, conf := newResponseCache("", 1<<20, 0), testCacheConfig()
+
+	leader := make(chan struct{})
+	go func() {
+		defer close(leader)
+		cacheGet(c, conf, up, "http://cache.test/u")
+	}()
+	up.waitHits(t, 1)
+
+	followers := make(chan string, 3)
+	for i := 0; i < cap(followers); i++ {
+		go func() {
+			followers <- cacheGet(c, conf, up, "http://cache.test/u").Body.String()
+		}()
+	}
+	for i := 0; i < cap(followers); i++ {
+		select {
+		case b := <-followers:
+			if b != "streamed" {
+				t.Errorf("got %q", b)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the followers waited on a response that was never going to be cached")
+		}
+	}
+	close(release)
+	<-leader
+}
+
+func TestProxyCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	up := newTestCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+		fmt.Fprint(w, "from "+r.URL.Path)
+	})
+	conf := testCacheConfig()
+
+	c := newResponseCache(dir, 1<<20, 1<<20)
+	cacheGet(c, conf, up, "http://cache.test/d1", "Accept", "text/plain")
+	cacheGet(c, conf, up, "http://cache.test/d2", "Accept", "text/plain")
+	os.WriteFile(dir+"/leftover.tmp", []byte("x"), 0600)
+	os.WriteFile(dir+"/garbage", []byte("x"), 0600)
+
+	// A restart finds them on disk, Vary and all
+	c = newResponseCache(dir, 1<<20, 1<<20)
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.disk) != 2 {
+		t.Errorf("loaded %d entries", len(c.disk))
+	}
+	for _, name := range []string{"leftover.tmp", "garbage"} {
+		if _, err := os.Stat(dir + "/" + name); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't cleaned up", name)
+		}
+	}
+	w := cacheGet(c, conf, up, "http://cache.test/d1", "Accept", "text/plain")
+	if w.Body.String() != "from /d1" || w.Header().Get("X-Cache") != "HIT" || up.count() != 2 {
+		t.Errorf("got %q %s after %d upstream requests", w.Body.String(), w.Header().Get("X-Cache"), up.count())
+	}
+	if w := cacheGet(c, conf, up, "http://cache.test/d1", "Accept", "text/html"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("another variant got %s", w.Header().Get("X-Cache"))
+	}
+}
+
+func testCacheEntry(path string, size int) *cacheEntry {
+	r := httptest.NewRequest("GET", "http://cache.test"+path, nil)
+	return newCacheEntry(cacheKey(r), r, 200, http.Header{}, []byte(strings.Repeat("x", size)), cachePolicy{lifetime: time.Minute})
+}
+
+func TestProxyCacheEviction(t *testing.T) {
+	size := testCacheEntry("/a", 1000).size()
+	c := newResponseCache("", 2*size, 0)
+	c.put(testCacheEntry("/a", 1000))
+	c.put(testCacheEntry("/b", 1000))
+	// /a was used last, so /b goes to make room for /c
+	c.get("cache.test/a")
+	c.put(testCacheEntry("/c", 1000))
+
+	for key, want := range map[string]bool{"cache.test/a": true, "cache.test/b": false, "cache.test/c": true} {
+		if got := c.get(key) != nil; got != want {
+			t.Errorf("%s cached is %v", key, got)
+		}
+	}
+	if mem, _ := c.sizes(); mem != 2*size {
+		t.Errorf("memory size is %d, want %d", mem, 2*size)
+	}
+
+	// Too big for memory at all
+	c.put(testCacheEntry("/huge", 10000))
+	if c.get("cache.test/huge") != nil {
+		t.Error("kept an entry bigger than the cache")
+	}
+
+	// On disk, the oldest go once it's over
+	dir := t.TempDir()
+	c = newResponseCache(dir, 1<<20, 1<<20)
+	c.put(testCacheEntry("/d", 1000))
+	_, diskSize := c.sizes()
+	c.diskMax = 2 * diskSize
+	c.put(testCacheEntry("/e", 1000))
+	c.put(testCacheEntry("/f", 1000))
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 || len(c.disk) != 2 {
+		t.Errorf("%d files and %d entries on disk, want 2", len(files), len(c.disk))
+	}
+	if _, ok := c.disk["cache.test/d"]; ok {
+		t.Error("the oldest entry is still on disk")
+	}
+}
+
+func TestPurgeMatcher(t *testing.T) {
+	tests := []struct {
+		url, prefix string
+		matches     []string
+		misses      []string
+	}{
+		{"example.com/a?b=1", "", []string{"example.com/a?b=1"}, []string{"example.com/a", "example.com/a?b=12"}},
+		{"https://Example.com/a", "", []string{"example.com/a"}, []string{"example.com/A"}},
+		{"", "example.com/api/", []string{"example.com/api/", "example.com/api/x?y"}, []string{"example.com/ap", "other.com/api/"}},
+		{"", "http://EXAMPLE.com", []string{"example.com/", "example.com/anything"}, []string{"example.co/"}},
+	}
+	for _, tt := range tests {
+		match, err := purgeMatcher(tt.url, tt.prefix)
+		if err != nil {
+			t.Errorf("%q %q: %v", tt.url, tt.prefix, err)
+			continue
+		}
+		for _, p := range tt.matches {
+			if !match(p) {
+				t.Errorf("%q %q didn't match %s", tt.url, tt.prefix, p)
+			}
+		}
+		for _, p := range tt.misses {
+			if match(p) {
+				t.Errorf("%q %q matched %s", tt.url, tt.prefix, p)
+			}
+		}
+	}
+	if _, err := purgeMatcher("", ""); err == nil {
+		t.Error("nothing to match on was taken")
+	}
+
+	c := newResponseCache(t.TempDir(), 1<<20, 1<<20)
+	for _, p := range []string{"/api/a", "/api/b", "/other"} {
+		c.put(testCacheEntry(p, 10))
+	}
+	match, _ := purgeMatcher("", "cache.test/api/")
+	if n := c.purge(match); n != 2 {
+		t.Errorf("purged %d", n)
+	}
+	if c.get("cache.test/api/a") != nil || c.get("cache.test/other") == nil {
+		t.Error("purged the wrong entries")
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per key, refilling at rate tokens a second
+// up to burst
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// The most keys a limiter keeps buckets for, when there are more than this
+// some are forgotten to make room, which only ever lets someone off early
+const maxRateLimitBuckets = 100000
+
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   []*rateLimiter
+	// Limiters shared by everything with the same use and settings, by
+	// use/rate/burst
+	sharedLimiters = map[string]*rateLimiter{}
+)
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+	rateLimitersMu.Lock()
+	rateLimiters = append(rateLimiters, l)
+	rateLimitersMu.Unlock()
+	go func() {
+		for range time.Tick(time.Minute) {
+			l.prune()
+		}
+	}()
+	return l
+}
+
+// sharedRateLimiter returns the limiter for use with these settings, made
+// the first time it's asked for. Limiters for things set up in the config
+// come from here so reloading it doesn't start everyone over, or leave old
+// limiters running. Different uses never share, so one can't use up
+// another's tokens
+func sharedRateLimiter(use string, rate float64, burst int) *rateLimiter {
+	rateLimitersMu.Lock()
+	key := use + "/" + strconv.FormatFloat(rate, 'g', -1, 64) + "/" + strconv.Itoa(burst)
+	l, ok := sharedLimiters[key]
+	rateLimitersMu.Unlock()
+	if !ok {
+		l = newRateLimiter(rate, burst)
+		rateLimitersMu.Lock()
+		sharedLimiters[key] = l
+		rateLimitersMu.Unlock()
+	}
+	return l
+}
+
+// rateLimitBuckets is how many keys all the limiters are keeping track of
+func rateLimitBuckets() int {
+	rateLimitersMu.Lock()
+	limiters := append([]*rateLimiter{}, rateLimiters...)
+	rateLimitersMu.Unlock()
+
+	n := 0
+	for _, l := range limiters {
+		l.mu.Lock()
+		n += len(l.buckets)
+		l.mu.Unlock()
+	}
+	return n
+}
+
+// take takes a token for key if there is one, otherwise it says how long
+// until there will be
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	ok, _, wait, _ := l.limit(key)
+	return ok, wait
+}
+
+// limit is take for when the client is told where it stands, it also says
+// how many tokens are left and how long until the bucket is full again
+func (l *rateLimiter) limit(key string) (ok bool, remaining int, wait, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.evict()
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		wait = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	reset = time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second))
+	return ok, int(b.tokens), wait, reset
+}
+
+// evict forgets a tenth of the buckets to make room for new ones, whichever
+// the map gives us first
+func (l *rateLimiter) evict() {
+	n := len(l.buckets) / 10
+	for key := range l.buckets {
+		if n <= 0 {
+			break
+		}
+		delete(l.buckets, key)
+		n--
+	}
+}
+
+// prune forgets buckets which have filled back up, they're no different to
+// new ones
+func (l *rateLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// blocked says whether take would turn key away right now, and for how
+// long, without taking anything
+func (l *rateLimiter) blocked(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return false, 0
+	}
+	tokens := math.Min(l.burst, b.tokens+time.Since(b.last).Seconds()*l.rate)
+	if tokens >= 1 {
+		return false, 0
+	}
+	return true, time.Duration((1 - tokens) / l.rate * float64(time.Second))
+}
+
+// RateLimit is how many requests a client can make to a host or site route
+type RateLimit struct {
+	// Requests allowed every per
+	Requests int `json:"requests"`
+	// 1s by default
+	Per duration `json:"per,omitempty"`
+	// How many can be made at once, requests by default
+	Burst int `json:"burst,omitempty"`
+	// Who counts as a client: ip, ip64 to count IPv6 addresses by their
+	// /64, or user for whoever logged in with auth or oidc, by ip64 when
+	// nobody has. ip by default
+	Key string `json:"key,omitempty"`
+
+	limiter *rateLimiter
+}
+
+func (rl *RateLimit) compile() error {
+	if rl.Requests <= 0 {
+		return errors.New("requests has to be more than 0")
+	}
+	if rl.Per <= 0 {
+		rl.Per = duration(time.Second)
+	}
+	if rl.Burst <= 0 {
+		rl.Burst = rl.Requests
+	}
+	switch rl.Key {
+	case "":
+		rl.Key = "ip"
+	case "ip", "ip64", "user":
+	default:
+		return fmt.Errorf("unknown key %q, use ip, ip64 or user", rl.Key)
+	}
+	rl.limiter = sharedRateLimiter("requests", float64(rl.Requests)/time.Duration(rl.Per).Seconds(), rl.Burst)
+	return nil
+}
+
+// compileHostRateLimits checks the limits for each host, lowercasing the
+// hosts
+func compileHostRateLimits(hosts map[string]*RateLimit) (map[string]*RateLimit, error) {
+	lower := make(map[string]*RateLimit, len(hosts))
+	for host, rl := range hosts {
+		host = strings.ToLower(host)
+		if !validDomain(host) {
+			return nil, fmt.Errorf("host_rate_limit %q isn't a valid host", host)
+		}
+		if err := rl.compile(); err != nil {
+			return nil, fmt.Errorf("host_rate_limit %s: %v", host, err)
+		}
+		lower[host] = rl
+	}
+	return lower, nil
+}
+
+// client is who r counts against
+func (rl *RateLimit) client(r *http.Request) string {
+	if rl.Key == "user" {
+		if id := authIdentity(r); id != "-" {
+			return id
+		}
+	}
+	ip := clientIP(r)
+	if rl.Key == "ip" {
+		return ip
+	}
+	return clientKey64(ip)
+}
+
+// clientKey64 is the /64 an IPv6 address is in, as whoever has one of
+// those usually has the lot, and IPv4 addresses as they are
+func clientKey64(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Unmap().Is6() {
+		return ip
+	}
+	p, _ := addr.Prefix(64)
+	return p.String()
+}
+
+// allow takes one of the client's requests for host and path, with path
+// empty for the host's limit, telling it how many it has left. When it
+// has none r is answered with a 429 and allow returns false
+func (rl *RateLimit) allow(w http.ResponseWriter, r *http.Request, host, path string) bool {
+	ok, remaining, wait, reset := rl.limiter.limit(host + path + " " + rl.client(r))
+
+	window := float64(rl.Burst) / rl.limiter.rate
+	h := w.Header()
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rl.Burst, int(math.Ceil(window))))
+	h.Set("RateLimit-Limit", strconv.Itoa(rl.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	if ok {
+		return true
+	}
+
+	rateLimited.inc(host, path)
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusTooManyRequests)
+	n, _ := io.WriteString(w, http.StatusText(http.StatusTooManyRequests)+"\n")
+	go logRequest(w, r, int64(n), http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	// 2 a second, up to 3 at once
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		takes   int
+		want    []bool
+		wait    time.Duration
+	}{
+		{"burst", 0, 4, []bool{true, true, true, false}, 500 * time.Millisecond},
+		{"half a token back", 250 * time.Millisecond, 1, []bool{false}, 250 * time.Millisecond},
+		{"one back", 500 * time.Millisecond, 2, []bool{true, false}, 500 * time.Millisecond},
+		{"full again", time.Hour, 4, []bool{true, true, true, false}, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(2, 3)
+			if tt.elapsed > 0 {
+				// Use the bucket up, as long ago as elapsed
+				for i := 0; i < 3; i++ {
+					l.take("client")
+				}
+				l.buckets["client"].last = time.Now().Add(-tt.elapsed)
+			}
+			var wait time.Duration
+			for i := 0; i < tt.takes; i++ {
+				var ok bool
+				ok, wait = l.take("client")
+				if ok != tt.want[i] {
+					t.Fatalf("take %d = %v, want %v", i+1, ok, tt.want[i])
+				}
+			}
+			// Allow for the time the test takes
+			if wait > tt.wait || wait < tt.wait-50*time.Millisecond {
+				t.Errorf("wait %s, want %s", wait, tt.wait)
+			}
+			if blocked, _ := l.blocked("client"); !blocked {
+				t.Error("not blocked after running out")
+			}
+			if blocked, _ := l.blocked("someone else"); blocked {
+				t.Error("a client who hasn't asked yet is blocked")
+			}
+		})
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	l.take("full")
+	l.take("empty")
+	l.take("empty")
+	l.buckets["full"].last = time.Now().Add(-time.Second)
+	l.prune()
+	if _, ok := l.buckets["full"]; ok {
+		t.Error("kept a bucket that had filled back up")
+	}
+	if _, ok := l.buckets["empty"]; !ok {
+		t.Error("forgot a bucket that was still empty")
+	}
+}
+
+func TestClientKey64(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "::ffff:192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::99", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+		{"not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		if got := clientKey64(tt.ip); got != tt.want {
+			t.Errorf("clientKey64(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		key     string
+		remotes []string
+		want    []int
+	}{
+		{"ip", "ip.example.com", "ip", []string{"[2001:db8::1]:1", "[2001:db8::1]:2", "[2001:db8::2]:1"}, []int{200, 429, 200}},
+		{"ip64 groups a /64", "ip64.example.com", "ip64", []string{"[2001:db8::1]:1", "[2001:db8::2]:1", "[2001:db8:0:1::1]:1"}, []int{200, 429, 200}},
+		{"ip64 leaves v4 alone", "v4.example.com", "ip64", []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.1:1"}, []int{200, 200, 429}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &RateLimit{Requests: 1, Per: duration(time.Minute), Key: tt.key}
+			if err := rl.compile(); err != nil {
+				t.Fatal(err)
+			}
+			// The shared limiter remembers the last run, start over
+			rl.limiter = newRateLimiter(rl.limiter.rate, rl.Burst)
+			host := tt.host
+			for i, remote := range tt.remotes {
+				r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+				r.RemoteAddr = remote
+				w := httptest.NewRecorder()
+				ok := rl.allow(w, r, host, "")
+				if ok != (tt.want[i] == http.StatusOK) {
+					t.Fatalf("request %d from %s allowed %v, want %d", i+1, remote, ok, tt.want[i])
+				}
+				h := w.Header()
+				if h.Get("RateLimit-Limit") != "1" || h.Get("RateLimit-Policy") != "1;w=60" {
+					t.Errorf("request %d: limit %q, policy %q", i+1, h.Get("RateLimit-Limit"), h.Get("RateLimit-Policy"))
+				}
+				if ok {
+					if h.Get("Retry-After") != "" {
+						t.Errorf("request %d: Retry-After %q on an allowed request", i+1, h.Get("Retry-After"))
+					}
+					continue
+				}
+				if w.Code != http.StatusTooManyRequests {
+					t.Errorf("request %d: status %d", i+1, w.Code)
+				}
+				if h.Get("Retry-After") != "60" || h.Get("RateLimit-Remaining") != "0" || h.Get("RateLimit-Reset") != "60" {
+					t.Errorf("request %d: Retry-After %q, remaining %q, reset %q", i+1, h.Get("Retry-After"), h.Get("RateLimit-Remaining"), h.Get("RateLimit-Reset"))
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitCompile(t *testing.T) {
+	tests := []struct {
+		rl      RateLimit
+		burst   int
+		key     string
+		wantErr bool
+	}{
+		{RateLimit{Requests: 10}, 10, "ip", false},
+		{RateLimit{Requests: 10, Burst: 20, Key: "user"}, 20, "user", false},
+		{RateLimit{}, 0, "", true},
+		{RateLimit{Requests: 1, Key: "cookie"}, 0, "", true},
+	}
+	for _, tt := range tests {
+		err := tt.rl.compile()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%+v compiled, want an error", tt.rl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt.rl, err)
+			continue
+		}
+		if tt.rl.Burst != tt.burst || tt.rl.Key != tt.key || tt.rl.Per != duration(time.Second) {
+			t.Errorf("got burst %d, key %q, per %s", tt.rl.Burst, tt.rl.Key, time.Duration(tt.rl.Per))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rdnsTimeout = 1500 * time.Millisecond
+	// The resolver doesn't tell us TTLs, so these stand in for them
+	rdnsTTL         = 10 * time.Minute
+	rdnsNegativeTTL = time.Minute
+	// Past this many entries expired ones get cleared out on insert
+	rdnsCacheSize = 10000
+)
+
+type rdnsEntry struct {
+	hostname string
+	expires  time.Time
+}
+
+// rdnsCache is a TTL cache of ip to forward confirmed hostname, with ""
+// cached for ips without one
+type rdnsCache struct {
+	mu      sync.Mutex
+	entries map[string]rdnsEntry
+}
+
+var hostnames = &rdnsCache{entries: map[string]rdnsEntry{}}
+
+func (c *rdnsCache) get(ip string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[ip]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.hostname, true
+}
+
+func (c *rdnsCache) put(ip, hostname string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= rdnsCacheSize {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= rdnsCacheSize {
+		// Everything is still fresh, we're being hammered by lots of
+		// addresses, start over rather than grow without bound
+		c.entries = map[string]rdnsEntry{}
+	}
+	c.entries[ip] = rdnsEntry{hostname, now.Add(ttl)}
+}
+
+// resolver returns the resolver to use, -resolver if it's set, otherwise
+// the system's
+func resolver() *net.Resolver {
+	if *resolverAddr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, *resolverAddr)
+		},
+	}
+}
+
+// lookupHostname returns the forward confirmed hostname for ip, that is a
+// PTR name which resolves back to ip. It's empty when there isn't one
+func lookupHostname(ip string) string {
+	if hostname, ok := hostnames.get(ip); ok {
+		rdnsLookups.inc("cached")
+		return hostname
+	}
+
+	hostname, result := confirmedHostname(ip)
+	switch result {
+	case "error":
+		// Don't hold on to a timeout for as long as a real answer
+		hostnames.put(ip, "", rdnsNegativeTTL)
+	case "confirmed":
+		hostnames.put(ip, hostname, rdnsTTL)
+	default:
+		hostnames.put(ip, "", rdnsTTL)
+	}
+	rdnsLookups.inc(result)
+	return hostname
+}
+
+func confirmedHostname(ip string) (string, string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", "none"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+	res := resolver()
+
+	names, err := res.LookupAddr(ctx, ip)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", "none"
+		}
+		return "", "error"
+	}
+
+	for _, name := range names {
+		addrs, err := res.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(parsed) {
+				return strings.TrimSuffix(name, "."), "confirmed"
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "", "none"
+	}
+	return "", "unconfirmed"
+}
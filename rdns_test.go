@@ -0,0 +1,207 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const dnsTypePTR = 12
+
+// testResolver is a DNS server on localhost answering from a map of
+// "name type" to answers, with rcodes for the names that fail
+type testResolver struct {
+	pc      net.PacketConn
+	answers map[string][]dnsRR
+	rcodes  map[string]int
+
+	mu      sync.Mutex
+	queries int
+}
+
+func newTestResolver(t *testing.T) *testResolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &testResolver{pc: pc, answers: map[string][]dnsRR{}, rcodes: map[string]int{}}
+	go res.serve()
+	t.Cleanup(func() { pc.Close() })
+
+	old := *resolverAddr
+	*resolverAddr = pc.LocalAddr().String()
+	t.Cleanup(func() { *resolverAddr = old })
+	return res
+}
+
+func (res *testResolver) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := res.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q, err := parseDNSQuery(buf[:n])
+		if err != nil {
+			continue
+		}
+		name := strings.ToLower(q.name)
+		res.mu.Lock()
+		res.queries++
+		rcode, ok := res.rcodes[name]
+		if !ok {
+			rcode = dnsRcodeSuccess
+		}
+		answers := res.answers[fmt.Sprintf("%s %d", name, q.qtype)]
+		res.mu.Unlock()
+		res.pc.WriteTo(buildDNSResponse(q, rcode, answers, true, "test.", q.udpSize), addr)
+	}
+}
+
+// ptr makes ip point at name, and name at addrs
+func (res *testResolver) ptr(ip, name string, addrs ...string) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	rev := reverseDNSName(net.ParseIP(ip))
+	res.answers[rev+" 12"] = []dnsRR{{dnsTypePTR, appendDNSName(nil, name), 60}}
+	for _, a := range addrs {
+		parsed := net.ParseIP(a)
+		if v4 := parsed.To4(); v4 != nil {
+			res.answers[name+" 1"] = append(res.answers[name+" 1"], dnsRR{dnsTypeA, v4, 60})
+		} else {
+			res.answers[name+" 28"] = append(res.answers[name+" 28"], dnsRR{dnsTypeAAAA, parsed, 60})
+		}
+	}
+}
+
+// rcode makes the reverse lookup of ip fail with rcode
+func (res *testResolver) rcode(ip string, rcode int) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.rcodes[reverseDNSName(net.ParseIP(ip))] = rcode
+}
+
+func (res *testResolver) count() int {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	return res.queries
+}
+
+func reverseDNSName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xF, ip[i]>>4)
+	}
+	return b.String() + "ip6.arpa."
+}
+
+func TestConfirmedHostname(t *testing.T) {
+	res := newTestResolver(t)
+	res.ptr("192.0.2.1", "host.example.test.", "192.0.2.1")
+	res.ptr("192.0.2.2", "liar.example.test.", "198.51.100.7")
+	res.ptr("192.0.2.5", "many.example.test.", "192.0.2.9", "192.0.2.5")
+	res.ptr("2001:db8::1", "v6.example.test.", "2001:db8::1")
+	res.rcode("192.0.2.3", dnsRcodeNXDomain)
+	res.rcode("192.0.2.4", dnsRcodeServFail)
+
+	tests := []struct {
+		ip       string
+		hostname string
+		result   string
+	}{
+		{"192.0.2.1", "host.example.test", "confirmed"},
+		{"192.0.2.2", "", "unconfirmed"},
+		{"192.0.2.3", "", "none"},
+		{"192.0.2.4", "", "error"},
+		{"192.0.2.5", "many.example.test", "confirmed"},
+		{"2001:db8::1", "v6.example.test", "confirmed"},
+		{"not an ip", "", "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			hostname, result := confirmedHostname(tt.ip)
+			if hostname != tt.hostname || result != tt.result {
+				t.Errorf("got %q %s, want %q %s", hostname, result, tt.hostname, tt.result)
+			}
+		})
+	}
+}
+
+func TestLookupHostnameCaches(t *testing.T) {
+	res := newTestResolver(t)
+	res.ptr("192.0.2.10", "cached.example.test.", "192.0.2.10")
+	res.rcode("192.0.2.11", dnsRcodeNXDomain)
+	old := hostnames
+	hostnames = &rdnsCache{entries: map[string]rdnsEntry{}}
+	t.Cleanup(func() { hostnames = old })
+
+	for _, tt := range []struct{ ip, want string }{
+		{"192.0.2.10", "cached.example.test"},
+		{"192.0.2.11", ""},
+	} {
+		if got := lookupHostname(tt.ip); got != tt.want {
+			t.Fatalf("%s is %q, want %q", tt.ip, got, tt.want)
+		}
+		before := res.count()
+		if got := lookupHostname(tt.ip); got != tt.want {
+			t.Fatalf("%s from the cache is %q, want %q", tt.ip, got, tt.want)
+		}
+		if res.count() != before {
+			t.Errorf("%s was looked up again instead of coming from the cache", tt.ip)
+		}
+	}
+}
+
+func TestRDNSCache(t *testing.T) {
+	c := &rdnsCache{entries: map[string]rdnsEntry{}}
+	c.put("192.0.2.1", "a.example.test", time.Minute)
+	c.put("192.0.2.2", "", time.Minute)
+	c.put("192.0.2.3", "old.example.test", -time.Second)
+
+	if h, ok := c.get("192.0.2.1"); !ok || h != "a.example.test" {
+		t.Errorf("got %q %v", h, ok)
+	}
+	if h, ok := c.get("192.0.2.2"); !ok || h != "" {
+		t.Errorf("no hostname wasn't cached, got %q %v", h, ok)
+	}
+	if _, ok := c.get("192.0.2.3"); ok {
+		t.Error("an expired entry came back")
+	}
+	if _, ok := c.get("192.0.2.4"); ok {
+		t.Error("an entry that was never put came back")
+	}
+
+	// Full of fresh entries, it starts over instead of growing
+	for i := 0; i < rdnsCacheSize+1; i++ {
+		c.put(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff), "", time.Minute)
+	}
+	if len(c.entries) > rdnsCacheSize {
+		t.Errorf("the cache grew to %d entries", len(c.entries))
+	}
+}
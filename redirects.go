@@ -0,0 +1,220 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redirects are rules per host, read from -redirects and reloaded along
+// with the config. The first rule to match the path wins:
+//
+//	{
+//		"example.com": [
+//			{"exact": "/old", "to": "/new", "status": 301},
+//			{"prefix": "/blog/", "to": "https://blog.example.com/", "preserve_query": true},
+//			{"regex": "^/u/(\\w+)$", "to": "/users/$1"},
+//			{"prefix": "/static/"}
+//		]
+//	}
+//
+// A prefix rule swaps the prefix for to, a regex rule expands $1 and so on
+// in to, and a rule without a to stops there without redirecting, letting
+// the request through to the site
+
+// redirectRule is one rule, only one of Exact, Prefix and Regex is set
+type redirectRule struct {
+	Exact         string `json:"exact,omitempty"`
+	Prefix        string `json:"prefix,omitempty"`
+	Regex         string `json:"regex,omitempty"`
+	To            string `json:"to,omitempty"`
+	Status        int    `json:"status,omitempty"`
+	PreserveQuery bool   `json:"preserve_query,omitempty"`
+
+	re *regexp.Regexp
+}
+
+var (
+	redirectsMu sync.RWMutex
+	redirects   = map[string][]*redirectRule{}
+)
+
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// defaultRedirects are used when there's no -redirects file, so
+// stopallthe.download still sends everything outside /ing/ there
+const defaultRedirects = `{
+	"stopallthe.download": [
+		{"prefix": "/ing/"},
+		{"prefix": "/", "to": "/ing/", "preserve_query": true}
+	]
+}`
+
+// readRedirects reads and checks the rules in path, falling back to
+// defaultRedirects when it doesn't exist
+func readRedirects(path string) (map[string][]*redirectRule, error) {
+	rules := map[string][]*redirectRule{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		b, err = []byte(defaultRedirects), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+
+	lower := make(map[string][]*redirectRule, len(rules))
+	for host, hostRules := range rules {
+		for i, rule := range hostRules {
+			if err := rule.compile(); err != nil {
+				return nil, fmt.Errorf("%s rule %d: %v", host, i+1, err)
+			}
+		}
+		lower[strings.ToLower(host)] = hostRules
+	}
+	return lower, nil
+}
+
+func (rule *redirectRule) compile() error {
+	set := 0
+	for _, s := range []string{rule.Exact, rule.Prefix, rule.Regex} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("needs exactly one of exact, prefix or regex")
+	}
+
+	if rule.Status == 0 {
+		rule.Status = http.StatusFound
+	}
+	if !redirectStatuses[rule.Status] {
+		return fmt.Errorf("status %d isn't a redirect, use 301, 302, 307 or 308", rule.Status)
+	}
+
+	if rule.Regex != "" {
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return err
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// loadRedirects reads -redirects and, if it's good, switches over to it
+func loadRedirects() error {
+	rules, err := readRedirects(*redirectsPath)
+	if err != nil {
+		return err
+	}
+	redirectsMu.Lock()
+	redirects = rules
+	redirectsMu.Unlock()
+
+	log.Infof("Loaded redirects for %d hosts from %s", len(rules), *redirectsPath)
+	return nil
+}
+
+// match returns where path goes, ok is false when the rule doesn't match
+func (rule *redirectRule) match(path string) (string, bool) {
+	switch {
+	case rule.Exact != "":
+		return rule.To, path == rule.Exact
+	case rule.Prefix != "":
+		if !strings.HasPrefix(path, rule.Prefix) {
+			return "", false
+		}
+		if rule.To == "" {
+			return "", true
+		}
+		return rule.To + strings.TrimPrefix(path, rule.Prefix), true
+	default:
+		idx := rule.re.FindStringSubmatchIndex(path)
+		if idx == nil {
+			return "", false
+		}
+		return string(rule.re.ExpandString(nil, rule.To, path, idx)), true
+	}
+}
+
+// findRedirect returns where a request for host and path goes and with
+// what status, the status is 0 when it isn't redirected
+func findRedirect(host, path, query string) (string, int) {
+	redirectsMu.RLock()
+	rules := redirects[host]
+	redirectsMu.RUnlock()
+
+	for _, rule := range rules {
+		target, ok := rule.match(path)
+		if !ok {
+			continue
+		}
+		if rule.To == "" {
+			return "", 0
+		}
+		if rule.PreserveQuery && query != "" {
+			if strings.Contains(target, "?") {
+				target += "&" + query
+			} else {
+				target += "?" + query
+			}
+		}
+		return target, rule.Status
+	}
+	return "", 0
+}
+
+// redirectMiddleware sends requests on to wherever the redirect rules say
+func redirectMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		target, status := findRedirect(host, r.URL.Path, r.URL.RawQuery)
+		if status == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, target, status)
+		go logRequest(w, r, 0, status)
+	})
+}
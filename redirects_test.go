@@ -0,0 +1,173 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setTestRedirects swaps in rules as the redirects until the test is over
+func setTestRedirects(t *testing.T, rules map[string][]*redirectRule) {
+	redirectsMu.Lock()
+	old := redirects
+	redirects = rules
+	redirectsMu.Unlock()
+	t.Cleanup(func() {
+		redirectsMu.Lock()
+		redirects = old
+		redirectsMu.Unlock()
+	})
+}
+
+// readTestRedirects reads rules from JSON the way -redirects would be
+func readTestRedirects(t *testing.T, rules string) map[string][]*redirectRule {
+	path := filepath.Join(t.TempDir(), "redirects.json")
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := readRedirects(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestFindRedirect(t *testing.T) {
+	setTestRedirects(t, readTestRedirects(t, `{
+		"Example.com": [
+			{"exact": "/old", "to": "/new", "status": 301},
+			{"prefix": "/static/"},
+			{"prefix": "/blog/", "to": "https://blog.example.com/", "preserve_query": true},
+			{"exact": "/docs", "to": "/manual?v=2", "preserve_query": true},
+			{"regex": "^/u/(\\w+)/(\\d+)$", "to": "/users/$1?post=$2", "status": 308},
+			{"regex": "^/u/(?P<name>\\w+)$", "to": "/users/${name}/"},
+			{"prefix": "/", "to": "https://www.example.com/"}
+		]
+	}`))
+
+	tests := []struct {
+		name, host, path, query string
+		target                  string
+		status                  int
+	}{
+		{"exact", "example.com", "/old", "", "/new", 301},
+		{"exact drops the query", "example.com", "/old", "a=1", "/new", 301},
+		{"exact only matches the path", "example.com", "/old/more", "", "https://www.example.com/old/more", 302},
+		{"no to means stop", "example.com", "/static/app.js", "", "", 0},
+		{"prefix", "example.com", "/blog/2017/post", "", "https://blog.example.com/2017/post", 302},
+		{"preserve_query", "example.com", "/blog/", "page=2", "https://blog.example.com/?page=2", 302},
+		{"preserve_query with a query already", "example.com", "/docs", "lang=en", "/manual?v=2&lang=en", 302},
+		{"regex", "example.com", "/u/henry/42", "", "/users/henry?post=42", 308},
+		{"named group", "example.com", "/u/henry", "", "/users/henry/", 302},
+		{"regex doesn't match", "example.com", "/u/hen-ry", "", "https://www.example.com/u/hen-ry", 302},
+		{"first rule wins", "example.com", "/", "", "https://www.example.com/", 302},
+		{"other hosts", "other.com", "/old", "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, status := findRedirect(tt.host, tt.path, tt.query)
+			if target != tt.target || status != tt.status {
+				t.Errorf("findRedirect(%q, %q, %q) = %q, %d, want %q, %d", tt.host, tt.path, tt.query, target, status, tt.target, tt.status)
+			}
+		})
+	}
+}
+
+func TestReadRedirectsErrors(t *testing.T) {
+	tests := []struct {
+		name, rules string
+	}{
+		{"no match", `{"example.com": [{"to": "/"}]}`},
+		{"two matches", `{"example.com": [{"exact": "/a", "prefix": "/a", "to": "/"}]}`},
+		{"not a redirect", `{"example.com": [{"exact": "/a", "to": "/", "status": 200}]}`},
+		{"bad regex", `{"example.com": [{"regex": "(", "to": "/"}]}`},
+		{"not json", `{"example.com": [`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "redirects.json")
+			if err := os.WriteFile(path, []byte(tt.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readRedirects(path); err == nil {
+				t.Error("read them, want an error")
+			}
+		})
+	}
+}
+
+// openTestDB opens a database for the tests that need one, it's left open
+// as clicks are recorded after the response has gone
+func openTestDB(t *testing.T) {
+	if db != nil {
+		return
+	}
+	var err error
+	db, err = bolt.Open("test.db", 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDefaultRedirects checks stopallthe.download behaves the way it did
+// before redirects could be set up, with the gists it used to redirect to
+// now seeded short links
+func TestDefaultRedirects(t *testing.T) {
+	rules, err := readRedirects(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestRedirects(t, rules)
+	openTestDB(t)
+	startShortLinks()
+
+	h := redirectMiddleware(shortLinkMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	tests := []struct {
+		name, url string
+		status    int
+		location  string
+	}{
+		{"root", "/", http.StatusFound, "/ing/"},
+		{"everything else", "/whatever", http.StatusFound, "/ing/whatever"},
+		{"with the query", "/x?y=z", http.StatusFound, "/ing/x?y=z"},
+		{"the site", "/ing/", http.StatusNoContent, ""},
+		{"provision", "/ing/provision", http.StatusFound, "https://gist.githubusercontent.com/HenrySlawniak/c31cedaec491c68631a6f62b5d94a740/raw"},
+		{"install-go", "/ing/install-go", http.StatusFound, "https://gist.githubusercontent.com/HenrySlawniak/1b17dc248f57016ee820a7502d7285ce/raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://stopallthe.download"+tt.url, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+				t.Errorf("got %d to %q, want %d to %q", w.Code, w.Header().Get("Location"), tt.status, tt.location)
+			}
+		})
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 var router *mux.Router
@@ -33,23 +34,44 @@ var router *mux.Router
 func setupRouter() {
 	log.Info("Setting up router")
 	router = mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.Use(accessMiddleware)
+	router.Use(redirectMiddleware)
+	router.Use(shortLinkMiddleware)
+	router.Use(siteMiddleware)
+
+	if *adminHost != "" {
+		setupAdminRoutes(router.Host(*adminHost).Subrouter(), true)
+	}
 
 	slawniakComRouter := router.Host("slawniak.com").PathPrefix("/").Name("slawniak.com").Subrouter()
 	slawniakComRouter.PathPrefix("/").HandlerFunc(indexHandler)
 
-	// This seems so wrong
-	router.Host("ifcfg.org").Name("ifcfg.org").PathPrefix("/").HandlerFunc(ifcfgRootHandler)
-	router.Host("v4.ifcfg.org").Name("ifcfg.org-v4").PathPrefix("/").HandlerFunc(ifcfgRootHandler)
-	router.Host("v6.ifcfg.org").Name("ifcfg.org-v6").PathPrefix("/").HandlerFunc(ifcfgRootHandler)
+	setupIfcfgRoutes(router.Host("ifcfg.org").Name("ifcfg.org").Subrouter(), 0)
+	setupIfcfgRoutes(router.Host("v4.ifcfg.org").Name("ifcfg.org-v4").Subrouter(), 4)
+	setupIfcfgRoutes(router.Host("v6.ifcfg.org").Name("ifcfg.org-v6").Subrouter(), 6)
 
-	router.Host("stopallthe.download").Path("/ing/provision").Handler(http.RedirectHandler("https://gist.githubusercontent.com/HenrySlawniak/c31cedaec491c68631a6f62b5d94a740/raw", http.StatusFound))
-	router.Host("stopallthe.download").Path("/ing/install-go").Handler(http.RedirectHandler("https://gist.githubusercontent.com/HenrySlawniak/1b17dc248f57016ee820a7502d7285ce/raw", http.StatusFound))
+	// Everything else on stopallthe.download is redirected, see redirects.json
 	router.Host("stopallthe.download").Name("stopall").PathPrefix("/ing/").HandlerFunc(stopAllIngHandler)
-	router.Host("stopallthe.download").Name("stopall").PathPrefix("/").HandlerFunc(stopAllRootHandler)
 
 	router.PathPrefix("/").HandlerFunc(indexHandler).Name("catch-all")
 }
 
+// withWriteTimeout replaces the server's WriteTimeout for h with d, or no
+// timeout at all when d is 0, for the handlers that hold responses open
+func withWriteTimeout(d time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if d > 0 {
+			deadline = time.Now().Add(d)
+		}
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+			log.Error(err)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
@@ -58,7 +80,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	if !domainIsRegistered(host) {
 		log.Debugf("Host is %s", host)
 		// Make sure we do this syncronousley
-		addToDomainList(host, true)
+		seenDomain(host)
 	}
 
 	staticFolder := "./sites/" + host
@@ -0,0 +1,297 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ScriptConfig is which files in sites/<host> are run for fastcgi and cgi
+// routes, everything else is served as a static file
+type ScriptConfig struct {
+	// Where the FastCGI server, like php-fpm, listens: host:port or
+	// unix:/path/to.sock. Only for fastcgi
+	Address string `json:"address,omitempty"`
+	// Files with these extensions are scripts, .php for fastcgi and .cgi
+	// for cgi by default
+	Extensions []string `json:"extensions,omitempty"`
+	// Every file under these paths is a script, like /cgi-bin/
+	Paths []string `json:"paths,omitempty"`
+	// The script run for a directory, index.php by default for fastcgi
+	Index string `json:"index,omitempty"`
+	// The script run for paths that aren't a file, for apps that route
+	// everything through one script
+	Fallback string `json:"fallback,omitempty"`
+	// The site's directory as the FastCGI server sees it, when it's
+	// somewhere else, like in a container
+	Root string `json:"root,omitempty"`
+	// Extra environment variables for the scripts
+	Env map[string]string `json:"env,omitempty"`
+	// How long a script can take, 60s by default
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+// scriptHandler runs the scripts in a site for a fastcgi or cgi route
+type scriptHandler struct {
+	host    string
+	kind    string
+	dir     string
+	conf    *ScriptConfig
+	network string
+	address string
+}
+
+func newScriptHandler(host, kind string, conf *ScriptConfig) (*scriptHandler, error) {
+	dir, err := filepath.Abs("./sites/" + host)
+	if err != nil {
+		return nil, err
+	}
+	h := &scriptHandler{host: host, kind: kind, dir: dir, conf: conf}
+
+	if len(conf.Extensions) == 0 && len(conf.Paths) == 0 {
+		if kind == "fastcgi" {
+			conf.Extensions = []string{".php"}
+		} else {
+			conf.Extensions = []string{".cgi"}
+		}
+	}
+	for _, ext := range conf.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			return nil, fmt.Errorf("extension %q has to start with .", ext)
+		}
+	}
+	for i, p := range conf.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path %q has to start with /", p)
+		}
+		if !strings.HasSuffix(p, "/") {
+			conf.Paths[i] = p + "/"
+		}
+	}
+	if kind == "fastcgi" && conf.Index == "" {
+		conf.Index = "index.php"
+	}
+	if conf.Fallback != "" && !strings.HasPrefix(conf.Fallback, "/") {
+		return nil, errors.New("fallback has to start with /")
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = duration(60 * time.Second)
+	}
+
+	if kind == "fastcgi" {
+		switch {
+		case strings.HasPrefix(conf.Address, "unix:"):
+			h.network, h.address = "unix", strings.TrimPrefix(conf.Address, "unix:")
+		case conf.Address != "":
+			h.network, h.address = "tcp", strings.TrimPrefix(conf.Address, "tcp://")
+			if _, _, err := net.SplitHostPort(h.address); err != nil {
+				return nil, fmt.Errorf("address %q has to be host:port or unix:/path", conf.Address)
+			}
+		default:
+			return nil, errors.New("fastcgi needs an address")
+		}
+		if conf.Root == "" {
+			conf.Root = dir
+		}
+	}
+	return h, nil
+}
+
+// isScript is whether the file at name, a path in the site, is run
+func (h *scriptHandler) isScript(name string) bool {
+	for _, ext := range h.conf.Extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	for _, p := range h.conf.Paths {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *scriptHandler) isFile(name string) bool {
+	fi, err := os.Stat(filepath.Join(h.dir, filepath.FromSlash(name)))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// find returns the script a request for urlPath runs, and the path after
+// it, ok is false when it's not for a script
+func (h *scriptHandler) find(urlPath string) (script, pathInfo string, ok bool) {
+	p := path.Clean("/" + urlPath)
+
+	// The first part of the path that's a script runs, like
+	// /index.php/some/page
+	for i := 1; i <= len(p); i++ {
+		if i < len(p) && p[i] != '/' {
+			continue
+		}
+		if name := p[:i]; h.isScript(name) && h.isFile(name) {
+			return name, p[i:], true
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(h.dir, filepath.FromSlash(p)))
+	if err == nil && fi.IsDir() && h.conf.Index != "" {
+		if index := path.Join(p, h.conf.Index); h.isFile(index) {
+			return index, "", true
+		}
+	}
+	if os.IsNotExist(err) && h.conf.Fallback != "" && h.isFile(h.conf.Fallback) {
+		return h.conf.Fallback, "", true
+	}
+	return "", "", false
+}
+
+func (h *scriptHandler) serveSite(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	script, pathInfo, ok := h.find(r.URL.Path)
+	if !ok {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// Scripts can take longer than the server would usually wait
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Duration(h.conf.Timeout)))
+
+	rec := &statusRecorder{ResponseWriter: w}
+	if h.kind == "fastcgi" {
+		h.serveFastCGI(rec, r, script, pathInfo)
+	} else {
+		h.serveCGI(rec, r, script, pathInfo)
+	}
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	go logRequest(rec, r, rec.bytes, rec.code)
+}
+
+func (h *scriptHandler) serveCGI(w http.ResponseWriter, r *http.Request, script, pathInfo string) {
+	file := filepath.Join(h.dir, filepath.FromSlash(script))
+	if fi, err := os.Stat(file); err != nil || fi.Mode()&0111 == 0 {
+		// Rather than serving the script's source
+		log.Errorf("CGI script %s isn't executable", file)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	env := []string{"DOCUMENT_ROOT=" + h.dir, "SERVER_SOFTWARE=henry.sites"}
+	for k, v := range h.conf.Env {
+		env = append(env, k+"="+v)
+	}
+	// The cgi package takes the path info from what's after Root
+	req := r.Clone(r.Context())
+	req.URL.Path = script + pathInfo
+	// The cgi package turns - into _ too, see scriptEnv
+	for k := range req.Header {
+		if strings.Contains(k, "_") {
+			delete(req.Header, k)
+		}
+	}
+	handler := &cgi.Handler{
+		Path:   file,
+		Root:   script,
+		Dir:    filepath.Dir(file),
+		Env:    env,
+		Logger: newServerErrorLog(),
+		Stderr: scriptStderr{file},
+	}
+	handler.ServeHTTP(w, req)
+}
+
+// scriptStderr logs what scripts write to stderr
+type scriptStderr struct {
+	script string
+}
+
+func (s scriptStderr) Write(b []byte) (int, error) {
+	log.Warnf("%s: %s", s.script, strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+// scriptEnv is the CGI environment for running script for r
+func (h *scriptHandler) scriptEnv(r *http.Request, script, pathInfo string) map[string]string {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "henry.sites",
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"SERVER_PROTOCOL":   r.Proto,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     h.conf.Root,
+		"DOCUMENT_URI":      script,
+		"SCRIPT_NAME":       script,
+		"SCRIPT_FILENAME":   path.Join(filepath.ToSlash(h.conf.Root), script),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       GetIP(r),
+		"REMOTE_PORT":       fmt.Sprint(GetPort(r)),
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"HTTP_HOST":         r.Host,
+		// PHP won't run without it, unless cgi.force_redirect is off
+		"REDIRECT_STATUS": "200",
+	}
+	if pathInfo != "" {
+		env["PATH_TRANSLATED"] = path.Join(filepath.ToSlash(h.conf.Root), pathInfo)
+	}
+	if r.ContentLength > 0 {
+		env["CONTENT_LENGTH"] = fmt.Sprint(r.ContentLength)
+	}
+	if r.TLS != nil {
+		env["HTTPS"] = "on"
+	}
+	for k, v := range r.Header {
+		// Proxy is left out so scripts don't take it for HTTP_PROXY
+		if k == "Proxy" || k == "Content-Type" || k == "Content-Length" {
+			continue
+		}
+		// X_Forwarded_User would pass for X-Forwarded-User, which
+		// stripIdentityHeaders doesn't know to take off
+		if strings.Contains(k, "_") {
+			continue
+		}
+		env["HTTP_"+strings.ToUpper(strings.Replace(k, "-", "_", -1))] = strings.Join(v, ", ")
+	}
+	for k, v := range h.conf.Env {
+		env[k] = v
+	}
+	return env
+}
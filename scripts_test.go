@@ -0,0 +1,51 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScriptEnvHeaders(t *testing.T) {
+	h := &scriptHandler{host: "cgi.test", conf: &ScriptConfig{Root: "/srv/www"}}
+
+	r := httptest.NewRequest("GET", "http://cgi.test/index.php?a=1", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.Header["X_forwarded_user"] = []string{"admin"}
+	r.Header["X_Forwarded_Email"] = []string{"admin@example.com"}
+	r.Header.Set("Proxy", "http://evil.test")
+	r.Header.Set("Accept-Language", "en")
+
+	env := h.scriptEnv(r, "/index.php", "")
+	for k, want := range map[string]string{
+		"HTTP_X_FORWARDED_USER":  "alice",
+		"HTTP_X_FORWARDED_EMAIL": "",
+		"HTTP_PROXY":             "",
+		"HTTP_ACCEPT_LANGUAGE":   "en",
+		"QUERY_STRING":           "a=1",
+		"SCRIPT_FILENAME":        "/srv/www/index.php",
+	} {
+		if env[k] != want {
+			t.Errorf("%s is %q, want %q", k, env[k], want)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/go-playground/log"
+	"github.com/gorilla/mux"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Short links, on any host, managed through the admin api. A link is a host
+// and a slug, the path without the leading slash, and where it goes. They're
+// checked after the redirect rules and before the site
+
+const (
+	shortLinkBucket = "shortlinks"
+	// Generated slugs are this long, from shortLinkAlphabet
+	shortLinkLength   = 6
+	shortLinkAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+var slugRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+
+var (
+	errShortLinkNotFound = errors.New("no such link")
+	errShortLinkExists   = errors.New("that slug is already taken")
+)
+
+// shortLink is a link and its clicks
+type shortLink struct {
+	Host      string           `json:"host"`
+	Slug      string           `json:"slug"`
+	Target    string           `json:"target"`
+	Status    int              `json:"status"`
+	Created   time.Time        `json:"created"`
+	Expires   time.Time        `json:"expires,omitzero"`
+	Clicks    int64            `json:"clicks"`
+	LastClick time.Time        `json:"last_click,omitzero"`
+	Referrers map[string]int64 `json:"referrers,omitempty"`
+	Countries map[string]int64 `json:"countries,omitempty"`
+}
+
+func (l *shortLink) expired() bool {
+	return !l.Expires.IsZero() && time.Now().After(l.Expires)
+}
+
+func shortLinkKey(host, slug string) []byte {
+	return []byte(host + "/" + slug)
+}
+
+// shortLinkHosts are the hosts with links, so requests for the others
+// don't need to look in the database
+var (
+	shortLinkHostsMu sync.RWMutex
+	shortLinkHosts   = map[string]int{}
+)
+
+// The gist redirects stopallthe.download had built in, they're the first
+// links when there aren't any yet
+var seedShortLinks = []shortLink{
+	{Host: "stopallthe.download", Slug: "ing/provision", Target: "https://gist.githubusercontent.com/HenrySlawniak/c31cedaec491c68631a6f62b5d94a740/raw"},
+	{Host: "stopallthe.download", Slug: "ing/install-go", Target: "https://gist.githubusercontent.com/HenrySlawniak/1b17dc248f57016ee820a7502d7285ce/raw"},
+}
+
+// startShortLinks seeds the links the first time round and loads which
+// hosts have them
+func startShortLinks() {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(shortLinkBucket)) != nil {
+			return nil
+		}
+		b, err := tx.CreateBucket([]byte(shortLinkBucket))
+		if err != nil {
+			return err
+		}
+		for _, l := range seedShortLinks {
+			l.Status = http.StatusFound
+			l.Created = time.Now().UTC()
+			v, err := json.Marshal(l)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(shortLinkKey(l.Host, l.Slug), v); err != nil {
+				return err
+			}
+		}
+		log.Infof("Seeded %d short links", len(seedShortLinks))
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+	}
+
+	links, err := listShortLinks("")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	shortLinkHostsMu.Lock()
+	for _, l := range links {
+		shortLinkHosts[l.Host]++
+	}
+	shortLinkHostsMu.Unlock()
+}
+
+func getShortLink(host, slug string) (*shortLink, error) {
+	var l *shortLink
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(shortLinkBucket))
+		if b == nil {
+			return errShortLinkNotFound
+		}
+		v := b.Get(shortLinkKey(host, slug))
+		if v == nil {
+			return errShortLinkNotFound
+		}
+		l = &shortLink{}
+		return json.Unmarshal(v, l)
+	})
+	return l, err
+}
+
+// listShortLinks returns the links for host, or every link when host is
+// empty
+func listShortLinks(host string) ([]shortLink, error) {
+	links := []shortLink{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(shortLinkBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var l shortLink
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			if host == "" || l.Host == host {
+				links = append(links, l)
+			}
+			return nil
+		})
+	})
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Host == links[j].Host {
+			return links[i].Slug < links[j].Slug
+		}
+		return links[i].Host < links[j].Host
+	})
+	return links, err
+}
+
+// generateSlug makes up a slug that isn't taken on host
+func generateSlug(b *bolt.Bucket, host string) (string, error) {
+	for tries := 0; tries < 10; tries++ {
+		slug := make([]byte, shortLinkLength)
+		for i := range slug {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(shortLinkAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			slug[i] = shortLinkAlphabet[n.Int64()]
+		}
+		if b.Get(shortLinkKey(host, string(slug))) == nil {
+			return string(slug), nil
+		}
+	}
+	return "", errors.New("couldn't find a free slug")
+}
+
+// createShortLink saves l, making up a slug if it hasn't got one
+func createShortLink(l *shortLink) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(shortLinkBucket))
+		if err != nil {
+			return err
+		}
+		if l.Slug == "" {
+			if l.Slug, err = generateSlug(b, l.Host); err != nil {
+				return err
+			}
+		} else if b.Get(shortLinkKey(l.Host, l.Slug)) != nil {
+			return errShortLinkExists
+		}
+
+		l.Created = time.Now().UTC()
+		v, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return b.Put(shortLinkKey(l.Host, l.Slug), v)
+	})
+	if err == nil {
+		shortLinkHostsMu.Lock()
+		shortLinkHosts[l.Host]++
+		shortLinkHostsMu.Unlock()
+	}
+	return err
+}
+
+// updateShortLink changes the link for host and slug with f
+func updateShortLink(host, slug string, f func(l *shortLink)) (*shortLink, error) {
+	var l shortLink
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(shortLinkBucket))
+		if b == nil {
+			return errShortLinkNotFound
+		}
+		key := shortLinkKey(host, slug)
+		v := b.Get(key)
+		if v == nil {
+			return errShortLinkNotFound
+		}
+		if err := json.Unmarshal(v, &l); err != nil {
+			return err
+		}
+		f(&l)
+		if v, err := json.Marshal(l); err != nil {
+			return err
+		} else {
+			return b.Put(key, v)
+		}
+	})
+	return &l, err
+}
+
+func removeShortLink(host, slug string) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(shortLinkBucket))
+		if b == nil || b.Get(shortLinkKey(host, slug)) == nil {
+			return errShortLinkNotFound
+		}
+		return b.Delete(shortLinkKey(host, slug))
+	})
+	if err == nil {
+		shortLinkHostsMu.Lock()
+		if shortLinkHosts[host]--; shortLinkHosts[host] <= 0 {
+			delete(shortLinkHosts, host)
+		}
+		shortLinkHostsMu.Unlock()
+	}
+	return err
+}
+
+// recordClick counts a click on the link, batched with other clicks so
+// a busy link isn't a write per request
+func recordClick(host, slug, referrer, country string) {
+	err := db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(shortLinkBucket))
+		if b == nil {
+			return nil
+		}
+		key := shortLinkKey(host, slug)
+		v := b.Get(key)
+		if v == nil {
+			// Deleted since
+			return nil
+		}
+		var l shortLink
+		if err := json.Unmarshal(v, &l); err != nil {
+			return err
+		}
+
+		l.Clicks++
+		l.LastClick = time.Now().UTC()
+		if l.Referrers == nil {
+			l.Referrers = map[string]int64{}
+		}
+		if l.Countries == nil {
+			l.Countries = map[string]int64{}
+		}
+		if referrer == "" {
+			referrer = "direct"
+		}
+		if country == "" {
+			country = "unknown"
+		}
+		incrCount(l.Referrers, referrer)
+		incrCount(l.Countries, country)
+
+		v, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// shortLinkMiddleware sends requests for a link to its target
+func shortLinkMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		shortLinkHostsMu.RLock()
+		hasLinks := shortLinkHosts[host] > 0
+		shortLinkHostsMu.RUnlock()
+
+		slug := strings.TrimPrefix(r.URL.Path, "/")
+		if !hasLinks || slug == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		l, err := getShortLink(host, slug)
+		if err == errShortLinkNotFound {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if l.expired() {
+			http.Error(w, "This link has expired", http.StatusGone)
+			go logRequest(w, r, 0, http.StatusGone)
+			return
+		}
+
+		ip := GetIP(r)
+		go recordClick(host, slug, referrerHost(r.Referer()), geoLookup(ip).CountryCode)
+		http.Redirect(w, r, l.Target, l.Status)
+		go logRequest(w, r, 0, l.Status)
+	})
+}
+
+// shortLinkRequest is what the api takes to create or change a link, as
+// form values or JSON
+type shortLinkRequest struct {
+	Host    string `json:"host"`
+	Slug    string `json:"slug"`
+	Target  string `json:"target"`
+	Status  string `json:"status"`
+	Expires string `json:"expires"`
+}
+
+func readShortLinkRequest(r *http.Request) (*shortLinkRequest, error) {
+	req := &shortLinkRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		// Let status be a number or a string in JSON
+		var body struct {
+			shortLinkRequest
+			Status json.Number `json:"status"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		*req = body.shortLinkRequest
+		req.Status = body.Status.String()
+		return req, nil
+	}
+	req.Host = r.FormValue("host")
+	req.Slug = r.FormValue("slug")
+	req.Target = r.FormValue("target")
+	req.Status = r.FormValue("status")
+	req.Expires = r.FormValue("expires")
+	return req, nil
+}
+
+// apply sets the fields of l which are set in req, checking them as it
+// goes
+func (req *shortLinkRequest) apply(l *shortLink) error {
+	if req.Target != "" {
+		u, err := url.Parse(req.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("target has to be an http or https url")
+		}
+		l.Target = req.Target
+	}
+	if req.Status != "" {
+		status, err := strconv.Atoi(req.Status)
+		if err != nil || !redirectStatuses[status] {
+			return errors.New("status has to be 301, 302, 307 or 308")
+		}
+		l.Status = status
+	}
+	switch req.Expires {
+	case "":
+	case "never":
+		l.Expires = time.Time{}
+	default:
+		t, err := parseExpiry(req.Expires)
+		if err != nil {
+			return err
+		}
+		l.Expires = t.UTC()
+	}
+	return nil
+}
+
+// newShortLink checks req and makes a link from it
+func (req *shortLinkRequest) newShortLink() (*shortLink, error) {
+	l := &shortLink{
+		Host:   strings.ToLower(strings.TrimSpace(req.Host)),
+		Slug:   strings.Trim(req.Slug, "/"),
+		Status: http.StatusFound,
+	}
+	if !validDomain(l.Host) {
+		return nil, errors.New("a valid host is required")
+	}
+	if l.Slug != "" && !slugRe.MatchString(l.Slug) {
+		return nil, errors.New("slugs can only have letters, numbers, _, - and . in them, with / between parts")
+	}
+	if req.Target == "" {
+		return nil, errors.New("a target is required")
+	}
+	return l, req.apply(l)
+}
+
+// parseExpiry takes a time, or how long from now like 72h or 30d
+func parseExpiry(s string) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && days > 0 {
+			return time.Now().AddDate(0, 0, days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return time.Now().Add(d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad expiry %q, use a time or a duration like 72h or 30d", s)
+}
+
+// shortLinkSummary is a link with its breakdowns sorted, for the api
+type shortLinkSummary struct {
+	shortLink
+	Referrers []countEntry `json:"referrers"`
+	Countries []countEntry `json:"countries"`
+}
+
+func summarizeShortLink(l *shortLink) shortLinkSummary {
+	return shortLinkSummary{
+		shortLink: *l,
+		Referrers: topCounts(l.Referrers, 0),
+		Countries: topCounts(l.Countries, 0),
+	}
+}
+
+func shortLinksHandler(w http.ResponseWriter, r *http.Request) {
+	links, err := listShortLinks(strings.ToLower(r.URL.Query().Get("host")))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+func createShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readShortLinkRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	l, err := req.newShortLink()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := createShortLink(l); err != nil {
+		code := http.StatusInternalServerError
+		if err == errShortLinkExists {
+			code = http.StatusConflict
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, l)
+}
+
+func shortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	l, err := getShortLink(strings.ToLower(vars["host"]), vars["slug"])
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == errShortLinkNotFound {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summarizeShortLink(l))
+}
+
+func updateShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readShortLinkRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Check it before touching the database
+	if err := req.apply(&shortLink{}); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	l, err := updateShortLink(strings.ToLower(vars["host"]), vars["slug"], func(l *shortLink) {
+		req.apply(l)
+	})
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == errShortLinkNotFound {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+func removeShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := removeShortLink(strings.ToLower(vars["host"]), vars["slug"]); err != nil {
+		code := http.StatusInternalServerError
+		if err == errShortLinkNotFound {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,413 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthConfig puts a route behind HTTP Basic auth, bearer tokens or both
+type AuthConfig struct {
+	// Shown in the login prompt, the host by default
+	Realm string `json:"realm,omitempty"`
+	// A file of user:hash lines, like the one made by htpasswd -B or the
+	// passwd command. Only bcrypt and argon2 hashes are accepted, the file
+	// is reread when it changes
+	Htpasswd string `json:"htpasswd,omitempty"`
+	// Bearer tokens by a name for who has them, the name is what shows up
+	// in the access log
+	Tokens map[string]string `json:"tokens,omitempty"`
+	// How many wrong passwords or tokens an IP gets before it's locked
+	// out, 10 by default
+	MaxFailures int `json:"max_failures,omitempty"`
+	// How long it takes a locked out IP to get all of its tries back, one
+	// comes back every lockout/max_failures. 15m by default
+	Lockout duration `json:"lockout,omitempty"`
+}
+
+// siteAuth checks the credentials for a route with an auth section
+type siteAuth struct {
+	host     string
+	conf     *AuthConfig
+	users    *htpasswdFile
+	failures *rateLimiter
+}
+
+func newSiteAuth(host string, conf *AuthConfig) (*siteAuth, error) {
+	if conf.Htpasswd == "" && len(conf.Tokens) == 0 {
+		return nil, errors.New("auth needs an htpasswd file or some tokens")
+	}
+	for name, token := range conf.Tokens {
+		if token == "" {
+			return nil, fmt.Errorf("token %q is empty", name)
+		}
+	}
+	if conf.Realm == "" {
+		conf.Realm = host
+	}
+	if strings.ContainsAny(conf.Realm, "\"\\") {
+		return nil, errors.New("realm can't have quotes or backslashes in it")
+	}
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = 10
+	}
+	if conf.Lockout <= 0 {
+		conf.Lockout = duration(15 * time.Minute)
+	}
+
+	a := &siteAuth{
+		host:     host,
+		conf:     conf,
+		failures: sharedRateLimiter("auth failures", float64(conf.MaxFailures)/time.Duration(conf.Lockout).Seconds(), conf.MaxFailures),
+	}
+	if conf.Htpasswd != "" {
+		a.users = &htpasswdFile{file: watchedFile{path: conf.Htpasswd}}
+		a.users.file.changed()
+		if err := a.users.load(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+type authKey struct{}
+
+// authIdentity is who r was authenticated as for the access log, - when
+// it wasn't. Turned away requests show why as denied:<user> or
+// locked:<user>
+func authIdentity(r *http.Request) string {
+	if id, ok := r.Context().Value(authKey{}).(string); ok && id != "" {
+		return id
+	}
+	return "-"
+}
+
+func withAuthIdentity(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authKey{}, id))
+}
+
+// authorize checks r's credentials, returning the request to carry on
+// with, or nil when it's already been answered
+func (a *siteAuth) authorize(w http.ResponseWriter, r *http.Request) *http.Request {
+	ip := clientIP(r)
+	key := a.host + " " + clientKey64(ip)
+
+	token := bearerToken(r)
+	name, pass, basic := r.BasicAuth()
+	var user string
+	switch {
+	case token != "" && len(a.conf.Tokens) > 0:
+		user = "token"
+	case basic && a.users != nil:
+		user = url.PathEscape(name)
+	default:
+		a.challenge(w, r, http.StatusUnauthorized)
+		return nil
+	}
+
+	// Locked out IPs are turned away before their credentials are even
+	// looked at, so guessing doesn't cost us any hashing and they're not
+	// told when they got it right
+	if locked, wait := a.failures.blocked(key); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		a.challenge(w, withAuthIdentity(r, "locked:"+user), http.StatusTooManyRequests)
+		return nil
+	}
+
+	var ok bool
+	if user == "token" {
+		if found, valid := a.checkToken(token); valid {
+			user, ok = found, true
+		}
+	} else {
+		ok = a.users.check(name, pass)
+	}
+	if !ok {
+		a.failures.take(key)
+		log.Warnf("Failed login for %s on %s from %s", user, a.host, ip)
+		a.challenge(w, withAuthIdentity(r, "denied:"+user), http.StatusUnauthorized)
+		return nil
+	}
+	// The upstream gets told who it was, not the site's password
+	r.Header.Del("Authorization")
+	name, _ = url.PathUnescape(strings.TrimPrefix(user, "token:"))
+	setIdentityHeaders(r, name, "", "", nil)
+	return withAuthIdentity(r, user)
+}
+
+// The headers telling proxied sites and scripts who logged in
+var identityHeaders = []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Preferred-Username", "X-Forwarded-Groups"}
+
+// stripIdentityHeaders removes identity headers sent by the client, only we
+// get to say who someone is
+func stripIdentityHeaders(r *http.Request) {
+	for _, h := range identityHeaders {
+		r.Header.Del(h)
+	}
+}
+
+// setIdentityHeaders tells whatever serves r who logged in, leaving out
+// what we don't know
+func setIdentityHeaders(r *http.Request, user, email, name string, groups []string) {
+	values := []string{user, email, name, strings.Join(groups, ",")}
+	for i, h := range identityHeaders {
+		v := strings.Map(func(c rune) rune {
+			if c < ' ' || c == 0x7f {
+				return -1
+			}
+			return c
+		}, values[i])
+		if v != "" {
+			r.Header.Set(h, v)
+		}
+	}
+}
+
+// removeCookie keeps a cookie of ours from being passed on with r
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// checkToken returns the name of token, checking every one the same way
+// so timing gives nothing away
+func (a *siteAuth) checkToken(token string) (string, bool) {
+	var found string
+	for name, t := range a.conf.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = name
+		}
+	}
+	return "token:" + url.PathEscape(found), found != ""
+}
+
+// challenge answers r with code, asking for whichever credentials the
+// route takes
+func (a *siteAuth) challenge(w http.ResponseWriter, r *http.Request, code int) {
+	if a.users != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+a.conf.Realm+`", charset="UTF-8"`)
+	}
+	if len(a.conf.Tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="`+a.conf.Realm+`"`)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	n, _ := io.WriteString(w, http.StatusText(code)+"\n")
+	go logRequest(w, r, int64(n), code)
+}
+
+// htpasswdFile is a file of user:hash lines, reread when it changes
+type htpasswdFile struct {
+	file watchedFile
+
+	mu    sync.Mutex
+	users map[string]string
+	// Passwords we've already checked, bcrypt and argon2 are slow on
+	// purpose and a page can be a lot of requests
+	verified map[[sha256.Size]byte]bool
+}
+
+// The most verified passwords we remember before starting over
+const maxVerifiedPasswords = 1024
+
+// load (re)reads the file, complaining about lines we can't use
+func (f *htpasswdFile) load() error {
+	file, err := os.Open(f.file.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			log.Warnf("%s line %d isn't user:hash, skipping it", f.file.path, n)
+			continue
+		}
+		user, hash := line[:i], line[i+1:]
+		if !supportedPasswordHash(hash) {
+			log.Warnf("%s line %d: %s's hash isn't bcrypt or argon2, skipping it", f.file.path, n, user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.users = users
+	f.verified = map[[sha256.Size]byte]bool{}
+	f.mu.Unlock()
+	return nil
+}
+
+// reload rereads the file if it's changed, keeping the users we have when
+// it can't be read
+func (f *htpasswdFile) reload() {
+	if !f.file.changed() {
+		return
+	}
+	if err := f.load(); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("Reloaded %s", f.file.path)
+}
+
+// check says whether password is user's
+func (f *htpasswdFile) check(user, password string) bool {
+	f.reload()
+
+	f.mu.Lock()
+	hash, ok := f.users[user]
+	sum := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	verified := f.verified[sum]
+	f.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if !ok {
+		// Take as long as we would have for a real user, so they can't be
+		// told apart
+		checkPasswordHash(dummyPasswordHash(), password)
+		return false
+	}
+	if !checkPasswordHash(hash, password) {
+		return false
+	}
+
+	f.mu.Lock()
+	if len(f.verified) >= maxVerifiedPasswords {
+		f.verified = map[[sha256.Size]byte]bool{}
+	}
+	f.verified[sum] = true
+	f.mu.Unlock()
+	return true
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("", false)
+	})
+	return dummyHash
+}
+
+func supportedPasswordHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$argon2i$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPasswordHash says whether password matches a bcrypt or argon2 hash
+func checkPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2") {
+		return checkArgon2(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// checkArgon2 checks password against a hash in the usual encoding,
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func checkArgon2(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return false
+	}
+	var memory, passes uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &passes, &threads); err != nil || passes == 0 || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+
+	var got []byte
+	if parts[1] == "argon2id" {
+		got = argon2.IDKey([]byte(password), salt, passes, memory, threads, uint32(len(want)))
+	} else {
+		got = argon2.Key([]byte(password), salt, passes, memory, threads, uint32(len(want)))
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// hashPassword hashes password with bcrypt, or argon2id when asked, for an
+// htpasswd file
+func hashPassword(password string, useArgon2 bool) (string, error) {
+	if !useArgon2 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	const memory, passes, threads = 19 * 1024, 2, 1
+	key := argon2.IDKey([]byte(password), salt, passes, memory, threads, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, passes, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
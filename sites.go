@@ -0,0 +1,245 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Sites are hosts served by more than the files in sites/<host>, set up in
+// the config. Each host has routes by path prefix, the first to match wins:
+//
+//	"sites": {
+//		"app.example.com": [
+//			{"path": "/static/", "type": "static"},
+//			{"path": "/admin/", "type": "proxy", "proxy": {...}, "auth": {"htpasswd": "staff.htpasswd"}},
+//			{"path": "/blog/", "type": "fastcgi", "fastcgi": {"address": "unix:/run/php-fpm.sock"}},
+//			{"path": "/", "type": "proxy", "proxy": {"upstreams": ["http://127.0.0.1:8080"]}}
+//		]
+//	}
+//
+// Requests no route matches are served like any other host
+
+// SiteRoute is how the paths under Path on a host are served
+type SiteRoute struct {
+	// The path prefix, / when empty
+	Path string `json:"path"`
+	// static for the files in sites/<host>, proxy, fastcgi or cgi
+	Type    string        `json:"type"`
+	Proxy   *ProxyConfig  `json:"proxy,omitempty"`
+	FastCGI *ScriptConfig `json:"fastcgi,omitempty"`
+	CGI     *ScriptConfig `json:"cgi,omitempty"`
+	// Credentials needed for the route, whatever its type
+	Auth *AuthConfig `json:"auth,omitempty"`
+	// Or a login with an OpenID Connect provider
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+	// Addresses let in or kept out, on top of the host and global ones
+	Access *AccessRules `json:"access,omitempty"`
+	// How many requests a client can make to the route, on top of the
+	// host's limit
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	handler siteHandler
+	auth    *siteAuth
+	oidc    *siteOIDC
+}
+
+// siteHandler serves the requests for a route, handing the ones it doesn't
+// want to next
+type siteHandler interface {
+	serveSite(w http.ResponseWriter, r *http.Request, next http.Handler)
+}
+
+// compileSites checks the routes for every host, setting up their handlers
+// and lowercasing the hosts
+func compileSites(sites map[string][]*SiteRoute) (map[string][]*SiteRoute, error) {
+	lower := make(map[string][]*SiteRoute, len(sites))
+	for host, routes := range sites {
+		host = strings.ToLower(host)
+		if !validDomain(host) {
+			return nil, fmt.Errorf("site %q isn't a valid host", host)
+		}
+		for i, route := range routes {
+			if err := route.compile(host); err != nil {
+				return nil, fmt.Errorf("site %s route %d: %v", host, i+1, err)
+			}
+		}
+		lower[host] = routes
+	}
+	return lower, nil
+}
+
+func (route *SiteRoute) compile(host string) error {
+	if route.Path == "" {
+		route.Path = "/"
+	}
+	if !strings.HasPrefix(route.Path, "/") {
+		return errors.New("path has to start with /")
+	}
+
+	switch route.Type {
+	case "", "static":
+		route.Type = "static"
+	case "proxy":
+		if route.Proxy == nil {
+			return errors.New("proxy routes need a proxy section")
+		}
+		h, err := newSiteProxy(host, route.Path, route.Proxy)
+		if err != nil {
+			return err
+		}
+		route.handler = h
+	case "fastcgi", "cgi":
+		conf := route.FastCGI
+		if route.Type == "cgi" {
+			conf = route.CGI
+		}
+		if conf == nil {
+			return fmt.Errorf("%s routes need a %s section", route.Type, route.Type)
+		}
+		h, err := newScriptHandler(host, route.Type, conf)
+		if err != nil {
+			return err
+		}
+		route.handler = h
+	default:
+		return fmt.Errorf("unknown type %q, use static, proxy, fastcgi or cgi", route.Type)
+	}
+
+	if route.Access != nil {
+		if err := route.Access.compile(); err != nil {
+			return fmt.Errorf("access: %v", err)
+		}
+	}
+	if route.RateLimit != nil {
+		if err := route.RateLimit.compile(); err != nil {
+			return fmt.Errorf("rate_limit: %v", err)
+		}
+	}
+	if route.Auth != nil && route.OIDC != nil {
+		return errors.New("a route can have auth or oidc, not both")
+	}
+	if route.Auth != nil {
+		a, err := newSiteAuth(host, route.Auth)
+		if err != nil {
+			return err
+		}
+		route.auth = a
+	}
+	if route.OIDC != nil {
+		o, err := newSiteOIDC(host, route.Path, route.OIDC)
+		if err != nil {
+			return fmt.Errorf("oidc: %v", err)
+		}
+		route.oidc = o
+	}
+	return nil
+}
+
+// findSiteRoute returns the first route for host matching path, or nil
+func findSiteRoute(host, path string) *SiteRoute {
+	for _, route := range config().Sites[host] {
+		if route.matches(path) {
+			return route
+		}
+	}
+	return nil
+}
+
+// matches says whether path is under the route, a whole segment at a time.
+// /private/ and /private both cover /private and everything in it, but not
+// /privateer
+func (route *SiteRoute) matches(path string) bool {
+	base := strings.TrimSuffix(route.Path, "/")
+	return path == base || strings.HasPrefix(path, base+"/")
+}
+
+// siteMiddleware checks the credentials and rate limits for the site route
+// requests match and hands them to it, static routes and requests the route
+// doesn't want carry on to the router. Host rate limits apply to every
+// request for the host, site or not
+func siteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		route := findSiteRoute(host, r.URL.Path)
+		if route != nil {
+			stripIdentityHeaders(r)
+			if route.auth != nil {
+				if r = route.auth.authorize(w, r); r == nil {
+					return
+				}
+			}
+			if route.oidc != nil {
+				if r = route.oidc.authorize(w, r); r == nil {
+					return
+				}
+			}
+		}
+
+		if rl := config().HostRateLimit[host]; rl != nil && !rl.allow(w, r, host, "") {
+			return
+		}
+		if route != nil && route.RateLimit != nil && !route.RateLimit.allow(w, r, host, route.Path) {
+			return
+		}
+
+		if route == nil || route.handler == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !domainIsRegistered(host) {
+			seenDomain(host)
+		}
+		route.handler.serveSite(w, r, next)
+	})
+}
+
+// openSites starts anything the routes in sites need running in the
+// background, once they're in use
+func openSites(sites map[string][]*SiteRoute) {
+	for _, routes := range sites {
+		for _, route := range routes {
+			if p, ok := route.handler.(*siteProxy); ok {
+				p.open()
+			}
+		}
+	}
+}
+
+// closeSites lets go of anything held by the routes in sites, once they've
+// been replaced
+func closeSites(sites map[string][]*SiteRoute) {
+	for _, routes := range sites {
+		for _, route := range routes {
+			if p, ok := route.handler.(*siteProxy); ok {
+				p.close()
+			}
+		}
+	}
+}
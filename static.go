@@ -29,6 +29,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -74,7 +75,7 @@ func serveFile(w http.ResponseWriter, r *http.Request, path string) (int64, int)
 	w.Header().Set("Expires", time.Now().Add(1*time.Hour).Format(time.RFC1123))
 	w.Header().Set("ETag", sum.Sum)
 
-	if r.Header.Get("If-None-Match") == sum.Sum {
+	if etagMatches(r, sum.Sum) {
 		go logRequest(w, r, 0, http.StatusNotModified)
 		w.WriteHeader(http.StatusNotModified)
 		return 0, http.StatusNotModified
@@ -85,14 +86,20 @@ func serveFile(w http.ResponseWriter, r *http.Request, path string) (int64, int)
 }
 
 func getFileSum(path string) (*fileSum, error) {
+	// purgeFileSums can be deleting from sums
+	mu.Lock()
 	sum := sums[path]
+	mu.Unlock()
 	if sum != nil {
 		if sum.Time.Add(15*time.Minute).Unix() > time.Now().Unix() {
+			fileSumLookups.inc("miss")
 			return generateAndCacheSum(path)
 		} else {
+			fileSumLookups.inc("hit")
 			return sum, nil
 		}
 	} else {
+		fileSumLookups.inc("miss")
 		return generateAndCacheSum(path)
 	}
 }
@@ -116,12 +123,9 @@ func generateAndCacheSum(path string) (*fileSum, error) {
 		return nil, err
 	}
 
-	summer := sha1.New()
-	summer.Write(cont)
-
 	sum := &fileSum{
 		Time:     time.Now(),
-		Sum:      fmt.Sprintf("sha1-%x", summer.Sum(nil)),
+		Sum:      contentSum(cont),
 		Modified: stat.ModTime(),
 		Size:     len(cont),
 	}
@@ -130,6 +134,25 @@ func generateAndCacheSum(path string) (*fileSum, error) {
 	return sum, nil
 }
 
+// contentSum is the ETag for a body
+func contentSum(cont []byte) string {
+	return fmt.Sprintf("sha1-%x", sha1.Sum(cont))
+}
+
+// etagMatches is whether the If-None-Match header on r has etag in it
+func etagMatches(r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func readFile(path string) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -144,3 +167,24 @@ func readFile(path string) ([]byte, error) {
 
 	return cont, nil
 }
+
+func fileSumCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(sums)
+}
+
+// purgeFileSums forgets the sums for every path starting with prefix,
+// returning how many there were
+func purgeFileSums(prefix string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	n := 0
+	for path := range sums {
+		if strings.HasPrefix(path, prefix) {
+			delete(sums, path)
+			n++
+		}
+	}
+	return n
+}
@@ -28,11 +28,29 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 var loc, _ = time.LoadLocation("America/Chicago")
 
+// clientIP is the address of whoever made r, taking X-Real-IP from a proxy
+// in front of us on localhost
+func clientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if strings.Contains(addr, "127.0.0.1") || strings.Contains(addr, "[::1]") {
+		if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
+			return xrip
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Error(err)
+	}
+	return ip
+}
+
 func logRequest(w http.ResponseWriter, r *http.Request, bytes int64, responseCode int) {
 	host := r.Host
 	var err error
@@ -44,37 +62,78 @@ func logRequest(w http.ResponseWriter, r *http.Request, bytes int64, responseCod
 		}
 	}
 
-	ip := r.RemoteAddr
+	ip := clientIP(r)
 
-	if strings.Contains(ip, "127.0.0.1") || strings.Contains(ip, "[::1]") {
-		if r.Header.Get("X-Real-IP") != "" {
-			ip = r.Header.Get("X-Real-IP")
-			log.Debug(ip)
-		}
-	}
+	siteAnalytics.record(r, host, ip, bytes, responseCode)
 
-	ip, _, err = net.SplitHostPort(ip)
-	if err != nil {
-		log.Error(err)
+	writeAccessLog(ip, authIdentity(r), r.Method, host, r.URL.Path, r.URL.RawQuery, r.Proto, responseCode, bytes, r.Referer(), r.UserAgent())
+}
+
+// accessLogLine is a line waiting in accessLogQueue
+type accessLogLine struct {
+	ip, user, method, host, path, query, proto string
+	code                                       int
+	bytes                                      int64
+	referer, userAgent                         string
+}
+
+// Lines from DNS and STUN, which can come in faster than we can write them,
+// wait here for a single writer instead of taking a goroutine each
+var (
+	accessLogQueue     = make(chan accessLogLine, 1024)
+	accessLogQueueOnce sync.Once
+)
+
+// queueAccessLog writes a line to the access logs in the background, it's
+// dropped if the writer has too many to get through already
+func queueAccessLog(ip, user, method, host, path, query, proto string, code int, bytes int64, referer, userAgent string) {
+	accessLogQueueOnce.Do(func() {
+		go func() {
+			for l := range accessLogQueue {
+				writeAccessLog(l.ip, l.user, l.method, l.host, l.path, l.query, l.proto, l.code, l.bytes, l.referer, l.userAgent)
+			}
+		}()
+	})
+	select {
+	case accessLogQueue <- accessLogLine{ip, user, method, host, path, query, proto, code, bytes, referer, userAgent}:
+	default:
+		accessLogDropped.inc()
 	}
+}
 
-	// remote_addr - [local_time] "method host path query protocol" response_code bytes_written referer user_agent
+// writeAccessLog writes a line to host's access log and the combined one,
+// it's not only for http, DNS and STUN go through here too
+func writeAccessLog(ip, user, method, host, path, query, proto string, code int, bytes int64, referer, userAgent string) {
+	// remote_addr user [local_time] "method host path query protocol" response_code bytes_written referer user_agent [country asn]
 	logStr := fmt.Sprintf(
-		"%s - [%s] \"%s %s %s %s %s\" %d %d \"%s\" \"%s\"",
+		"%s %s [%s] \"%s %s %s %s %s\" %d %d \"%s\" \"%s\"",
 		ip,
-		time.Now().In(loc).Format("02/Jan/2006:15:04:05 -0700"),
-		r.Method,
+		user,
+		time.Now().In(loc).Format(logTimeFormat),
+		method,
 		host,
-		r.URL.Path,
-		r.URL.RawQuery,
-		r.Proto,
-		responseCode,
+		path,
+		query,
+		proto,
+		code,
 		bytes,
-		r.Referer(),
-		r.UserAgent(),
+		referer,
+		userAgent,
 	)
+	if *accessLogGeo {
+		// "country asn", with - for the ones we don't know
+		geo := geoLookup(ip)
+		country, asn := "-", "-"
+		if geo.CountryCode != "" {
+			country = geo.CountryCode
+		}
+		if geo.ASN != 0 {
+			asn = fmt.Sprintf("AS%d", geo.ASN)
+		}
+		logStr += fmt.Sprintf(" \"%s\" \"%s\"", country, asn)
+	}
 
-	logFile := filepath.Join(".logs", strings.ToLower(host)+".access.log")
+	logFile := filepath.Join(logDir, strings.ToLower(host)+".access.log")
 	if _, err := os.Stat(filepath.Dir(logFile)); os.IsNotExist(err) {
 		os.MkdirAll(filepath.Dir(logFile), 0755)
 	}
@@ -87,7 +146,7 @@ func logRequest(w http.ResponseWriter, r *http.Request, bytes int64, responseCod
 
 	f.WriteString(logStr + "\n")
 
-	logFile2 := filepath.Join(".logs", ".access.log")
+	logFile2 := filepath.Join(logDir, ".access.log")
 	if _, err := os.Stat(filepath.Dir(logFile)); os.IsNotExist(err) {
 		os.MkdirAll(filepath.Dir(logFile), 0755)
 	}
@@ -25,10 +25,6 @@ import (
 	"strings"
 )
 
-func stopAllRootHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "/ing"+r.URL.RequestURI(), http.StatusFound)
-}
-
 func stopAllIngHandler(w http.ResponseWriter, r *http.Request) {
 	serveFile(w, r, "stopall/client"+strings.Replace(r.URL.RequestURI(), "/ing", "", -1))
 }
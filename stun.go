@@ -0,0 +1,339 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A STUN server, RFC 5389, which only answers Binding requests. That's all
+// a client needs to find its reflexive address, the one its NAT maps it to,
+// there's no TURN or RFC 5780 NAT behaviour discovery
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	stunBindingRequest    = 0x0001
+	stunBindingIndication = 0x0011
+	stunBindingSuccess    = 0x0101
+	stunBindingError      = 0x0111
+
+	stunAttrMappedAddress     = 0x0001
+	stunAttrUsername          = 0x0006
+	stunAttrMessageIntegrity  = 0x0008
+	stunAttrErrorCode         = 0x0009
+	stunAttrUnknownAttributes = 0x000A
+	stunAttrXORMappedAddress  = 0x0020
+	stunAttrPriority          = 0x0024
+	stunAttrUseCandidate      = 0x0025
+	stunAttrSoftware          = 0x8022
+	stunAttrFingerprint       = 0x8028
+
+	stunFingerprintXOR = 0x5354554e
+
+	stunTCPIdle = 30 * time.Second
+	// Where the access log lines go
+	stunLogHost = "stun"
+)
+
+// Comprehension required attributes we're fine to ignore, the ones ICE puts
+// in connectivity checks
+var stunIgnoredAttrs = map[uint16]bool{
+	stunAttrUsername:         true,
+	stunAttrMessageIntegrity: true,
+	stunAttrPriority:         true,
+	stunAttrUseCandidate:     true,
+}
+
+var errNotSTUN = errors.New("stun: not a STUN message")
+
+// stunMessage is a parsed STUN message, the attributes are left as they
+// are
+type stunMessage struct {
+	typ   uint16
+	txID  []byte
+	attrs []stunAttr
+}
+
+type stunAttr struct {
+	typ   uint16
+	value []byte
+}
+
+func parseSTUN(b []byte) (*stunMessage, error) {
+	if len(b) < stunHeaderSize || b[0]&0xC0 != 0 || binary.BigEndian.Uint32(b[4:]) != stunMagicCookie {
+		return nil, errNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || stunHeaderSize+length != len(b) {
+		return nil, errNotSTUN
+	}
+
+	m := &stunMessage{
+		typ:  binary.BigEndian.Uint16(b),
+		txID: b[8:20],
+	}
+	for rest := b[stunHeaderSize:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, errNotSTUN
+		}
+		typ := binary.BigEndian.Uint16(rest)
+		n := int(binary.BigEndian.Uint16(rest[2:]))
+		padded := (n + 3) &^ 3
+		if 4+padded > len(rest) {
+			return nil, errNotSTUN
+		}
+		m.attrs = append(m.attrs, stunAttr{typ, rest[4 : 4+n]})
+		rest = rest[4+padded:]
+	}
+	return m, nil
+}
+
+func (m *stunMessage) attr(typ uint16) []byte {
+	for _, a := range m.attrs {
+		if a.typ == typ {
+			return a.value
+		}
+	}
+	return nil
+}
+
+// stunBuilder writes a STUN message, attribute by attribute
+type stunBuilder struct {
+	b []byte
+}
+
+func newSTUNBuilder(typ uint16, txID []byte) *stunBuilder {
+	b := make([]byte, stunHeaderSize, 128)
+	binary.BigEndian.PutUint16(b, typ)
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], txID)
+	return &stunBuilder{b}
+}
+
+func (s *stunBuilder) add(typ uint16, value []byte) {
+	s.b = binary.BigEndian.AppendUint16(s.b, typ)
+	s.b = binary.BigEndian.AppendUint16(s.b, uint16(len(value)))
+	s.b = append(s.b, value...)
+	for len(s.b)%4 != 0 {
+		s.b = append(s.b, 0)
+	}
+	binary.BigEndian.PutUint16(s.b[2:], uint16(len(s.b)-stunHeaderSize))
+}
+
+// finish adds the fingerprint and returns the message
+func (s *stunBuilder) finish() []byte {
+	// The length has to count the fingerprint before it's worked out
+	binary.BigEndian.PutUint16(s.b[2:], uint16(len(s.b)-stunHeaderSize+8))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(s.b)^stunFingerprintXOR)
+	s.add(stunAttrFingerprint, crc)
+	return s.b
+}
+
+// stunAddress encodes ip and port as a (XOR-)MAPPED-ADDRESS, xor with the
+// cookie and transaction id when txID is set
+func stunAddress(ip net.IP, port int, txID []byte) []byte {
+	family, addr := byte(0x01), ip.To4()
+	if addr == nil {
+		family, addr = 0x02, ip.To16()
+	}
+	addr = append([]byte{}, addr...)
+
+	if txID != nil {
+		port ^= stunMagicCookie >> 16
+		key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+		key = append(key, txID...)
+		for i := range addr {
+			addr[i] ^= key[i]
+		}
+	}
+
+	b := []byte{0, family}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	return append(b, addr...)
+}
+
+// handleSTUN answers msg from addr, the response is nil for anything that
+// doesn't get one
+func handleSTUN(msg []byte, addr net.Addr, proto string) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	m, err := parseSTUN(msg)
+	if err != nil {
+		stunRequests.inc(proto, "invalid")
+		return nil
+	}
+	if m.typ != stunBindingRequest {
+		// Indications are keepalives, and everything else isn't for us
+		if m.typ == stunBindingIndication {
+			stunRequests.inc(proto, "indication")
+		} else {
+			stunRequests.inc(proto, "unsupported")
+		}
+		return nil
+	}
+
+	var unknown []byte
+	for _, a := range m.attrs {
+		if a.typ < 0x8000 && !stunIgnoredAttrs[a.typ] {
+			unknown = binary.BigEndian.AppendUint16(unknown, a.typ)
+		}
+	}
+
+	code := 200
+	var resp *stunBuilder
+	if unknown != nil {
+		code = 420
+		resp = newSTUNBuilder(stunBindingError, m.txID)
+		resp.add(stunAttrErrorCode, append([]byte{0, 0, 4, 20}, "Unknown Attribute"...))
+		resp.add(stunAttrUnknownAttributes, unknown)
+		stunRequests.inc(proto, "error")
+	} else {
+		resp = newSTUNBuilder(stunBindingSuccess, m.txID)
+		resp.add(stunAttrXORMappedAddress, stunAddress(ip, port, m.txID))
+		// For RFC 3489 era clients which don't know the XOR'd one
+		resp.add(stunAttrMappedAddress, stunAddress(ip, port, nil))
+		stunRequests.inc(proto, "success")
+	}
+	resp.add(stunAttrSoftware, []byte("henry.sites"))
+	b := resp.finish()
+
+	software := escapeSTUNSoftware(m.attr(stunAttrSoftware))
+	queueAccessLog(ip.String(), "-", "BINDING", stunLogHost, "/", "port="+strconv.Itoa(port), "STUN/"+proto, code, int64(len(b)), "", software)
+
+	return b
+}
+
+// escapeSTUNSoftware makes a client's SOFTWARE safe for the access log, it
+// goes where a user agent would and can't be allowed to end the line or the
+// quotes around it
+func escapeSTUNSoftware(b []byte) string {
+	var s strings.Builder
+	for len(b) > 0 {
+		r, n := utf8.DecodeRune(b)
+		switch {
+		case r == utf8.RuneError && n == 1, r < ' ', r == 0x7F, r == '"', r == '\\':
+			fmt.Fprintf(&s, "\\x%02x", b[0])
+		default:
+			s.Write(b[:n])
+		}
+		b = b[n:]
+	}
+	return s.String()
+}
+
+// startSTUN starts the STUN server on -stun-listen, over both UDP and TCP
+func startSTUN() {
+	if *stunListen == "" {
+		return
+	}
+
+	pc, err := net.ListenPacket("udp", *stunListen)
+	if err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+	l, err := net.Listen("tcp", *stunListen)
+	if err != nil {
+		log.Fatal(err)
+		panic(err)
+	}
+	log.Info("Serving STUN on " + *stunListen)
+
+	go serveSTUNUDP(pc)
+	go serveSTUNTCP(l)
+}
+
+func serveSTUNUDP(pc net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if resp := handleSTUN(buf[:n], addr, "UDP"); resp != nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+func serveSTUNTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Error(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go serveSTUNConn(conn)
+	}
+}
+
+// serveSTUNConn answers the messages on conn, which are framed by the
+// length in their headers
+func serveSTUNConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(stunTCPIdle))
+		header := make([]byte, stunHeaderSize)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		if header[0]&0xC0 != 0 || binary.BigEndian.Uint32(header[4:]) != stunMagicCookie {
+			// Lost track of the framing, or it was never STUN
+			stunRequests.inc("TCP", "invalid")
+			return
+		}
+		msg := make([]byte, stunHeaderSize+int(binary.BigEndian.Uint16(header[2:])))
+		copy(msg, header)
+		if _, err := io.ReadFull(r, msg[stunHeaderSize:]); err != nil {
+			return
+		}
+
+		if resp := handleSTUN(msg, conn.RemoteAddr(), "TCP"); resp != nil {
+			if _, err := conn.Write(resp); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+)
+
+var testTxID = []byte("0123456789ab")
+
+// testSTUNMessage builds a message with attrs, given as type and value
+// pairs
+func testSTUNMessage(typ uint16, attrs ...interface{}) []byte {
+	s := newSTUNBuilder(typ, testTxID)
+	for i := 0; i < len(attrs); i += 2 {
+		s.add(uint16(attrs[i].(int)), attrs[i+1].([]byte))
+	}
+	return s.b
+}
+
+func TestParseSTUN(t *testing.T) {
+	req := testSTUNMessage(stunBindingRequest, stunAttrSoftware, []byte("abcde"), stunAttrPriority, []byte{1, 2, 3, 4})
+	m, err := parseSTUN(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.typ != stunBindingRequest || !bytes.Equal(m.txID, testTxID) || len(m.attrs) != 2 {
+		t.Fatalf("got %+v", m)
+	}
+	if got := string(m.attr(stunAttrSoftware)); got != "abcde" {
+		t.Errorf("software is %q, the padding shouldn't be in it", got)
+	}
+	if m.attr(stunAttrUsername) != nil {
+		t.Error("found an attribute that isn't there")
+	}
+
+	badCookie := append([]byte{}, req...)
+	badCookie[4] = 0
+	badLength := append([]byte{}, req...)
+	badLength[3] += 4
+	oddLength := append([]byte{}, req...)
+	oddLength[3]--
+	topBits := append([]byte{}, req...)
+	topBits[0] |= 0x80
+	longAttr := testSTUNMessage(stunBindingRequest, stunAttrSoftware, []byte("abcd"))
+	longAttr[stunHeaderSize+3] = 9
+
+	for name, b := range map[string][]byte{
+		"empty":              nil,
+		"short":              req[:stunHeaderSize-1],
+		"wrong cookie":       badCookie,
+		"length past end":    badLength,
+		"length not padded":  oddLength,
+		"top bits set":       topBits,
+		"attribute past end": longAttr,
+		"extra bytes":        append(append([]byte{}, req...), 0, 0, 0, 0),
+		"http":               []byte("GET / HTTP/1.1\r\nHost: stun\r\n\r\n"),
+	} {
+		if m, err := parseSTUN(b); err != errNotSTUN {
+			t.Errorf("%s: got %+v, %v", name, m, err)
+		}
+	}
+}
+
+// The XOR-MAPPED-ADDRESS values from the RFC 5769 test vectors
+func TestSTUNAddress(t *testing.T) {
+	txID, _ := hex.DecodeString("b7e7a701bc34d686fa87dfae")
+	tests := []struct {
+		ip   string
+		txID []byte
+		want string
+	}{
+		{"192.0.2.1", txID, "0001a147e112a643"},
+		{"2001:db8:1234:5678:11:2233:4455:6677", txID, "0002a1470113a9faa5d3f179bc25f4b5bed2b9d9"},
+		{"192.0.2.1", nil, "00018055c0000201"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(stunAddress(net.ParseIP(tt.ip), 32853, tt.txID)); got != tt.want {
+			t.Errorf("%s got %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestHandleSTUN(t *testing.T) {
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 32853}
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		typ     uint16
+		unknown []byte
+	}{
+		{"binding", testSTUNMessage(stunBindingRequest), stunBindingSuccess, nil},
+		{"ice check", testSTUNMessage(stunBindingRequest, stunAttrUsername, []byte("a:b"), stunAttrPriority, []byte{0, 0, 0, 1}, stunAttrUseCandidate, []byte{}, stunAttrMessageIntegrity, make([]byte, 20)), stunBindingSuccess, nil},
+		{"optional attribute", testSTUNMessage(stunBindingRequest, 0x8055, []byte("hi")), stunBindingSuccess, nil},
+		{"unknown attributes", testSTUNMessage(stunBindingRequest, 0x0003, []byte{0, 0, 0, 6}, 0x0019, []byte{17, 0, 0, 0}), stunBindingError, []byte{0, 3, 0, 0x19}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := handleSTUN(tt.msg, from, "UDP")
+			m, err := parseSTUN(b)
+			if err != nil {
+				t.Fatalf("bad response %x", b)
+			}
+			if m.typ != tt.typ || !bytes.Equal(m.txID, testTxID) {
+				t.Errorf("got type %04x for %x", m.typ, m.txID)
+			}
+
+			// The fingerprint is last, and covers everything before it
+			last := m.attrs[len(m.attrs)-1]
+			if last.typ != stunAttrFingerprint {
+				t.Fatal("no fingerprint")
+			}
+			if want := crc32.ChecksumIEEE(b[:len(b)-8]) ^ stunFingerprintXOR; binary.BigEndian.Uint32(last.value) != want {
+				t.Error("the fingerprint doesn't check out")
+			}
+			if string(m.attr(stunAttrSoftware)) != "henry.sites" {
+				t.Error("no software")
+			}
+
+			if tt.typ == stunBindingSuccess {
+				if got := m.attr(stunAttrXORMappedAddress); !bytes.Equal(got, stunAddress(from.IP, from.Port, testTxID)) {
+					t.Errorf("xor mapped address is %x", got)
+				}
+				if got := m.attr(stunAttrMappedAddress); !bytes.Equal(got, []byte{0, 1, 0x80, 0x55, 192, 0, 2, 1}) {
+					t.Errorf("mapped address is %x", got)
+				}
+				return
+			}
+			if got := m.attr(stunAttrErrorCode); !bytes.Equal(got[:4], []byte{0, 0, 4, 20}) {
+				t.Errorf("error code is %x, want 420", got)
+			}
+			if got := m.attr(stunAttrUnknownAttributes); !bytes.Equal(got, tt.unknown) {
+				t.Errorf("unknown attributes are %x, want %x", got, tt.unknown)
+			}
+		})
+	}
+
+	for name, msg := range map[string][]byte{
+		"indication": testSTUNMessage(stunBindingIndication),
+		"response":   testSTUNMessage(stunBindingSuccess),
+		"garbage":    []byte("hello"),
+	} {
+		if b := handleSTUN(msg, from, "UDP"); b != nil {
+			t.Errorf("%s was answered with %x", name, b)
+		}
+	}
+}
+
+func TestHandleSTUNOverTCPv6(t *testing.T) {
+	from := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4000}
+	m, err := parseSTUN(handleSTUN(testSTUNMessage(stunBindingRequest), from, "TCP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.attr(stunAttrXORMappedAddress); !bytes.Equal(got, stunAddress(from.IP, from.Port, testTxID)) || got[1] != 0x02 {
+		t.Errorf("xor mapped address is %x", got)
+	}
+}
+
+func TestEscapeSTUNSoftware(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"libjingle", "libjingle"},
+		{"pion/1.0 (linux)", "pion/1.0 (linux)"},
+		{"héllo", "héllo"},
+		{"a\nb\r\"c\\", `a\x0ab\x0d\x22c\x5c`},
+		{"\x00\x7f\xff", `\x00\x7f\xff`},
+	}
+	for _, tt := range tests {
+		if got := escapeSTUNSoftware([]byte(tt.in)); got != tt.want {
+			t.Errorf("%q got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// A forged line stays part of the one it was sent in
+	forged := "x\" \"y\"\n192.0.2.99 - [02/Jan/2017:15:04:05 -0600] \"GET a / HTTP/1.1\" 200 0 \"\" \""
+	line := `192.0.2.1 - [02/Jan/2017:15:04:05 -0600] "BINDING stun / port=1 STUN/UDP" 200 88 "" "` + escapeSTUNSoftware([]byte(forged)) + `"`
+	e, err := parseLogLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.IP != "192.0.2.1" || strings.ContainsAny(e.UserAgent, "\"\n") {
+		t.Errorf("got %+v", e)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckConfig is how a proxy route checks its upstreams are up
+type HealthCheckConfig struct {
+	// The path to ask for, / by default
+	Path     string   `json:"path,omitempty"`
+	Interval duration `json:"interval,omitempty"`
+	Timeout  duration `json:"timeout,omitempty"`
+	// The status wanted back, any 2xx or 3xx when 0
+	Status int `json:"status,omitempty"`
+	// How many checks in a row it takes to mark an upstream up or down
+	Healthy   int `json:"healthy,omitempty"`
+	Unhealthy int `json:"unhealthy,omitempty"`
+}
+
+func (hc *HealthCheckConfig) compile() error {
+	if hc == nil {
+		return nil
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if !strings.HasPrefix(hc.Path, "/") {
+		return errors.New("health_check path has to start with /")
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = duration(10 * time.Second)
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = duration(2 * time.Second)
+	}
+	if hc.Healthy <= 0 {
+		hc.Healthy = 2
+	}
+	if hc.Unhealthy <= 0 {
+		hc.Unhealthy = 3
+	}
+	return nil
+}
+
+// proxyUpstream is one backend of a proxy route
+type proxyUpstream struct {
+	name      string
+	target    *url.URL
+	unix      bool
+	transport *http.Transport
+
+	// Requests in flight, counting the time spent streaming the response
+	active   int64
+	requests uint64
+
+	mu sync.Mutex
+	// Failed its health checks
+	down bool
+	// Health checks in a row that disagree with down
+	streak int
+	// Errors in a row, and until when they've taken it out
+	fails        int
+	ejectedUntil time.Time
+	lastError    string
+	lastCheck    time.Time
+}
+
+func newProxyUpstream(i int, raw string) (*proxyUpstream, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	u := &proxyUpstream{
+		name: raw,
+		transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+
+	if strings.HasPrefix(raw, "unix:") {
+		socket := strings.TrimPrefix(raw, "unix:")
+		if socket == "" {
+			return nil, fmt.Errorf("upstream %q needs a socket path", raw)
+		}
+		// The host is only for telling the upstreams apart, the socket is
+		// what gets dialed
+		u.unix = true
+		u.target = &url.URL{Scheme: "http", Host: fmt.Sprintf("unix-%d", i)}
+		u.transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return u, nil
+	}
+
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("upstream %q has to be http://, https:// or unix:", raw)
+	}
+	if target.RawQuery != "" || target.Fragment != "" {
+		return nil, fmt.Errorf("upstream %q can't have a query or fragment", raw)
+	}
+	u.target = target
+	return u, nil
+}
+
+// available is whether u should get requests
+func (u *proxyUpstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down && !now.Before(u.ejectedUntil)
+}
+
+// roundTrip sends req to u, keeping track of how it went
+func (u *proxyUpstream) roundTrip(req *http.Request, conf *ProxyConfig) (*http.Response, error) {
+	atomic.AddInt64(&u.active, 1)
+	atomic.AddUint64(&u.requests, 1)
+	resp, err := u.transport.RoundTrip(req)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		atomic.AddInt64(&u.active, -1)
+		if req.Context().Err() != nil {
+			// The client went away, not the upstream's fault
+			return nil, err
+		}
+		proxyRequests.inc(u.name, "error")
+		u.lastError = err.Error()
+		u.fails++
+		if conf.MaxFails > 0 && u.fails >= conf.MaxFails {
+			u.ejectedUntil = time.Now().Add(time.Duration(conf.FailTimeout))
+			u.fails = 0
+			log.Warnf("Upstream %s failed %d times in a row, taking it out for %s", u.name, conf.MaxFails, time.Duration(conf.FailTimeout))
+		}
+		return nil, err
+	}
+
+	proxyRequests.inc(u.name, "response")
+	u.fails = 0
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			atomic.AddInt64(&u.active, -1)
+		})
+	}
+	// Upgraded connections need to stay writable
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &upstreamConn{rwc, done}
+	} else {
+		resp.Body = &upstreamBody{resp.Body, done}
+	}
+	return resp, nil
+}
+
+// upstreamBody and upstreamConn count a request as finished when the
+// response is closed
+type upstreamBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *upstreamBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+type upstreamConn struct {
+	io.ReadWriteCloser
+	done func()
+}
+
+func (c *upstreamConn) Close() error {
+	c.done()
+	return c.ReadWriteCloser.Close()
+}
+
+// pick chooses an upstream for a request from ip, leaving out the ones
+// already tried. When none are available it tries the ones that aren't, and
+// returns nil once they've all been tried
+func (p *siteProxy) pick(ip string, tried map[*proxyUpstream]bool) *proxyUpstream {
+	now := time.Now()
+	var candidates, fallback []*proxyUpstream
+	for _, u := range p.upstreams {
+		if tried[u] {
+			continue
+		}
+		if u.available(now) {
+			candidates = append(candidates, u)
+		} else {
+			fallback = append(fallback, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.conf.LoadBalancing {
+	case "least_conn":
+		// Starting somewhere different each time spreads out the ties
+		start := int(atomic.AddUint32(&p.next, 1))
+		var best *proxyUpstream
+		for i := range candidates {
+			u := candidates[(start+i)%len(candidates)]
+			if best == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+				best = u
+			}
+		}
+		return best
+	case "ip_hash":
+		// Rendezvous hashing, so an upstream going away only moves its own
+		// clients
+		var best *proxyUpstream
+		var bestScore uint64
+		for _, u := range candidates {
+			h := fnv.New64a()
+			io.WriteString(h, ip)
+			io.WriteString(h, u.name)
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = u, score
+			}
+		}
+		return best
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return candidates[int(n-1)%len(candidates)]
+}
+
+// healthChecks checks every upstream each interval until the proxy is
+// closed
+func (p *siteProxy) healthChecks() {
+	hc := p.conf.HealthCheck
+	t := time.NewTicker(time.Duration(hc.Interval))
+	defer t.Stop()
+	for {
+		for _, u := range p.upstreams {
+			go p.check(u)
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (p *siteProxy) check(u *proxyUpstream) {
+	hc := p.conf.HealthCheck
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hc.Timeout))
+	defer cancel()
+
+	target := strings.TrimSuffix(u.target.String(), "/") + hc.Path
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if p.conf.PreserveHost || u.unix {
+		req.Host = p.host
+	}
+	req.Header.Set("User-Agent", "henry.sites health check")
+
+	resp, err := u.transport.RoundTrip(req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if (hc.Status == 0 && resp.StatusCode >= 400) || (hc.Status != 0 && resp.StatusCode != hc.Status) {
+			err = fmt.Errorf("health check got %s", resp.Status)
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastCheck = time.Now()
+	if err != nil {
+		u.lastError = err.Error()
+	}
+	if (err != nil) != u.down {
+		u.streak++
+	} else {
+		u.streak = 0
+	}
+
+	switch {
+	case u.down && u.streak >= hc.Healthy:
+		u.down, u.streak = false, 0
+		log.Noticef("Upstream %s for %s%s is up", u.name, p.host, p.path)
+	case !u.down && u.streak >= hc.Unhealthy:
+		u.down, u.streak = true, 0
+		log.Warnf("Upstream %s for %s%s is down: %v", u.name, p.host, p.path, err)
+	}
+}
+
+// upstreamStatus is how an upstream is doing, for the admin api
+type upstreamStatus struct {
+	Site         string    `json:"site"`
+	Path         string    `json:"path"`
+	Upstream     string    `json:"upstream"`
+	Healthy      bool      `json:"healthy"`
+	EjectedUntil time.Time `json:"ejected_until,omitzero"`
+	Active       int64     `json:"active"`
+	Requests     uint64    `json:"requests"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastCheck    time.Time `json:"last_check,omitzero"`
+}
+
+// upstreamStatuses returns the status of every proxy route's upstreams
+func upstreamStatuses() []upstreamStatus {
+	sites := config().Sites
+	hosts := make([]string, 0, len(sites))
+	for host := range sites {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	statuses := []upstreamStatus{}
+	now := time.Now()
+	for _, host := range hosts {
+		for _, route := range sites[host] {
+			p, ok := route.handler.(*siteProxy)
+			if !ok {
+				continue
+			}
+			for _, u := range p.upstreams {
+				u.mu.Lock()
+				s := upstreamStatus{
+					Site:      host,
+					Path:      route.Path,
+					Upstream:  u.name,
+					Healthy:   !u.down,
+					Active:    atomic.LoadInt64(&u.active),
+					Requests:  atomic.LoadUint64(&u.requests),
+					LastError: u.lastError,
+					LastCheck: u.lastCheck,
+				}
+				if now.Before(u.ejectedUntil) {
+					s.EjectedUntil = u.ejectedUntil
+				}
+				u.mu.Unlock()
+				statuses = append(statuses, s)
+			}
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ifcfg's /watch streams your IP with Server-Sent Events. The stream is
+// closed every so often, and the browser reconnecting is what notices a new
+// address. EventSource sends the last event id when it reconnects, and the
+// id is the IP, so we can tell it when it's changed
+
+const (
+	watchDefaultInterval = 30 * time.Second
+	watchMinInterval     = 5 * time.Second
+	watchMaxInterval     = 5 * time.Minute
+	// How long a stream lasts before the client has to reconnect
+	watchStreamLifetime = 10 * time.Minute
+	// How soon EventSource should reconnect, in milliseconds
+	watchRetry = 3000
+)
+
+// watchEvent is the data of the events on /watch
+type watchEvent struct {
+	IP         string    `json:"ip"`
+	IPVersion  int       `json:"ip_version"`
+	Port       int       `json:"port"`
+	PreviousIP string    `json:"previous_ip,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func ifcfgWatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Accept") != "text/event-stream" && r.URL.Query().Get("stream") == "" {
+		ifcfgWatchPage(w, r)
+		return
+	}
+
+	interval := watchDefaultInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			interval = time.Duration(n) * time.Second
+		}
+		if interval < watchMinInterval {
+			interval = watchMinInterval
+		}
+		if interval > watchMaxInterval {
+			interval = watchMaxInterval
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Server", "ifcfg.org")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream when it's in front
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ip := GetIP(r)
+	var n int64
+	send := func(event string, v interface{}) error {
+		data, _ := json.Marshal(v)
+		written, err := fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", event, ip, data)
+		n += int64(written)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	current := func() watchEvent {
+		return watchEvent{IP: ip, IPVersion: ipVersion(ip), Port: GetPort(r), Time: time.Now().UTC()}
+	}
+
+	written, _ := fmt.Fprintf(w, "retry: %d\n\n", watchRetry)
+	n += int64(written)
+
+	ev := current()
+	err := send("ip", ev)
+	if previous := r.Header.Get("Last-Event-ID"); err == nil && previous != "" && previous != ip {
+		ev.PreviousIP = previous
+		err = send("change", ev)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	end := time.After(watchStreamLifetime)
+	for done := err != nil; !done; {
+		select {
+		case <-ticker.C:
+			done = send("ip", current()) != nil
+		case <-end:
+			// Closing the stream makes the browser reconnect, which is
+			// how it finds out about a new address
+			send("reconnect", current())
+			done = true
+		case <-r.Context().Done():
+			done = true
+		}
+	}
+
+	go logRequest(w, r, n, http.StatusOK)
+}
+
+func ifcfgWatchPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "ifcfg.org")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	n, _ := w.Write([]byte(ifcfgWatchHTML))
+	go logRequest(w, r, int64(n), http.StatusOK)
+}
+
+const ifcfgWatchHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ifcfg.org - watching your IP</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+#ip { font-family: monospace; font-size: 2em; }
+#log { font-family: monospace; }
+.change { color: #c00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Your IP</h1>
+<p id="ip">Connecting...</p>
+<p id="status"></p>
+<h2>Changes</h2>
+<ul id="log"></ul>
+<script>
+var es = new EventSource(location.pathname + "?stream=1" + location.search.replace("?", "&"));
+var last = null;
+
+function note(text, className) {
+	var li = document.createElement("li");
+	li.textContent = new Date().toLocaleString() + " " + text;
+	if (className) {
+		li.className = className;
+	}
+	document.getElementById("log").prepend(li);
+}
+
+function update(e) {
+	var info = JSON.parse(e.data);
+	document.getElementById("ip").textContent = info.ip;
+	document.getElementById("status").textContent = "Last checked " + new Date().toLocaleTimeString();
+	if (last !== null && last !== info.ip) {
+		note(last + " changed to " + info.ip, "change");
+		document.title = "Changed: " + info.ip;
+	} else if (last === null) {
+		note("Started watching, " + info.ip);
+	}
+	last = info.ip;
+}
+
+es.addEventListener("ip", update);
+es.addEventListener("change", update);
+es.onerror = function() {
+	document.getElementById("status").textContent = "Reconnecting...";
+};
+</script>
+</body>
+</html>
+`